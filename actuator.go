@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+)
+
+// Output is an auxiliary relay the thermostat drives alongside the main
+// heating/cooling call.
+type Output string
+
+const (
+	OutputHumidifier   Output = "humidifier"
+	OutputDehumidifier Output = "dehumidifier"
+)
+
+var (
+	actuatorMutex sync.RWMutex
+	outputStates  = map[Output]bool{}
+)
+
+// SetOutput switches an output and logs the change with its reason. It is a
+// no-op if the output is already in the requested state.
+func SetOutput(output Output, on bool, reason string) {
+	actuatorMutex.Lock()
+	if outputStates[output] == on {
+		actuatorMutex.Unlock()
+		return
+	}
+	outputStates[output] = on
+	actuatorMutex.Unlock()
+
+	state := "off"
+	if on {
+		state = "on"
+	}
+	LogEvent("actuator", string(output)+" "+state+": "+reason, "system", "info")
+}
+
+func OutputState(output Output) bool {
+	actuatorMutex.RLock()
+	defer actuatorMutex.RUnlock()
+	return outputStates[output]
+}
+
+// GetOutputStates returns a snapshot of every output that has been driven.
+func GetOutputStates() map[Output]bool {
+	actuatorMutex.RLock()
+	defer actuatorMutex.RUnlock()
+	states := make(map[Output]bool, len(outputStates))
+	for o, on := range outputStates {
+		states[o] = on
+	}
+	return states
+}
@@ -146,8 +146,8 @@ func IsTechnicianAccessAllowed(db *sql.DB, username string) bool {
 		"SELECT expires_at FROM guest_access WHERE guest_username = ? AND expires_at > ? ORDER BY expires_at DESC LIMIT 1",
 		username, time.Now(),
 	).Scan(&expiresAt)
-	// Access only allowed if there is a non-expired grant
-	return err == nil && time.Now().Before(expiresAt)
+	// Access only allowed if there is a non-expired grant for an open service ticket
+	return err == nil && time.Now().Before(expiresAt) && technicianHasOpenTicket(username)
 }
 
 func incrementFailedLogin(username string) error {
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultHeatSetpoint      = 20.0
+	DefaultCoolSetpoint      = 24.0
+	DefaultAutoDeadband      = 1.5  // minimum °C between heat and cool setpoints
+	DefaultChangeoverMinutes = 10.0 // minimum idle time before switching heat<->cool
+)
+
+func autoDeadband() float64 {
+	return GetSettingFloat("auto_min_deadband", DefaultAutoDeadband)
+}
+
+func autoChangeoverDelay() time.Duration {
+	return time.Duration(GetSettingFloat("auto_changeover_minutes", DefaultChangeoverMinutes) * float64(time.Minute))
+}
+
+// ValidateAutoSetpoints checks both setpoints are in the safe range and at
+// least the configured deadband apart.
+func ValidateAutoSetpoints(heat, cool float64) error {
+	if err := ValidateTemperatureInput(heat); err != nil {
+		return err
+	}
+	if err := ValidateTemperatureInput(cool); err != nil {
+		return err
+	}
+	if deadband := autoDeadband(); cool-heat < deadband {
+		return fmt.Errorf("cool setpoint must be at least %.1f°C above heat setpoint", deadband)
+	}
+	return nil
+}
+
+func SetAutoSetpoints(heat, cool float64, user *User) error {
+	if err := ValidateAutoSetpoints(heat, cool); err != nil {
+		AuditSecurityEvent("invalid_temp", fmt.Sprintf("Invalid auto setpoints attempted: %.1f/%.1f", heat, cool), user.Username)
+		return err
+	}
+	hvacMutex.Lock()
+	defer hvacMutex.Unlock()
+	hvacState.HeatSetpoint = heat
+	hvacState.CoolSetpoint = cool
+	hvacState.TargetTemp = (heat + cool) / 2
+	hvacState.LastUpdate = time.Now()
+	recordHVACState()
+	LogEvent("hvac_temp_change", fmt.Sprintf("Auto setpoints changed to heat %.1f / cool %.1f", heat, cool), user.Username, "info")
+	return nil
+}
+
+// SetAutoModeSettings changes the minimum deadband and changeover delay. If
+// the current setpoints are now too close, the cool setpoint is raised.
+func SetAutoModeSettings(deadband, changeoverMinutes float64, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change auto mode settings")
+	}
+	if deadband < 1 || deadband > 5 {
+		return errors.New("deadband must be 1-5°C")
+	}
+	if changeoverMinutes < 5 || changeoverMinutes > 60 {
+		return errors.New("changeover delay must be 5-60 minutes")
+	}
+	if err := SetSettingFloat("auto_min_deadband", deadband, user.Username); err != nil {
+		return err
+	}
+	if err := SetSettingFloat("auto_changeover_minutes", changeoverMinutes, user.Username); err != nil {
+		return err
+	}
+	hvacMutex.Lock()
+	defer hvacMutex.Unlock()
+	if hvacState.CoolSetpoint-hvacState.HeatSetpoint < deadband {
+		hvacState.CoolSetpoint = hvacState.HeatSetpoint + deadband
+		if hvacState.CoolSetpoint > 35 {
+			hvacState.CoolSetpoint = 35
+			hvacState.HeatSetpoint = 35 - deadband
+		}
+		LogEvent("hvac_temp_change", fmt.Sprintf("Auto setpoints widened to heat %.1f / cool %.1f", hvacState.HeatSetpoint, hvacState.CoolSetpoint), user.Username, "info")
+	}
+	return nil
+}
+
+// selectAutoCall picks heating or cooling for auto mode. A call only changes
+// to the opposite one once the equipment has been idle for the changeover
+// delay, so the system never flips straight from heat to cool.
+// Callers must hold hvacMutex.
+func selectAutoCall(current float64) {
+	var demand HVACMode
+	if current < autoSetpoint(ModeHeat) {
+		demand = ModeHeat
+	} else if current > autoSetpoint(ModeCool) {
+		demand = ModeCool
+	}
+	if demand == "" || demand == hvacState.ActiveCall {
+		return
+	}
+	if hvacState.ActiveCall == "" {
+		hvacState.ActiveCall = demand
+		return
+	}
+	if hvacState.IsRunning || (!lastRunStop.IsZero() && time.Since(lastRunStop) < autoChangeoverDelay()) {
+		return
+	}
+	LogEvent("auto_changeover", fmt.Sprintf("Auto mode changed over from %s to %s at %.1f°C", hvacState.ActiveCall, demand, current), "system", "info")
+	hvacState.ActiveCall = demand
+	controlStrategy.Reset()
+}
+
+// autoSetpoint is the heat or cool setpoint after the occupancy setback and
+// forecast adjustment. Callers must hold hvacMutex.
+func autoSetpoint(call HVACMode) float64 {
+	if call == ModeCool {
+		return applyForecast(ModeCool, applySetback(ModeCool, hvacState.CoolSetpoint))
+	}
+	return applyForecast(ModeHeat, applySetback(ModeHeat, hvacState.HeatSetpoint))
+}
+
+// autoTarget is the setpoint for the active auto call. Callers must hold hvacMutex.
+func autoTarget() float64 {
+	if hvacState.ActiveCall == ModeCool {
+		return autoSetpoint(ModeCool)
+	}
+	return autoSetpoint(ModeHeat)
+}
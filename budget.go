@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BudgetDaily   = "daily"
+	BudgetWeekly  = "weekly"
+	BudgetMonthly = "monthly"
+
+	budgetCheckInterval = 5 * time.Minute
+	budgetMinElapsed    = 0.1 // fraction of a period before usage is projected
+)
+
+// EnergyBudget is a homeowner's limit on electricity (kWh) or total energy
+// cost over a calendar day, week (from Monday) or month.
+type EnergyBudget struct {
+	Period string  // daily, weekly or monthly
+	Unit   string  // kwh or cost
+	Limit  float64 // kWh, or money in the configured currency
+}
+
+// BudgetStatus is a budget's progress through its current period.
+type BudgetStatus struct {
+	EnergyBudget
+	Start     time.Time
+	End       time.Time
+	Used      float64
+	Projected float64 // usage at the end of the period at the current pace
+	AtRisk    bool    // projected to exceed the limit
+}
+
+// BudgetSettings control budget alerts and eco mode, which widens the
+// setpoints by EcoWiden while any budget is at risk.
+type BudgetSettings struct {
+	AlertPercents []int
+	EcoEnabled    bool
+	EcoWiden      float64 // °C
+}
+
+var budgetPeriods = []string{BudgetDaily, BudgetWeekly, BudgetMonthly}
+
+func SetEnergyBudget(b EnergyBudget, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can set energy budgets")
+	}
+	if b.Period != BudgetDaily && b.Period != BudgetWeekly && b.Period != BudgetMonthly {
+		return errors.New("budget period must be daily, weekly or monthly")
+	}
+	if b.Unit != "kwh" && b.Unit != "cost" {
+		return errors.New("budget must be in kwh or cost")
+	}
+	if b.Limit <= 0 || b.Limit > 100000 {
+		return errors.New("budget must be above 0 and at most 100000")
+	}
+	_, err := db.Exec(`INSERT INTO energy_budgets (period, unit, limit_value, updated_by, updated_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(period) DO UPDATE SET unit = excluded.unit, limit_value = excluded.limit_value,
+		updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP`, b.Period, b.Unit, b.Limit, user.Username)
+	if err != nil {
+		return err
+	}
+	LogEvent("budget_set", fmt.Sprintf("%s budget set to %s", budgetLabel(b.Period), formatBudgetAmount(b.Unit, b.Limit)), user.Username, "info")
+	return nil
+}
+
+func ClearEnergyBudget(period string, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can set energy budgets")
+	}
+	result, err := db.Exec("DELETE FROM energy_budgets WHERE period = ?", period)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("no budget set for that period")
+	}
+	LogEvent("budget_set", budgetLabel(period)+" budget removed", user.Username, "info")
+	return nil
+}
+
+// ListEnergyBudgets returns the budgets set, daily first.
+func ListEnergyBudgets() ([]EnergyBudget, error) {
+	rows, err := db.Query("SELECT period, unit, limit_value FROM energy_budgets")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	budgets := []EnergyBudget{}
+	for rows.Next() {
+		var b EnergyBudget
+		if err := rows.Scan(&b.Period, &b.Unit, &b.Limit); err != nil {
+			continue
+		}
+		budgets = append(budgets, b)
+	}
+	order := map[string]int{BudgetDaily: 0, BudgetWeekly: 1, BudgetMonthly: 2}
+	sort.Slice(budgets, func(i, j int) bool { return order[budgets[i].Period] < order[budgets[j].Period] })
+	return budgets, nil
+}
+
+func LoadBudgetSettings() BudgetSettings {
+	s := BudgetSettings{
+		EcoEnabled: GetSetting("budget_eco_enabled", "0") == "1",
+		EcoWiden:   GetSettingFloat("budget_eco_widen", 1),
+	}
+	for _, field := range strings.Split(GetSetting("budget_alert_percents", "50,80,100"), ",") {
+		if p, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+			s.AlertPercents = append(s.AlertPercents, p)
+		}
+	}
+	return s
+}
+
+func SetBudgetSettings(s BudgetSettings, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can change budget alerts")
+	}
+	if len(s.AlertPercents) == 0 || len(s.AlertPercents) > 5 {
+		return errors.New("give 1-5 alert percentages")
+	}
+	fields := []string{}
+	for _, p := range s.AlertPercents {
+		if p < 1 || p > 200 {
+			return errors.New("alert percentages must be 1-200")
+		}
+		fields = append(fields, strconv.Itoa(p))
+	}
+	if s.EcoWiden < 0.5 || s.EcoWiden > 4 {
+		return errors.New("eco mode must widen setpoints by 0.5-4°C")
+	}
+	eco := "0"
+	if s.EcoEnabled {
+		eco = "1"
+	}
+	for _, kv := range [][2]string{
+		{"budget_alert_percents", strings.Join(fields, ",")},
+		{"budget_eco_enabled", eco},
+		{"budget_eco_widen", fmt.Sprintf("%g", s.EcoWiden)},
+	} {
+		if err := SetSetting(kv[0], kv[1], user.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// budgetPeriod returns the local calendar period containing now.
+func budgetPeriod(period string, now time.Time) (time.Time, time.Time) {
+	now = now.Local()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	switch period {
+	case BudgetWeekly:
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7)
+	case BudgetMonthly:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+		return start, start.AddDate(0, 1, 0)
+	}
+	return day, day.AddDate(0, 0, 1)
+}
+
+// EnergyCost is the electricity and gas cost of energy used in [from, to),
+// with the tariff's fixed charges for the time covered.
+func EnergyCost(from, to time.Time) (float64, error) {
+	tariff, _ := ActiveTariff()
+	_, electric, err := energyCosts(tariff, from, to)
+	if err != nil {
+		return 0, err
+	}
+	intervals, err := meteredIntervals(from, to)
+	if err != nil {
+		return 0, err
+	}
+	therms := 0.0
+	for _, m := range intervals {
+		therms += m.Therms
+	}
+	fixed := tariff.DailyCharge * to.Sub(from).Hours() / 24
+	return electric + therms*GetGasRate() + fixed, nil
+}
+
+// budgetUsage is the usage counted against b from the start of its period
+// until now.
+func budgetUsage(b EnergyBudget, start, now time.Time) (float64, error) {
+	if b.Unit == "cost" {
+		return EnergyCost(start, now)
+	}
+	switch b.Period {
+	case BudgetMonthly:
+		return GetMonthlyEnergyUsage(start.Year(), start.Month())
+	case BudgetWeekly:
+		total := 0.0
+		for day := start; !day.After(now); day = day.AddDate(0, 0, 1) {
+			kwh, err := GetDailyEnergyUsage(day)
+			if err != nil {
+				return 0, err
+			}
+			total += kwh
+		}
+		return total, nil
+	}
+	return GetDailyEnergyUsage(now)
+}
+
+// GetBudgetStatuses measures every budget and projects its usage to the end
+// of the period at the pace so far.
+func GetBudgetStatuses(now time.Time) ([]BudgetStatus, error) {
+	budgets, err := ListEnergyBudgets()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []BudgetStatus{}
+	for _, b := range budgets {
+		start, end := budgetPeriod(b.Period, now)
+		used, err := budgetUsage(b, start, now)
+		if err != nil {
+			return nil, err
+		}
+		status := BudgetStatus{EnergyBudget: b, Start: start, End: end, Used: used, Projected: used}
+		// Early in a period there is too little usage to extrapolate from.
+		if elapsed := float64(now.Sub(start)) / float64(end.Sub(start)); elapsed >= budgetMinElapsed {
+			status.Projected = used / elapsed
+		}
+		status.AtRisk = status.Projected > b.Limit
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// EvaluateEnergyBudgets alerts homeowners as each budget passes its alert
+// percentages or is projected to be exceeded, once per period, and runs eco
+// mode while any budget is at risk. It must not be called with hvacMutex held.
+func EvaluateEnergyBudgets(now time.Time) error {
+	statuses, err := GetBudgetStatuses(now)
+	if err != nil {
+		return err
+	}
+	s := LoadBudgetSettings()
+	atRisk := []string{}
+	for _, status := range statuses {
+		for _, p := range s.AlertPercents {
+			threshold := status.Limit * float64(p) / 100
+			if status.Used >= threshold {
+				sendBudgetAlert(status, fmt.Sprintf("%d%%", p), status.Used, threshold,
+					fmt.Sprintf("%s budget %d%% used: %s of %s", budgetLabel(status.Period), p,
+						formatBudgetAmount(status.Unit, status.Used), formatBudgetAmount(status.Unit, status.Limit)))
+			}
+		}
+		if status.AtRisk {
+			atRisk = append(atRisk, status.Period)
+			sendBudgetAlert(status, "projected", status.Projected, status.Limit,
+				fmt.Sprintf("%s budget at risk: projected %s against %s", budgetLabel(status.Period),
+					formatBudgetAmount(status.Unit, status.Projected), formatBudgetAmount(status.Unit, status.Limit)))
+		}
+	}
+
+	offset, reason := 0.0, ""
+	if s.EcoEnabled && len(atRisk) > 0 {
+		offset = s.EcoWiden
+		reason = fmt.Sprintf("setpoints widened %.1f°C, %s budget at risk", offset, strings.Join(atRisk, " and "))
+	}
+	hvacMutex.Lock()
+	changed := offset != hvacState.EcoOffset
+	hvacState.EcoOffset, hvacState.EcoReason = offset, reason
+	hvacMutex.Unlock()
+	if changed {
+		if offset > 0 {
+			LogEvent("budget_eco", "Eco mode on: "+reason, "system", "info")
+		} else {
+			LogEvent("budget_eco", "Eco mode off: no budget at risk", "system", "info")
+		}
+	}
+	return nil
+}
+
+// sendBudgetAlert notifies homeowners unless this alert was already sent for
+// the budget's current period.
+func sendBudgetAlert(status BudgetStatus, alert string, usage, threshold float64, details string) {
+	result, err := db.Exec("INSERT OR IGNORE INTO energy_budget_alerts (period, period_start, alert) VALUES (?, ?, ?)",
+		status.Period, dbTime(status.Start), alert)
+	if err != nil {
+		LogEvent("budget_error", "Could not record budget alert: "+err.Error(), "system", "warning")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return
+	}
+	LogEvent("budget_alert", details, "system", "warning")
+	usernames, err := activeUsernames("homeowner")
+	if err != nil {
+		LogEvent("budget_error", "Could not look up users to notify: "+err.Error(), "system", "warning")
+		return
+	}
+	label, unit := status.Period, "kWh"
+	if alert == "projected" {
+		label = "projected " + status.Period
+	}
+	if status.Unit == "cost" {
+		unit = GetCurrency()
+	}
+	for _, username := range usernames {
+		SendEnergyUsageAlert(username, label, usage, threshold, unit)
+	}
+}
+
+func formatBudgetAmount(unit string, amount float64) string {
+	if unit == "cost" {
+		return FormatMoney(amount)
+	}
+	return fmt.Sprintf("%.2f kWh", amount)
+}
+
+// budgetLabel capitalises a budget period for messages.
+func budgetLabel(period string) string {
+	if period == "" {
+		return period
+	}
+	return strings.ToUpper(period[:1]) + period[1:]
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Built-in sensor channels. Room sensors are calibrated as "room:<name>".
+const (
+	ChannelTemperature = "temperature"
+	ChannelHumidity    = "humidity"
+	ChannelCO          = "co"
+
+	roomChannelPrefix   = "room:"
+	calibrationSamples  = 5
+	calibrationMinScale = 0.8
+	calibrationMaxScale = 1.2
+)
+
+// calibrationOffsetLimits bounds the offset per channel, in its own units.
+var calibrationOffsetLimits = map[string]float64{
+	ChannelTemperature: 5,
+	ChannelHumidity:    15,
+	ChannelCO:          20,
+}
+
+// Calibration maps a raw reading to a calibrated one as raw*Scale + Offset.
+type Calibration struct {
+	Channel      string
+	Offset       float64
+	Scale        float64
+	CalibratedBy string
+	CalibratedAt time.Time
+}
+
+type CalibrationRecord struct {
+	Channel        string
+	ReferenceValue float64
+	RawValue       float64
+	OldOffset      float64
+	NewOffset      float64
+	OldScale       float64
+	NewScale       float64
+	CalibratedBy   string
+	Timestamp      time.Time
+}
+
+var (
+	calibrationMutex sync.RWMutex
+	calibrations     = map[string]Calibration{}
+)
+
+// LoadCalibrations reads the stored calibration of each built-in channel.
+func LoadCalibrations() error {
+	rows, err := db.Query("SELECT channel, offset_value, scale, calibrated_by, calibrated_at FROM sensor_calibrations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	loaded := map[string]Calibration{}
+	for rows.Next() {
+		var c Calibration
+		if err := rows.Scan(&c.Channel, &c.Offset, &c.Scale, &c.CalibratedBy, &c.CalibratedAt); err != nil {
+			continue
+		}
+		loaded[c.Channel] = c
+	}
+	calibrationMutex.Lock()
+	calibrations = loaded
+	calibrationMutex.Unlock()
+	return nil
+}
+
+func GetCalibration(channel string) Calibration {
+	calibrationMutex.RLock()
+	defer calibrationMutex.RUnlock()
+	if c, ok := calibrations[channel]; ok {
+		return c
+	}
+	return Calibration{Channel: channel, Scale: 1}
+}
+
+// applyCalibration converts a raw reading on a built-in channel.
+func applyCalibration(channel string, raw float64) float64 {
+	c := GetCalibration(channel)
+	return raw*c.Scale + c.Offset
+}
+
+func validateCalibration(channel string, offset, scale float64) error {
+	limit, ok := calibrationOffsetLimits[channel]
+	if strings.HasPrefix(channel, roomChannelPrefix) {
+		limit, ok = 5, true
+		if scale != 1 {
+			return errors.New("room sensors support an offset only")
+		}
+	}
+	if !ok {
+		return fmt.Errorf("unknown sensor channel %q", channel)
+	}
+	if math.Abs(offset) > limit {
+		return fmt.Errorf("offset for %s must be within ±%g", channel, limit)
+	}
+	if scale < calibrationMinScale || scale > calibrationMaxScale {
+		return fmt.Errorf("scale must be %.1f-%.1f", calibrationMinScale, calibrationMaxScale)
+	}
+	return nil
+}
+
+// readRawChannel takes a fresh reading and returns it before calibration.
+func readRawChannel(channel string) (float64, error) {
+	if name, ok := strings.CutPrefix(channel, roomChannelPrefix); ok {
+		sensors, err := ListRoomSensors()
+		if err != nil {
+			return 0, err
+		}
+		for _, s := range sensors {
+			if s.Name == name {
+				temp, err := readRoomSensor(s, time.Now())
+				return temp - s.Offset, err
+			}
+		}
+		return 0, errors.New("sensor not found")
+	}
+	var err error
+	switch channel {
+	case ChannelTemperature:
+		_, err = ReadTemperature()
+	case ChannelHumidity:
+		_, err = ReadHumidity()
+	case ChannelCO:
+		_, err = ReadCO()
+	default:
+		return 0, fmt.Errorf("unknown sensor channel %q", channel)
+	}
+	if err != nil {
+		return 0, err
+	}
+	sensorMutex.RLock()
+	defer sensorMutex.RUnlock()
+	switch channel {
+	case ChannelHumidity:
+		return rawReading.Humidity, nil
+	case ChannelCO:
+		return rawReading.CO, nil
+	}
+	return rawReading.Temperature, nil
+}
+
+// SampleRawChannel averages several fresh raw readings, smoothing noise
+// before they are compared with a reference meter.
+func SampleRawChannel(channel string) (float64, error) {
+	sum := 0.0
+	for i := 0; i < calibrationSamples; i++ {
+		raw, err := readRawChannel(channel)
+		if err != nil {
+			return 0, err
+		}
+		sum += raw
+	}
+	return sum / calibrationSamples, nil
+}
+
+// currentCalibration returns the offset and scale now applied to channel.
+func currentCalibration(channel string) (Calibration, error) {
+	name, ok := strings.CutPrefix(channel, roomChannelPrefix)
+	if !ok {
+		return GetCalibration(channel), nil
+	}
+	c := Calibration{Channel: channel, Scale: 1}
+	err := db.QueryRow("SELECT calibration_offset FROM room_sensors WHERE name = ?", name).Scan(&c.Offset)
+	if err == sql.ErrNoRows {
+		return c, errors.New("sensor not found")
+	}
+	return c, err
+}
+
+// CalibrateChannel compares the channel with a reference meter reading and
+// stores the offset that makes them agree, keeping the current scale (or
+// the given one if scale is non-zero). The change is recorded in the
+// calibration history.
+func CalibrateChannel(channel string, reference, raw, scale float64, user *User) (CalibrationRecord, error) {
+	if user.Role != "technician" && user.Role != "homeowner" {
+		return CalibrationRecord{}, errors.New("only technicians or homeowners can calibrate sensors")
+	}
+	old, err := currentCalibration(channel)
+	if err != nil {
+		return CalibrationRecord{}, err
+	}
+	if scale == 0 {
+		scale = old.Scale
+	}
+	offset := reference - raw*scale
+	if err := validateCalibration(channel, offset, scale); err != nil {
+		return CalibrationRecord{}, err
+	}
+
+	record := CalibrationRecord{
+		Channel:        channel,
+		ReferenceValue: reference,
+		RawValue:       raw,
+		OldOffset:      old.Offset,
+		NewOffset:      offset,
+		OldScale:       old.Scale,
+		NewScale:       scale,
+		CalibratedBy:   user.Username,
+		Timestamp:      time.Now(),
+	}
+	if name, ok := strings.CutPrefix(channel, roomChannelPrefix); ok {
+		_, err = db.Exec("UPDATE room_sensors SET calibration_offset = ? WHERE name = ?", offset, name)
+	} else {
+		_, err = db.Exec(`INSERT INTO sensor_calibrations (channel, offset_value, scale, calibrated_by, calibrated_at) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(channel) DO UPDATE SET offset_value = excluded.offset_value, scale = excluded.scale,
+			calibrated_by = excluded.calibrated_by, calibrated_at = CURRENT_TIMESTAMP`, channel, offset, scale, user.Username)
+	}
+	if err != nil {
+		return CalibrationRecord{}, err
+	}
+	_, err = db.Exec(`INSERT INTO calibration_history (channel, reference_value, raw_value, old_offset, new_offset, old_scale, new_scale, calibrated_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, channel, reference, raw, old.Offset, offset, old.Scale, scale, user.Username)
+	if err != nil {
+		return CalibrationRecord{}, err
+	}
+	if !strings.HasPrefix(channel, roomChannelPrefix) {
+		calibrationMutex.Lock()
+		calibrations[channel] = Calibration{Channel: channel, Offset: offset, Scale: scale, CalibratedBy: user.Username, CalibratedAt: record.Timestamp}
+		calibrationMutex.Unlock()
+		if _, ok := sensorFaultLimits[channel]; ok {
+			// Readings step by the change in offset, which is not a spike
+			markSensorBreak(channel)
+			if err := clearSensorReference(channel, user.Username); err != nil {
+				return CalibrationRecord{}, err
+			}
+		}
+	}
+	LogEvent("sensor_calibration", fmt.Sprintf("%s calibrated against reference %.2f (raw %.2f): offset %+.2f -> %+.2f, scale %.3f -> %.3f",
+		channel, reference, raw, old.Offset, offset, old.Scale, scale), user.Username, "info")
+	return record, nil
+}
+
+// GetCalibrationHistory returns the most recent calibrations, newest first.
+func GetCalibrationHistory(limit int) ([]CalibrationRecord, error) {
+	rows, err := db.Query(`SELECT channel, reference_value, raw_value, old_offset, new_offset, old_scale, new_scale, calibrated_by, timestamp
+		FROM calibration_history ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []CalibrationRecord{}
+	for rows.Next() {
+		var r CalibrationRecord
+		if err := rows.Scan(&r.Channel, &r.ReferenceValue, &r.RawValue, &r.OldOffset, &r.NewOffset, &r.OldScale, &r.NewScale,
+			&r.CalibratedBy, &r.Timestamp); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultChartWidth  = 60
+	DefaultChartHeight = 10
+)
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// hvacStateSample is one row of hvac_state history. In auto mode Mode holds
+// the heat/cool call that was active.
+type hvacStateSample struct {
+	Timestamp  time.Time
+	Mode       string
+	TargetTemp float64
+	IsRunning  bool
+}
+
+// resampleHistory averages history points into width equal columns over
+// [from, to). Columns without data are NaN.
+func resampleHistory(points []SensorHistoryPoint, from, to time.Time, width int) []float64 {
+	sums := make([]float64, width)
+	counts := make([]int, width)
+	span := to.Sub(from)
+	for _, p := range points {
+		col := int(float64(p.Timestamp.Sub(from)) / float64(span) * float64(width))
+		if col < 0 || col >= width {
+			continue
+		}
+		sums[col] += p.Avg * float64(p.Count)
+		counts[col] += p.Count
+	}
+	values := make([]float64, width)
+	for i := range values {
+		values[i] = math.NaN()
+		if counts[i] > 0 {
+			values[i] = sums[i] / float64(counts[i])
+		}
+	}
+	return values
+}
+
+func seriesRange(series ...[]float64) (float64, float64, bool) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, values := range series {
+		for _, v := range values {
+			if math.IsNaN(v) {
+				continue
+			}
+			lo = math.Min(lo, v)
+			hi = math.Max(hi, v)
+		}
+	}
+	return lo, hi, !math.IsInf(lo, 1)
+}
+
+// RenderSparkline draws values as a single row of block characters.
+// Missing values are drawn as blanks.
+func RenderSparkline(values []float64) string {
+	lo, hi, ok := seriesRange(values)
+	if !ok {
+		return strings.Repeat(" ", len(values))
+	}
+	var b strings.Builder
+	for _, v := range values {
+		if math.IsNaN(v) {
+			b.WriteRune(' ')
+			continue
+		}
+		idx := 0
+		if hi > lo {
+			idx = int((v - lo) / (hi - lo) * float64(len(sparkBlocks)-1))
+		}
+		b.WriteRune(sparkBlocks[idx])
+	}
+	return b.String()
+}
+
+// RenderTemperatureChart draws indoor temperature (●) against the target
+// setpoint (─) on a shared axis, height rows tall.
+func RenderTemperatureChart(temps, targets []float64, height int) []string {
+	lo, hi, ok := seriesRange(temps, targets)
+	if !ok {
+		return []string{"(no temperature data)"}
+	}
+	if hi-lo < 1.0 {
+		mid := (hi + lo) / 2
+		lo, hi = mid-0.5, mid+0.5
+	}
+	rowOf := func(v float64) int {
+		return int(math.Round((hi - v) / (hi - lo) * float64(height-1)))
+	}
+	grid := make([][]rune, height)
+	for r := range grid {
+		grid[r] = []rune(strings.Repeat(" ", len(temps)))
+	}
+	for c := range temps {
+		if c < len(targets) && !math.IsNaN(targets[c]) {
+			grid[rowOf(targets[c])][c] = '─'
+		}
+		if !math.IsNaN(temps[c]) {
+			grid[rowOf(temps[c])][c] = '●'
+		}
+	}
+	lines := make([]string, height)
+	for r := range grid {
+		label := hi - (hi-lo)*float64(r)/float64(height-1)
+		lines[r] = fmt.Sprintf("%6.1f°C │%s", label, string(grid[r]))
+	}
+	return lines
+}
+
+// loadHVACStateHistory returns hvac_state rows inside the window, preceded by
+// the last row before it so the state at the start of the window is known.
+func loadHVACStateHistory(from, to time.Time) ([]hvacStateSample, error) {
+	// Rows written in the same second are ordered by id
+	rows, err := db.Query(`SELECT id, timestamp, COALESCE(active_call, mode), COALESCE(target_temp, 0), is_running FROM (
+			SELECT id, timestamp, mode, active_call, target_temp, is_running FROM hvac_state WHERE timestamp < ? ORDER BY timestamp DESC, id DESC LIMIT 1
+		) UNION ALL SELECT id, timestamp, COALESCE(active_call, mode), COALESCE(target_temp, 0), is_running FROM hvac_state WHERE timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, id`, dbTime(from), dbTime(from), dbTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	samples := []hvacStateSample{}
+	for rows.Next() {
+		var id int
+		var s hvacStateSample
+		if err := rows.Scan(&id, &s.Timestamp, &s.Mode, &s.TargetTemp, &s.IsRunning); err != nil {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// hvacColumns derives the setpoint and the fraction of time the equipment was
+// running for each chart column from hvac_state history.
+func hvacColumns(samples []hvacStateSample, from, to time.Time, width int) ([]float64, []float64, []string) {
+	targets := make([]float64, width)
+	running := make([]float64, width)
+	modes := make([]string, width)
+	colSpan := to.Sub(from) / time.Duration(width)
+	for c := 0; c < width; c++ {
+		colStart := from.Add(time.Duration(c) * colSpan)
+		colEnd := colStart.Add(colSpan)
+		targets[c] = math.NaN()
+		var on time.Duration
+		for i, s := range samples {
+			if !s.Timestamp.Before(colEnd) {
+				break
+			}
+			targets[c] = s.TargetTemp
+			modes[c] = s.Mode
+			start, end := s.Timestamp, to
+			if i+1 < len(samples) {
+				end = samples[i+1].Timestamp
+			}
+			if start.Before(colStart) {
+				start = colStart
+			}
+			if end.After(colEnd) {
+				end = colEnd
+			}
+			if s.IsRunning && end.After(start) {
+				on += end.Sub(start)
+			}
+		}
+		running[c] = float64(on) / float64(colSpan)
+	}
+	return targets, running, modes
+}
+
+func renderRunBar(running []float64, modes []string) string {
+	var b strings.Builder
+	for i, frac := range running {
+		switch {
+		case frac >= 0.5 && (modes[i] == string(ModeHeat) || modes[i] == string(ModeEmergencyHeat)):
+			b.WriteRune('H')
+		case frac >= 0.5 && modes[i] == string(ModeCool):
+			b.WriteRune('C')
+		case frac >= 0.5:
+			b.WriteRune('F')
+		case frac > 0:
+			b.WriteRune('░')
+		default:
+			b.WriteRune('·')
+		}
+	}
+	return b.String()
+}
+
+// BuildTrendCharts renders temperature vs. setpoint, humidity, CO and HVAC
+// run periods for the window from stored sensor_readings and hvac_state rows.
+func BuildTrendCharts(from, to time.Time, width int) (string, error) {
+	if !to.After(from) {
+		return "", errors.New("invalid chart window")
+	}
+	if width < 10 || width > 200 {
+		width = DefaultChartWidth
+	}
+	series := map[string][]float64{}
+	for metric := range sensorMetricColumns {
+		points, err := GetSensorHistory(metric, from, to, ResolutionAuto)
+		if err != nil {
+			return "", err
+		}
+		series[metric] = resampleHistory(points, from, to, width)
+	}
+	samples, err := loadHVACStateHistory(from, to)
+	if err != nil {
+		return "", err
+	}
+	targets, running, modes := hvacColumns(samples, from, to, width)
+
+	pad := strings.Repeat(" ", 9)
+	output := fmt.Sprintf("=== TRENDS %s → %s ===\n\n", from.Format("01-02 15:04"), to.Format("01-02 15:04"))
+	output += "Indoor temperature (●) vs target (─)\n"
+	for _, line := range RenderTemperatureChart(series["temperature"], targets, DefaultChartHeight) {
+		output += line + "\n"
+	}
+	output += pad + "└" + strings.Repeat("─", width) + "\n"
+	output += fmt.Sprintf("%s %-*s%s\n\n", pad, width-5, from.Format("15:04"), to.Format("15:04"))
+
+	for _, row := range []struct{ label, metric, unit string }{
+		{"Humidity", "humidity", "%"},
+		{"CO", "co", " ppm"},
+	} {
+		lo, hi, ok := seriesRange(series[row.metric])
+		rangeText := "no data"
+		if ok {
+			rangeText = fmt.Sprintf("%.1f–%.1f%s", lo, hi, row.unit)
+		}
+		output += fmt.Sprintf("%-8s │%s│ %s\n", row.label, RenderSparkline(series[row.metric]), rangeText)
+	}
+	output += fmt.Sprintf("%-8s │%s│ H=heat C=cool F=fan ░=partial\n", "HVAC", renderRunBar(running, modes))
+	return output, nil
+}
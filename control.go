@@ -0,0 +1,448 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	StrategyHysteresis = "hysteresis"
+	StrategyPID        = "pid"
+
+	DefaultPIDKp           = 0.5  // duty per °C of error
+	DefaultPIDKi           = 0.01 // duty per °C·minute of accumulated error
+	DefaultPIDKd           = 0.0  // duty per °C/minute of error change
+	DefaultPIDCycleMinutes = 10.0
+	// Duty cycles below this are treated as off to avoid very short runs.
+	minPIDDuty = 0.05
+)
+
+// ControlStrategy decides when heating or cooling should be called for.
+// Implementations are only called with hvacMutex held.
+type ControlStrategy interface {
+	Name() string
+	// ShouldRun reports whether the equipment should run in mode given the
+	// current and target temperatures and whether it is running now.
+	ShouldRun(mode HVACMode, current, target float64, running bool, now time.Time) bool
+	// Output is the last computed demand in the range 0-1.
+	Output() float64
+	// Reset clears internal state, e.g. after a mode or setpoint change.
+	Reset()
+}
+
+// HysteresisController is the original fixed-band on/off controller.
+type HysteresisController struct {
+	StartBand float64 // start once this far past target
+	StopBand  float64 // stop once this far past target in the other direction
+	output    float64
+}
+
+func NewHysteresisController() *HysteresisController {
+	return &HysteresisController{StartBand: 1.0, StopBand: 0.5}
+}
+
+func (h *HysteresisController) Name() string { return StrategyHysteresis }
+
+func (h *HysteresisController) ShouldRun(mode HVACMode, current, target float64, running bool, now time.Time) bool {
+	run := running
+	switch mode {
+	case ModeHeat:
+		if current < target-h.StartBand {
+			run = true
+		} else if current > target+h.StopBand {
+			run = false
+		}
+	case ModeCool:
+		if current > target+h.StartBand {
+			run = true
+		} else if current < target-h.StopBand {
+			run = false
+		}
+	default:
+		run = false
+	}
+	h.output = 0
+	if run {
+		h.output = 1
+	}
+	return run
+}
+
+func (h *HysteresisController) Output() float64 { return h.output }
+
+func (h *HysteresisController) Reset() { h.output = 0 }
+
+type PIDGains struct {
+	Kp           float64
+	Ki           float64
+	Kd           float64
+	CycleMinutes float64
+}
+
+// PIDController computes a 0-1 demand and turns it into on/off calls by time
+// proportioning: each cycle runs for output*cycle length. The integral term
+// only accumulates while the output is not saturated (anti-windup).
+type PIDController struct {
+	Gains      PIDGains
+	integral   float64
+	lastError  float64
+	lastTime   time.Time
+	output     float64
+	cycleStart time.Time
+	cycleDuty  float64
+}
+
+func NewPIDController(gains PIDGains) *PIDController {
+	if gains.CycleMinutes <= 0 {
+		gains.CycleMinutes = DefaultPIDCycleMinutes
+	}
+	return &PIDController{Gains: gains}
+}
+
+func (p *PIDController) Name() string { return StrategyPID }
+
+func (p *PIDController) ShouldRun(mode HVACMode, current, target float64, running bool, now time.Time) bool {
+	var e float64
+	switch mode {
+	case ModeHeat:
+		e = target - current
+	case ModeCool:
+		e = current - target
+	default:
+		p.Reset()
+		return false
+	}
+
+	dt := 0.0
+	if !p.lastTime.IsZero() {
+		dt = now.Sub(p.lastTime).Minutes()
+	}
+	derivative := 0.0
+	if dt > 0 {
+		derivative = (e - p.lastError) / dt
+	}
+
+	unclamped := p.Gains.Kp*e + p.Gains.Ki*(p.integral+e*dt) + p.Gains.Kd*derivative
+	saturatedHigh := unclamped > 1 && e > 0
+	saturatedLow := unclamped < 0 && e < 0
+	if !saturatedHigh && !saturatedLow {
+		p.integral += e * dt
+	}
+	if p.Gains.Ki > 0 {
+		limit := 1 / p.Gains.Ki
+		p.integral = math.Max(-limit, math.Min(limit, p.integral))
+	}
+	p.output = math.Max(0, math.Min(1, p.Gains.Kp*e+p.Gains.Ki*p.integral+p.Gains.Kd*derivative))
+	p.lastError = e
+	p.lastTime = now
+
+	cycle := time.Duration(p.Gains.CycleMinutes * float64(time.Minute))
+	if p.cycleStart.IsZero() || now.Sub(p.cycleStart) >= cycle {
+		p.cycleStart = now
+		p.cycleDuty = p.output
+	}
+	if p.cycleDuty < minPIDDuty {
+		return false
+	}
+	return now.Sub(p.cycleStart) < time.Duration(p.cycleDuty*float64(cycle))
+}
+
+func (p *PIDController) Output() float64 { return p.output }
+
+func (p *PIDController) Reset() {
+	p.integral = 0
+	p.lastError = 0
+	p.lastTime = time.Time{}
+	p.output = 0
+	p.cycleStart = time.Time{}
+	p.cycleDuty = 0
+}
+
+// LoadPIDGains reads the configured gains, falling back to defaults.
+func LoadPIDGains() PIDGains {
+	return PIDGains{
+		Kp:           GetSettingFloat("pid_kp", DefaultPIDKp),
+		Ki:           GetSettingFloat("pid_ki", DefaultPIDKi),
+		Kd:           GetSettingFloat("pid_kd", DefaultPIDKd),
+		CycleMinutes: GetSettingFloat("pid_cycle_minutes", DefaultPIDCycleMinutes),
+	}
+}
+
+func newControlStrategy(name string) (ControlStrategy, error) {
+	switch name {
+	case StrategyHysteresis:
+		return NewHysteresisController(), nil
+	case StrategyPID:
+		return NewPIDController(LoadPIDGains()), nil
+	}
+	return nil, errors.New("invalid control strategy")
+}
+
+// loadControlStrategy builds the configured strategy. Callers must hold hvacMutex.
+func loadControlStrategy() {
+	strategy, err := newControlStrategy(GetSetting("control_strategy", StrategyHysteresis))
+	if err != nil {
+		strategy = NewHysteresisController()
+	}
+	controlStrategy = strategy
+}
+
+func SetControlStrategy(name string, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change the control strategy")
+	}
+	strategy, err := newControlStrategy(name)
+	if err != nil {
+		return err
+	}
+	if err := SetSetting("control_strategy", name, user.Username); err != nil {
+		return err
+	}
+	hvacMutex.Lock()
+	controlStrategy = strategy
+	hvacMutex.Unlock()
+	LogEvent("control_strategy", "Control strategy set to "+name, user.Username, "info")
+	return nil
+}
+
+func validatePIDGains(gains PIDGains) error {
+	if gains.Kp < 0 || gains.Ki < 0 || gains.Kd < 0 || gains.Kp > 10 || gains.Ki > 1 || gains.Kd > 10 {
+		return errors.New("PID gains out of range")
+	}
+	if gains.CycleMinutes < 5 || gains.CycleMinutes > 60 {
+		return errors.New("cycle length must be 5-60 minutes")
+	}
+	return nil
+}
+
+func SetPIDGains(gains PIDGains, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change PID gains")
+	}
+	if err := validatePIDGains(gains); err != nil {
+		return err
+	}
+	for key, value := range map[string]float64{
+		"pid_kp": gains.Kp, "pid_ki": gains.Ki, "pid_kd": gains.Kd, "pid_cycle_minutes": gains.CycleMinutes,
+	} {
+		if err := SetSettingFloat(key, value, user.Username); err != nil {
+			return err
+		}
+	}
+	hvacMutex.Lock()
+	if pid, ok := controlStrategy.(*PIDController); ok {
+		pid.Gains = gains
+		pid.Reset()
+	}
+	hvacMutex.Unlock()
+	LogEvent("pid_gains", fmt.Sprintf("PID gains set: Kp=%.3f Ki=%.4f Kd=%.3f cycle=%.0fmin", gains.Kp, gains.Ki, gains.Kd, gains.CycleMinutes), user.Username, "info")
+	return nil
+}
+
+type AutotuneResult struct {
+	Gains         PIDGains
+	RunSlope      float64 // °C/minute while equipment ran
+	IdleSlope     float64 // °C/minute while it was idle
+	DeadTime      float64 // minutes from start until the temperature responded
+	RunsAnalysed  int
+	IdlesAnalysed int
+}
+
+type runInterval struct {
+	Start   time.Time
+	End     time.Time
+	Mode    string
+	Running bool
+}
+
+// loadRunIntervals splits hvac_state history into alternating running and
+// idle intervals for heat/cool modes.
+func loadRunIntervals(from, to time.Time) ([]runInterval, error) {
+	samples, err := loadHVACStateHistory(from, to)
+	if err != nil {
+		return nil, err
+	}
+	intervals := []runInterval{}
+	for i, s := range samples {
+		if s.Mode != string(ModeHeat) && s.Mode != string(ModeCool) {
+			continue
+		}
+		end := to
+		if i+1 < len(samples) {
+			end = samples[i+1].Timestamp
+		}
+		start := s.Timestamp
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(start) {
+			intervals = append(intervals, runInterval{Start: start, End: end, Mode: s.Mode, Running: s.IsRunning})
+		}
+	}
+	return intervals, nil
+}
+
+type tempSample struct {
+	At   time.Time
+	Temp float64
+}
+
+func loadTemperatureSamples(from, to time.Time) ([]tempSample, error) {
+	rows, err := db.Query("SELECT timestamp, temperature FROM sensor_readings WHERE timestamp >= ? AND timestamp < ? ORDER BY timestamp", dbTime(from), dbTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	samples := []tempSample{}
+	for rows.Next() {
+		var s tempSample
+		if err := rows.Scan(&s.At, &s.Temp); err != nil {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// temperatureSlope fits a least-squares line through samples and returns
+// its slope in °C per minute.
+func temperatureSlope(samples []tempSample) (float64, bool) {
+	if len(samples) < 3 {
+		return 0, false
+	}
+	t0 := samples[0].At
+	var sx, sy, sxx, sxy float64
+	n := float64(len(samples))
+	for _, s := range samples {
+		x := s.At.Sub(t0).Minutes()
+		sx += x
+		sy += s.Temp
+		sxx += x * x
+		sxy += x * s.Temp
+	}
+	denom := n*sxx - sx*sx
+	if denom == 0 {
+		return 0, false
+	}
+	return (n*sxy - sx*sy) / denom, true
+}
+
+func samplesBetween(samples []tempSample, from, to time.Time) []tempSample {
+	out := []tempSample{}
+	for _, s := range samples {
+		if !s.At.Before(from) && s.At.Before(to) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// analyseResponse measures how fast heating or cooling moves the
+// temperature, from sensor_readings and hvac_state history between from and
+// to. mode restricts it to heat or cool intervals; "" uses both.
+func analyseResponse(from, to time.Time, mode HVACMode) (AutotuneResult, error) {
+	intervals, err := loadRunIntervals(from, to)
+	if err != nil {
+		return AutotuneResult{}, err
+	}
+	temps, err := loadTemperatureSamples(from, to)
+	if err != nil {
+		return AutotuneResult{}, err
+	}
+
+	result := AutotuneResult{}
+	var runSum, idleSum, deadSum float64
+	deadCount := 0
+	for _, iv := range intervals {
+		if mode != "" && iv.Mode != string(mode) {
+			continue
+		}
+		window := samplesBetween(temps, iv.Start, iv.End)
+		slope, ok := temperatureSlope(window)
+		if !ok {
+			continue
+		}
+		// Normalise so a positive slope always means "towards the setpoint".
+		if iv.Mode == string(ModeCool) {
+			slope = -slope
+		}
+		if !iv.Running {
+			idleSum += slope
+			result.IdlesAnalysed++
+			continue
+		}
+		runSum += slope
+		result.RunsAnalysed++
+		for _, s := range window {
+			responded := s.Temp >= window[0].Temp+0.2
+			if iv.Mode == string(ModeCool) {
+				responded = s.Temp <= window[0].Temp-0.2
+			}
+			if responded {
+				deadSum += s.At.Sub(iv.Start).Minutes()
+				deadCount++
+				break
+			}
+		}
+	}
+	if result.RunsAnalysed == 0 {
+		return AutotuneResult{}, errors.New("not enough heating/cooling history to autotune")
+	}
+	result.RunSlope = runSum / float64(result.RunsAnalysed)
+	if result.IdlesAnalysed > 0 {
+		result.IdleSlope = idleSum / float64(result.IdlesAnalysed)
+	}
+	result.DeadTime = 2.0
+	if deadCount > 0 {
+		result.DeadTime = math.Max(0.5, deadSum/float64(deadCount))
+	}
+	return result, nil
+}
+
+// AutotunePID learns how the house responds from the last week of
+// sensor_readings and hvac_state history and derives PI gains with SIMC
+// rules for an integrating process with dead time. The gains are saved but
+// the strategy is not switched.
+func AutotunePID(user *User) (AutotuneResult, error) {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return AutotuneResult{}, errors.New("only homeowners or technicians can autotune the controller")
+	}
+	to := time.Now()
+	result, err := analyseResponse(to.AddDate(0, 0, -7), to, "")
+	if err != nil {
+		return AutotuneResult{}, err
+	}
+
+	// Gain of the integrating process: °C/minute gained per unit of duty.
+	k := result.RunSlope - result.IdleSlope
+	if k <= 0.001 {
+		return AutotuneResult{}, errors.New("equipment shows no measurable effect on temperature")
+	}
+	tauC := math.Max(result.DeadTime, 5.0)
+	kp := 1 / (k * (tauC + result.DeadTime))
+	ti := 4 * (tauC + result.DeadTime)
+	result.Gains = PIDGains{
+		Kp:           math.Min(kp, 10),
+		Ki:           math.Min(kp/ti, 1),
+		Kd:           0,
+		CycleMinutes: LoadPIDGains().CycleMinutes,
+	}
+	if err := SetPIDGains(result.Gains, user); err != nil {
+		return AutotuneResult{}, err
+	}
+	LogEvent("pid_autotune", fmt.Sprintf("Autotune from %d runs: %.3f°C/min running, %.3f°C/min idle, dead time %.1f min",
+		result.RunsAnalysed, result.RunSlope, result.IdleSlope, result.DeadTime), user.Username, "info")
+	return result, nil
+}
+
+// GetControlStrategyInfo returns the active strategy name and its last output.
+func GetControlStrategyInfo() (string, float64) {
+	hvacMutex.RLock()
+	defer hvacMutex.RUnlock()
+	if controlStrategy == nil {
+		return StrategyHysteresis, 0
+	}
+	return controlStrategy.Name(), controlStrategy.Output()
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
+	"strings"
 	"time"
 )
 
@@ -46,10 +48,12 @@ func InitializeDatabase() error {
 	    id INTEGER PRIMARY KEY AUTOINCREMENT,
 	    profile_name TEXT UNIQUE NOT NULL,
 	    target_temp REAL NOT NULL CHECK(target_temp >= 10 AND target_temp <= 35),
-	    hvac_mode TEXT NOT NULL CHECK(hvac_mode IN ('off', 'heat', 'cool', 'fan')),
+	    hvac_mode TEXT NOT NULL CHECK(hvac_mode IN ('off', 'heat', 'cool', 'fan', 'auto')),
 	    owner TEXT NOT NULL,
 	    guest_accessible INTEGER DEFAULT 0, 
-	    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	    heat_setpoint REAL CHECK(heat_setpoint IS NULL OR (heat_setpoint >= 10 AND heat_setpoint <= 35)),
+	    cool_setpoint REAL CHECK(cool_setpoint IS NULL OR (cool_setpoint >= 10 AND cool_setpoint <= 35))
 	);`
 
 	createSchedulesTable := `CREATE TABLE IF NOT EXISTS schedules (
@@ -59,15 +63,35 @@ func InitializeDatabase() error {
 		start_time TEXT NOT NULL,
 		end_time TEXT NOT NULL,
 		target_temp REAL NOT NULL CHECK(target_temp >= 10 AND target_temp <= 35),
+		heat_setpoint REAL,
+		cool_setpoint REAL,
+		active_room TEXT,
 		FOREIGN KEY(profile_id) REFERENCES profiles(id) ON DELETE CASCADE
 	);`
 
+	// energy_logs is energy recorded before interval metering; it is read
+	// only by migrateEnergyLogs.
 	createEnergyTable := `CREATE TABLE IF NOT EXISTS energy_logs (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
 		hvac_mode TEXT NOT NULL,
 		runtime_minutes INTEGER NOT NULL CHECK(runtime_minutes >= 0),
-		estimated_kwh REAL NOT NULL CHECK(estimated_kwh >= 0)
+		estimated_kwh REAL NOT NULL CHECK(estimated_kwh >= 0),
+		stage TEXT,
+		gas_therms REAL NOT NULL DEFAULT 0 CHECK(gas_therms >= 0)
+	);`
+
+	createEnergyIntervalsTable := `CREATE TABLE IF NOT EXISTS energy_intervals (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at DATETIME NOT NULL,
+		ended_at DATETIME NOT NULL,
+		hvac_mode TEXT NOT NULL,
+		stage TEXT,
+		runtime_seconds INTEGER NOT NULL CHECK(runtime_seconds >= 0),
+		estimated_kwh REAL NOT NULL CHECK(estimated_kwh >= 0),
+		gas_therms REAL NOT NULL DEFAULT 0 CHECK(gas_therms >= 0),
+		closed INTEGER NOT NULL DEFAULT 0,
+		CHECK(ended_at >= started_at)
 	);`
 
 	createGuestAccessTable := `CREATE TABLE IF NOT EXISTS guest_access (
@@ -94,13 +118,238 @@ func InitializeDatabase() error {
 		mode TEXT NOT NULL,
 		target_temp REAL,
 		current_temp REAL,
-		is_running INTEGER DEFAULT 0
+		is_running INTEGER DEFAULT 0,
+		active_call TEXT,
+		control_target REAL
+	);`
+
+	createSettingsTable := `CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL,
+		updated_by TEXT,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	createEquipmentTable := `CREATE TABLE IF NOT EXISTS equipment_config (
+		id INTEGER PRIMARY KEY CHECK(id = 1),
+		heat_type TEXT NOT NULL CHECK(heat_type IN ('furnace', 'heat_pump', 'electric')),
+		heat_stages INTEGER NOT NULL CHECK(heat_stages BETWEEN 1 AND 2),
+		cool_stages INTEGER NOT NULL CHECK(cool_stages BETWEEN 0 AND 2),
+		has_aux_heat INTEGER DEFAULT 0,
+		heat_stage1_kw REAL NOT NULL CHECK(heat_stage1_kw >= 0),
+		heat_stage2_kw REAL NOT NULL CHECK(heat_stage2_kw >= 0),
+		aux_heat_kw REAL NOT NULL CHECK(aux_heat_kw >= 0),
+		cool_stage1_kw REAL NOT NULL CHECK(cool_stage1_kw >= 0),
+		cool_stage2_kw REAL NOT NULL CHECK(cool_stage2_kw >= 0),
+		fan_kw REAL NOT NULL CHECK(fan_kw >= 0),
+		stage_up_gap REAL NOT NULL,
+		stage_up_minutes REAL NOT NULL,
+		stage_down_gap REAL NOT NULL,
+		aux_gap REAL NOT NULL,
+		aux_minutes REAL NOT NULL,
+		gas_stage1_btuh REAL NOT NULL DEFAULT 60000 CHECK(gas_stage1_btuh >= 0),
+		gas_stage2_btuh REAL NOT NULL DEFAULT 90000 CHECK(gas_stage2_btuh >= 0),
+		heat_efficiency REAL NOT NULL DEFAULT 95,
+		cool_seer REAL NOT NULL DEFAULT 14,
+		updated_by TEXT,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	createCOAlarmsTable := `CREATE TABLE IF NOT EXISTS co_alarms (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tripped_at DATETIME NOT NULL,
+		peak_ppm REAL NOT NULL,
+		threshold TEXT NOT NULL,
+		acknowledged_by TEXT,
+		acknowledged_at DATETIME
+	);`
+
+	createRoomSensorsTable := `CREATE TABLE IF NOT EXISTS room_sensors (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		location TEXT NOT NULL,
+		calibration_offset REAL DEFAULT 0 CHECK(calibration_offset >= -5 AND calibration_offset <= 5),
+		weight REAL DEFAULT 1 CHECK(weight >= 0 AND weight <= 10),
+		is_active INTEGER DEFAULT 1,
+		created_by TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	createRoomReadingsTable := `CREATE TABLE IF NOT EXISTS room_sensor_readings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sensor_id INTEGER NOT NULL,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+		temperature REAL NOT NULL,
+		FOREIGN KEY(sensor_id) REFERENCES room_sensors(id) ON DELETE CASCADE
+	);`
+
+	createCalibrationTable := `CREATE TABLE IF NOT EXISTS sensor_calibrations (
+		channel TEXT PRIMARY KEY,
+		offset_value REAL NOT NULL DEFAULT 0,
+		scale REAL NOT NULL DEFAULT 1 CHECK(scale > 0),
+		calibrated_by TEXT NOT NULL,
+		calibrated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	createCalibrationHistoryTable := `CREATE TABLE IF NOT EXISTS calibration_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		channel TEXT NOT NULL,
+		reference_value REAL NOT NULL,
+		raw_value REAL NOT NULL,
+		old_offset REAL NOT NULL,
+		new_offset REAL NOT NULL,
+		old_scale REAL NOT NULL,
+		new_scale REAL NOT NULL,
+		calibrated_by TEXT NOT NULL,
+		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	createVacationsTable := `CREATE TABLE IF NOT EXISTS vacations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		start_at DATETIME NOT NULL,
+		end_at DATETIME NOT NULL,
+		hold_temp REAL CHECK(hold_temp IS NULL OR (hold_temp >= 10 AND hold_temp <= 35)),
+		precondition_at DATETIME,
+		heating_rate REAL,
+		created_by TEXT NOT NULL,
+		cancelled INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	createForecastTable := `CREATE TABLE IF NOT EXISTS weather_forecasts (
+		location TEXT NOT NULL,
+		forecast_for DATETIME NOT NULL,
+		temperature REAL NOT NULL,
+		humidity REAL NOT NULL,
+		conditions TEXT,
+		fetched_at DATETIME NOT NULL,
+		PRIMARY KEY(location, forecast_for)
+	);`
+
+	createTariffsTable := `CREATE TABLE IF NOT EXISTS tariffs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL,
+		base_rate REAL NOT NULL CHECK(base_rate >= 0),
+		daily_charge REAL NOT NULL DEFAULT 0 CHECK(daily_charge >= 0),
+		created_by TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	createTariffPeriodsTable := `CREATE TABLE IF NOT EXISTS tariff_periods (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tariff_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		day_type TEXT NOT NULL CHECK(day_type IN ('all', 'weekday', 'weekend')),
+		start_month INTEGER NOT NULL CHECK(start_month >= 1 AND start_month <= 12),
+		end_month INTEGER NOT NULL CHECK(end_month >= 1 AND end_month <= 12),
+		start_time TEXT NOT NULL,
+		end_time TEXT NOT NULL,
+		rate REAL NOT NULL CHECK(rate >= 0),
+		FOREIGN KEY(tariff_id) REFERENCES tariffs(id) ON DELETE CASCADE
+	);`
+
+	createTariffTiersTable := `CREATE TABLE IF NOT EXISTS tariff_tiers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		tariff_id INTEGER NOT NULL,
+		above_kwh REAL NOT NULL CHECK(above_kwh > 0),
+		adder REAL NOT NULL,
+		FOREIGN KEY(tariff_id) REFERENCES tariffs(id) ON DELETE CASCADE
+	);`
+
+	createBudgetsTable := `CREATE TABLE IF NOT EXISTS energy_budgets (
+		period TEXT PRIMARY KEY CHECK(period IN ('daily', 'weekly', 'monthly')),
+		unit TEXT NOT NULL CHECK(unit IN ('kwh', 'cost')),
+		limit_value REAL NOT NULL CHECK(limit_value > 0),
+		updated_by TEXT,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	createBudgetAlertsTable := `CREATE TABLE IF NOT EXISTS energy_budget_alerts (
+		period TEXT NOT NULL,
+		period_start DATETIME NOT NULL,
+		alert TEXT NOT NULL,
+		sent_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(period, period_start, alert)
+	);`
+
+	createOutdoorTable := `CREATE TABLE IF NOT EXISTS outdoor_temperatures (
+		hour DATETIME PRIMARY KEY,
+		temperature REAL NOT NULL,
+		samples INTEGER NOT NULL CHECK(samples > 0)
+	);`
+
+	createMaintenanceItemsTable := `CREATE TABLE IF NOT EXISTS maintenance_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		kind TEXT NOT NULL CHECK(kind IN ('filter', 'humidifier_pad', 'uv_bulb', 'other')),
+		runtime_hours REAL NOT NULL DEFAULT 0 CHECK(runtime_hours >= 0),
+		interval_days INTEGER NOT NULL DEFAULT 0 CHECK(interval_days >= 0),
+		last_serviced_at DATETIME NOT NULL,
+		reminded_at DATETIME,
+		updated_by TEXT NOT NULL
+	);`
+
+	createServiceVisitsTable := `CREATE TABLE IF NOT EXISTS service_visits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		visited_at DATETIME NOT NULL,
+		technician TEXT NOT NULL,
+		parts TEXT,
+		notes TEXT
+	);`
+
+	createServiceVisitItemsTable := `CREATE TABLE IF NOT EXISTS service_visit_items (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		visit_id INTEGER NOT NULL,
+		item_name TEXT NOT NULL,
+		FOREIGN KEY(visit_id) REFERENCES service_visits(id) ON DELETE CASCADE
+	);`
+
+	createServiceTicketsTable := `CREATE TABLE IF NOT EXISTS service_tickets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL,
+		description TEXT,
+		status TEXT NOT NULL CHECK(status IN ('open', 'closed')),
+		opened_by TEXT NOT NULL,
+		opened_at DATETIME NOT NULL,
+		technician TEXT NOT NULL,
+		access_until DATETIME NOT NULL,
+		closed_by TEXT,
+		closed_at DATETIME,
+		resolution TEXT
+	);`
+
+	createServiceTicketEntriesTable := `CREATE TABLE IF NOT EXISTS service_ticket_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		ticket_id INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		author TEXT NOT NULL,
+		kind TEXT NOT NULL CHECK(kind IN ('note', 'diagnostics')),
+		body TEXT NOT NULL,
+		FOREIGN KEY(ticket_id) REFERENCES service_tickets(id) ON DELETE CASCADE
 	);`
 
 	tables := []string{
 		createUsersTable, createLogsTable, createProfilesTable,
-		createSchedulesTable, createEnergyTable, createGuestAccessTable,
-		createSensorTable, createHVACStateTable,
+		createSchedulesTable, createEnergyTable, createEnergyIntervalsTable, createGuestAccessTable,
+		createSensorTable, createHVACStateTable, createSettingsTable,
+		createEquipmentTable, createCOAlarmsTable, createRoomSensorsTable, createRoomReadingsTable,
+		createCalibrationTable, createCalibrationHistoryTable, createVacationsTable,
+		createForecastTable, createTariffsTable, createTariffPeriodsTable, createTariffTiersTable,
+		createBudgetsTable, createBudgetAlertsTable, createOutdoorTable,
+		createMaintenanceItemsTable, createServiceVisitsTable, createServiceVisitItemsTable,
+		createServiceTicketsTable, createServiceTicketEntriesTable,
+	}
+	for _, table := range []string{"sensor_rollup_1m", "sensor_rollup_1h", "sensor_rollup_1d"} {
+		tables = append(tables, `CREATE TABLE IF NOT EXISTS `+table+` (
+		metric TEXT NOT NULL CHECK(metric IN ('temperature', 'humidity', 'co')),
+		bucket_start DATETIME NOT NULL,
+		min_value REAL NOT NULL,
+		max_value REAL NOT NULL,
+		avg_value REAL NOT NULL,
+		sample_count INTEGER NOT NULL CHECK(sample_count > 0),
+		PRIMARY KEY(metric, bucket_start)
+	);`)
 	}
 
 	for _, table := range tables {
@@ -109,10 +358,15 @@ func InitializeDatabase() error {
 		}
 	}
 
+	if err = migrateSchema(createProfilesTable); err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
 	indices := []string{
 		"CREATE INDEX IF NOT EXISTS idx_logs_timestamp ON logs(timestamp)",
 		"CREATE INDEX IF NOT EXISTS idx_users_session ON users(session_token)",
 		"CREATE INDEX IF NOT EXISTS idx_energy_timestamp ON energy_logs(timestamp)",
+		"CREATE INDEX IF NOT EXISTS idx_energy_intervals_start ON energy_intervals(started_at)",
 		"CREATE INDEX IF NOT EXISTS idx_sensor_timestamp ON sensor_readings(timestamp)",
 	}
 
@@ -125,11 +379,143 @@ func InitializeDatabase() error {
 	if err = createDefaultUser(); err != nil {
 		return err
 	}
+	if err = seedMaintenanceItems(); err != nil {
+		return fmt.Errorf("failed to add maintenance items: %w", err)
+	}
 
 	LogEvent("system", "Database initialized", "system", "info")
 	return nil
 }
 
+// migrateSchema brings tables created by older versions up to date.
+// CREATE TABLE IF NOT EXISTS leaves existing tables untouched, so new
+// columns are added here and tables whose CHECK constraints changed are rebuilt.
+func migrateSchema(createProfilesTable string) error {
+	columns := []struct{ table, column, definition string }{
+		{"schedules", "heat_setpoint", "REAL"},
+		{"schedules", "cool_setpoint", "REAL"},
+		{"hvac_state", "active_call", "TEXT"},
+		{"energy_logs", "stage", "TEXT"},
+		{"schedules", "active_room", "TEXT"},
+		{"vacations", "hold_temp", "REAL"},
+		{"vacations", "precondition_at", "DATETIME"},
+		{"vacations", "heating_rate", "REAL"},
+		{"equipment_config", "gas_stage1_btuh", "REAL NOT NULL DEFAULT 60000"},
+		{"equipment_config", "gas_stage2_btuh", "REAL NOT NULL DEFAULT 90000"},
+		{"equipment_config", "heat_efficiency", "REAL NOT NULL DEFAULT 95"},
+		{"equipment_config", "cool_seer", "REAL NOT NULL DEFAULT 14"},
+		{"energy_logs", "gas_therms", "REAL NOT NULL DEFAULT 0"},
+		{"hvac_state", "control_target", "REAL"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfMissing(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+
+	if err := migrateEnergyLogs(); err != nil {
+		return err
+	}
+
+	var profilesSQL string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'profiles'").Scan(&profilesSQL); err != nil {
+		return err
+	}
+	if !strings.Contains(profilesSQL, "'auto'") {
+		if err := rebuildProfilesTable(createProfilesTable); err != nil {
+			return err
+		}
+		LogEvent("schema_migrate", "Profiles table rebuilt to allow auto mode", "system", "info")
+	}
+	return nil
+}
+
+// migrateEnergyLogs carries energy recorded before interval metering into
+// energy_intervals. Each energy_logs row ended at its timestamp after its
+// whole minutes of runtime.
+func migrateEnergyLogs() error {
+	var intervals int
+	if err := db.QueryRow("SELECT COUNT(*) FROM energy_intervals").Scan(&intervals); err != nil {
+		return err
+	}
+	if intervals > 0 {
+		return nil
+	}
+	result, err := db.Exec(`INSERT INTO energy_intervals (started_at, ended_at, hvac_mode, stage, runtime_seconds, estimated_kwh, gas_therms, closed)
+		SELECT datetime(timestamp, '-' || runtime_minutes || ' minutes'), datetime(timestamp), hvac_mode, stage, runtime_minutes * 60, estimated_kwh, gas_therms, 1
+		FROM energy_logs WHERE runtime_minutes > 0 ORDER BY timestamp, id`)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		LogEvent("schema_migrate", fmt.Sprintf("Copied %d energy log entries into metered intervals", n), "system", "info")
+	}
+	return nil
+}
+
+func addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if found {
+		return nil
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// rebuildProfilesTable copies profiles into a table with the current schema.
+// Foreign keys are switched off on a dedicated connection for the swap so
+// dropping the old table does not cascade into schedules.
+func rebuildProfilesTable(createProfilesTable string) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Create-copy-drop-rename rather than renaming the old table first, which
+	// would rewrite the schedules foreign key to point at the old name.
+	steps := []string{
+		strings.Replace(createProfilesTable, "profiles (", "profiles_new (", 1),
+		`INSERT INTO profiles_new (id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at)
+			SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at FROM profiles`,
+		"DROP TABLE profiles",
+		"ALTER TABLE profiles_new RENAME TO profiles",
+	}
+	for _, step := range steps {
+		if _, err := tx.ExecContext(ctx, step); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func createDefaultUser() error {
 	var count int
 	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE role='homeowner'").Scan(&count)
@@ -158,6 +544,12 @@ func CleanOldLogs(daysToKeep int) error {
 	return err
 }
 
+// dbTime formats t the way SQLite's CURRENT_TIMESTAMP stores it, so range
+// queries against DEFAULT CURRENT_TIMESTAMP columns compare correctly.
+func dbTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
 func CleanExpiredSessions() error {
 	result, err := db.Exec("UPDATE users SET session_token = NULL, session_expires_at = NULL WHERE session_expires_at < ?", time.Now())
 	if err != nil {
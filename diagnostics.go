@@ -11,6 +11,14 @@ type DiagnosticReport struct {
 	SystemHealth  string
 	SensorStatus  SensorStatus
 	NetworkStatus bool
+	RoomSensors   []RoomSensorStatus
+	Calibrations  []Calibration
+	Calibrated    []CalibrationRecord // recent calibration history, newest first
+	HVACWait      string
+	Protection    []StageProtectionStatus
+	Runtime       []RuntimeAnomaly
+	Maintenance   []MaintenanceStatus
+	Visits        []ServiceVisit // recent service visits, newest first
 	Errors        []string
 	Warnings      []string
 }
@@ -38,12 +46,21 @@ func RunSystemDiagnostics(user *User) (DiagnosticReport, error) {
 		report.Errors = append(report.Errors, "Sensor system unhealthy")
 	}
 
+	for _, f := range sensorStatus.Faults {
+		msg := fmt.Sprintf("%s sensor %s: %s", f.Metric, f.Kind, f.Detail)
+		if f.Metric == "temperature" && f.Kind != FaultDrift {
+			report.Errors = append(report.Errors, msg+" (HVAC held off)")
+		} else {
+			report.Warnings = append(report.Warnings, msg)
+		}
+	}
+
 	if sensorStatus.ErrorCount > 0 {
 		report.Warnings = append(report.Warnings, fmt.Sprintf("Sensor errors: %d", sensorStatus.ErrorCount))
 	}
 
 	// Individual sensor checks
-	if _, err := ReadTemperature(); err != nil {
+	if _, err := ReadControlTemperature(); err != nil {
 		report.Errors = append(report.Errors, "Temperature sensor failed")
 	}
 	if _, err := ReadHumidity(); err != nil {
@@ -52,6 +69,63 @@ func RunSystemDiagnostics(user *User) (DiagnosticReport, error) {
 	if _, err := ReadCO(); err != nil {
 		report.Errors = append(report.Errors, "CO sensor failed")
 	}
+	for _, channel := range []string{ChannelTemperature, ChannelHumidity, ChannelCO} {
+		report.Calibrations = append(report.Calibrations, GetCalibration(channel))
+	}
+	if history, err := GetCalibrationHistory(5); err == nil {
+		report.Calibrated = history
+	}
+	if rooms, err := GetRoomSensorStatuses(); err == nil {
+		report.RoomSensors = rooms
+		for _, r := range rooms {
+			if r.IsActive && !r.Healthy {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("Room sensor %s (%s) unhealthy: %s", r.Name, r.Location, r.LastError))
+			}
+		}
+	}
+
+	if alarm := GetCOAlarm(); alarm.Active {
+		report.Errors = append(report.Errors, fmt.Sprintf("CO alarm latched since %s (peak %.1f ppm, %s)",
+			alarm.TrippedAt.Format("15:04:05"), alarm.PeakPPM, alarm.Threshold))
+	}
+
+	if hvacStatus := GetHVACStatus(); hvacStatus.SafetyOverride == SafetyOverrideFreeze {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("Freeze protection forcing heat at %.1f°C", hvacStatus.CurrentTemp))
+	}
+
+	// Equipment protection: report held-off requests and short-cycling
+	hvacStatus := GetHVACStatus()
+	if hvacStatus.WaitReason != "" {
+		report.HVACWait = fmt.Sprintf("%s (until %s)", hvacStatus.WaitReason, hvacStatus.WaitUntil.Format("15:04:05"))
+		report.Warnings = append(report.Warnings, "HVAC request held by protection timers: "+hvacStatus.WaitReason)
+	}
+	report.Protection = GetProtectionStatus()
+	for _, p := range report.Protection {
+		if p.CyclesLastHour >= p.Timers.MaxCyclesPerHour {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s stage reached %d cycles in the last hour", p.Stage, p.CyclesLastHour))
+		}
+	}
+
+	// Runtime trends: rising runtime at similar outdoor temperatures
+	if anomalies, err := DetectRuntimeAnomalies(time.Now()); err == nil {
+		report.Runtime = anomalies
+		for _, a := range anomalies {
+			report.Warnings = append(report.Warnings, a.String())
+		}
+	}
+
+	// Maintenance: consumables due and recent service visits
+	if statuses, err := GetMaintenanceStatuses(time.Now()); err == nil {
+		report.Maintenance = statuses
+		for _, m := range statuses {
+			if m.Due {
+				report.Warnings = append(report.Warnings, fmt.Sprintf("%s due for service: %s", m.Name, m.Reason))
+			}
+		}
+	}
+	if visits, err := GetServiceVisits(5); err == nil {
+		report.Visits = visits
+	}
 
 	// Network check
 	report.NetworkStatus = testNetworkConnectivity()
@@ -84,6 +158,9 @@ func CheckSensorHealth() error {
 	if time.Since(status.LastReading) > 5*time.Minute {
 		return errors.New("sensor data stale")
 	}
+	if status.Degraded {
+		return errors.New("sensor degraded: " + status.Faults[0].Metric + " " + status.Faults[0].Kind)
+	}
 	return nil
 }
 
@@ -94,10 +171,75 @@ func GenerateDiagnosticReport(report DiagnosticReport) string {
 
 	output += fmt.Sprintf("Sensor Status:\n")
 	output += fmt.Sprintf("  Healthy: %v\n", report.SensorStatus.IsHealthy)
+	output += fmt.Sprintf("  Degraded: %v\n", report.SensorStatus.Degraded)
+	for _, f := range report.SensorStatus.Faults {
+		output += fmt.Sprintf("    %s %s since %s: %s\n", f.Metric, f.Kind, f.Since.Format("15:04:05"), f.Detail)
+	}
 	output += fmt.Sprintf("  Last Reading: %s\n", report.SensorStatus.LastReading.Format("15:04:05"))
 	output += fmt.Sprintf("  Error Count: %d\n", report.SensorStatus.ErrorCount)
 	output += fmt.Sprintf("  Sensor Type: %s\n\n", report.SensorStatus.SensorType) // <--- sensor type added
 
+	output += "Calibration:\n"
+	for _, c := range report.Calibrations {
+		if c.CalibratedBy == "" {
+			output += fmt.Sprintf("  %s: factory (never calibrated)\n", c.Channel)
+			continue
+		}
+		output += fmt.Sprintf("  %s: offset %+.2f, scale %.3f by %s on %s\n", c.Channel, c.Offset, c.Scale,
+			c.CalibratedBy, c.CalibratedAt.Format("2006-01-02 15:04"))
+	}
+	if len(report.Calibrated) > 0 {
+		output += "  Recent history:\n"
+		for _, r := range report.Calibrated {
+			output += fmt.Sprintf("    %s %s by %s: reference %.2f, raw %.2f, offset %+.2f -> %+.2f, scale %.3f -> %.3f\n",
+				r.Timestamp.Format("2006-01-02 15:04"), r.Channel, r.CalibratedBy, r.ReferenceValue, r.RawValue,
+				r.OldOffset, r.NewOffset, r.OldScale, r.NewScale)
+		}
+	}
+	output += "\n"
+
+	if len(report.RoomSensors) > 0 {
+		output += "Room Sensors:\n"
+		for _, r := range report.RoomSensors {
+			output += "  " + formatRoomSensorStatus(r) + "\n"
+		}
+		output += "\n"
+	}
+
+	output += "Equipment Protection:\n"
+	if report.HVACWait != "" {
+		output += fmt.Sprintf("  State: %s\n", report.HVACWait)
+	} else {
+		output += "  State: not waiting\n"
+	}
+	for _, p := range report.Protection {
+		output += fmt.Sprintf("  %s: %d/%d cycles last hour, min on %.0f min, min off %.0f min\n",
+			p.Stage, p.CyclesLastHour, p.Timers.MaxCyclesPerHour, p.Timers.MinOnMinutes, p.Timers.MinOffMinutes)
+	}
+	output += "\n"
+
+	output += "Runtime Trends:\n"
+	if len(report.Runtime) == 0 {
+		output += "  No rise in runtime at similar outdoor temperatures\n"
+	}
+	for _, a := range report.Runtime {
+		output += fmt.Sprintf("  %s: %.1f h this week vs %.1f h last week (%+.0f%%), outdoor %.1f°C vs %.1f°C\n",
+			modeLabel(a.Mode), a.ThisWeek/60, a.LastWeek/60, a.Rise*100, a.ThisOutdoor, a.LastOutdoor)
+	}
+	output += "\n"
+
+	output += "Maintenance:\n"
+	for _, m := range report.Maintenance {
+		output += "  " + formatMaintenanceStatus(m) + "\n"
+	}
+	if len(report.Visits) > 0 {
+		output += "  Recent visits:\n"
+		for _, v := range report.Visits {
+			output += "    " + formatServiceVisit(v) + "\n"
+		}
+	}
+	output += "\n"
+
 	output += fmt.Sprintf("Network Status: %v\n\n", report.NetworkStatus)
 
 	if len(report.Errors) > 0 {
@@ -117,3 +259,17 @@ func GenerateDiagnosticReport(report DiagnosticReport) string {
 
 	return output
 }
+
+// formatRoomSensorStatus renders one room sensor for reports and the status screen.
+func formatRoomSensorStatus(r RoomSensorStatus) string {
+	switch {
+	case !r.IsActive:
+		return fmt.Sprintf("%s (%s): inactive", r.Name, r.Location)
+	case r.ReadAt.IsZero():
+		return fmt.Sprintf("%s (%s): no reading yet", r.Name, r.Location)
+	case !r.Healthy:
+		return fmt.Sprintf("%s (%s): UNHEALTHY - %s (errors: %d)", r.Name, r.Location, r.LastError, r.ErrorCount)
+	}
+	return fmt.Sprintf("%s (%s): %.1f°C at %s, offset %+.1f, weight %.1f", r.Name, r.Location, r.Temperature,
+		r.ReadAt.Format("15:04:05"), r.Offset, r.Weight)
+}
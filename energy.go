@@ -2,16 +2,24 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"time"
 )
 
 type EnergyStats struct {
-	TotalKWH      float64
+	TotalKWH      float64 // electricity
 	TotalRuntime  int
 	HeatingKWH    float64
 	CoolingKWH    float64
 	FanKWH        float64
-	EstimatedCost float64
+	GasTherms     float64
+	EstimatedCost float64 // electricity and gas plus fixed charges
+	EnergyCost    float64 // electricity only
+	GasCost       float64
+	FixedCharges  float64
+	ByPeriod      []PeriodCost
+	Budgets       []BudgetStatus
+	Tariff        string
 	Period        string
 }
 
@@ -19,76 +27,116 @@ func GetEnergyUsage(days int) (EnergyStats, error) {
 	if days <= 0 {
 		days = 7
 	}
-	cutoffDate := time.Now().AddDate(0, 0, -days)
-	rows, err := db.Query("SELECT hvac_mode, runtime_minutes, estimated_kwh FROM energy_logs WHERE timestamp >= ?", cutoffDate)
+	until := time.Now()
+	cutoffDate := until.AddDate(0, 0, -days)
+	intervals, err := meteredIntervals(cutoffDate, until)
 	if err != nil {
 		return EnergyStats{}, err
 	}
-	defer rows.Close()
 	stats := EnergyStats{Period: fmt.Sprintf("Last %d days", days)}
-	for rows.Next() {
-		var mode string
-		var runtime int
-		var kwh float64
-		if err := rows.Scan(&mode, &runtime, &kwh); err != nil {
-			continue
-		}
-		stats.TotalKWH += kwh
-		stats.TotalRuntime += runtime
-		switch mode {
+	seconds := 0.0
+	for _, m := range intervals {
+		stats.TotalKWH += m.KWH
+		stats.GasTherms += m.Therms
+		seconds += m.Seconds()
+		switch m.Mode {
 		case "heat":
-			stats.HeatingKWH += kwh
+			stats.HeatingKWH += m.KWH
 		case "cool":
-			stats.CoolingKWH += kwh
+			stats.CoolingKWH += m.KWH
 		case "fan":
-			stats.FanKWH += kwh
+			stats.FanKWH += m.KWH
 		}
 	}
-	stats.EstimatedCost = stats.TotalKWH * 0.12
-	return stats, nil
+	stats.TotalRuntime = int(math.Round(seconds / 60))
+	tariff, _ := ActiveTariff()
+	stats.Tariff = tariff.Name
+	stats.ByPeriod, stats.EnergyCost, err = energyCosts(tariff, cutoffDate, until)
+	if err != nil {
+		return stats, err
+	}
+	stats.FixedCharges = float64(days) * tariff.DailyCharge
+	stats.GasCost = stats.GasTherms * GetGasRate()
+	stats.EstimatedCost = stats.EnergyCost + stats.GasCost + stats.FixedCharges
+	stats.Budgets, err = GetBudgetStatuses(time.Now())
+	return stats, err
 }
 
 func GenerateEnergyReport(stats EnergyStats) string {
 	output := "=== ENERGY USAGE REPORT ===\n"
 	output += fmt.Sprintf("Period: %s\n\n", stats.Period)
-	output += fmt.Sprintf("Total Energy Used: %.2f kWh\n", stats.TotalKWH)
+	output += fmt.Sprintf("Electricity Used: %.2f kWh\n", stats.TotalKWH)
+	if stats.GasTherms > 0 {
+		output += fmt.Sprintf("Gas Used: %.2f therms\n", stats.GasTherms)
+	}
 	output += fmt.Sprintf("Total Runtime: %d minutes (%.1f hours)\n", stats.TotalRuntime, float64(stats.TotalRuntime)/60.0)
 	output += fmt.Sprintf("\nBreakdown by Mode:\n")
-	output += fmt.Sprintf("  Heating: %.2f kWh\n", stats.HeatingKWH)
+	output += fmt.Sprintf("  Heating: %.2f kWh", stats.HeatingKWH)
+	if stats.GasTherms > 0 {
+		output += fmt.Sprintf(" + %.2f therms", stats.GasTherms)
+	}
+	output += "\n"
 	output += fmt.Sprintf("  Cooling: %.2f kWh\n", stats.CoolingKWH)
 	output += fmt.Sprintf("  Fan: %.2f kWh\n", stats.FanKWH)
-	output += fmt.Sprintf("\nEstimated Cost: $%.2f\n", stats.EstimatedCost)
+	output += fmt.Sprintf("\nElectricity Cost by Tariff Period (%s):\n", stats.Tariff)
+	for _, p := range stats.ByPeriod {
+		output += fmt.Sprintf("  %s: %.2f kWh, %s\n", p.Name, p.KWH, FormatMoney(p.Cost))
+	}
+	if stats.FixedCharges > 0 {
+		output += fmt.Sprintf("  Fixed charges: %s\n", FormatMoney(stats.FixedCharges))
+	}
+	output += fmt.Sprintf("  Electricity total: %s\n", FormatMoney(stats.EnergyCost+stats.FixedCharges))
+	if stats.GasTherms > 0 {
+		output += fmt.Sprintf("Gas Cost: %s (%.2f therms at %s/therm)\n", FormatMoney(stats.GasCost), stats.GasTherms, FormatMoney(GetGasRate()))
+	}
+	output += fmt.Sprintf("\nEstimated Cost: %s (%s)\n", FormatMoney(stats.EstimatedCost), GetCurrency())
+	if len(stats.Budgets) > 0 {
+		output += "\nBudgets:\n"
+	}
+	for _, b := range stats.Budgets {
+		output += fmt.Sprintf("  %s: %s of %s (%.0f%%), projected %s", budgetLabel(b.Period),
+			formatBudgetAmount(b.Unit, b.Used), formatBudgetAmount(b.Unit, b.Limit), b.Used/b.Limit*100, formatBudgetAmount(b.Unit, b.Projected))
+		if b.AtRisk {
+			output += " - AT RISK"
+		}
+		output += "\n"
+	}
 	return output
 }
 
 func GetDailyEnergyUsage(date time.Time) (float64, error) {
 	startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
-	endOfDay := startOfDay.Add(24 * time.Hour)
-	var totalKWH float64
-	err := db.QueryRow("SELECT COALESCE(SUM(estimated_kwh), 0) FROM energy_logs WHERE timestamp >= ? AND timestamp < ?", startOfDay, endOfDay).Scan(&totalKWH)
-	if err != nil {
-		return 0, err
-	}
-	return totalKWH, nil
+	return meteredKWH(startOfDay, startOfDay.AddDate(0, 0, 1))
 }
 
 func GetMonthlyEnergyUsage(year int, month time.Month) (float64, error) {
-	startOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
-	endOfMonth := startOfMonth.AddDate(0, 1, 0)
-	var totalKWH float64
-	err := db.QueryRow("SELECT COALESCE(SUM(estimated_kwh), 0) FROM energy_logs WHERE timestamp >= ? AND timestamp < ?", startOfMonth, endOfMonth).Scan(&totalKWH)
+	startOfMonth := time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
+	return meteredKWH(startOfMonth, startOfMonth.AddDate(0, 1, 0))
+}
+
+// meteredKWH is the electricity metered in [from, to).
+func meteredKWH(from, to time.Time) (float64, error) {
+	intervals, err := meteredIntervals(from, to)
 	if err != nil {
 		return 0, err
 	}
+	totalKWH := 0.0
+	for _, m := range intervals {
+		totalKWH += m.KWH
+	}
 	return totalKWH, nil
 }
 
+// TrackEnergyUsage records runtime that ended just now at stage 1, for
+// equipment run outside the control loop.
 func TrackEnergyUsage(mode HVACMode, runtimeMinutes int) error {
-	kwh := estimateEnergyUsage(mode, runtimeMinutes)
-	_, err := db.Exec("INSERT INTO energy_logs (hvac_mode, runtime_minutes, estimated_kwh) VALUES (?, ?, ?)", mode, runtimeMinutes, kwh)
-	if err != nil {
-		return err
+	if runtimeMinutes <= 0 {
+		return nil
 	}
-	//LogEvent("energy_track", fmt.Sprintf("Tracked %.2f kWh for %s mode", kwh, mode), "system", "info")
-	return nil
+	runtime := time.Duration(runtimeMinutes) * time.Minute
+	end := time.Now().Truncate(time.Second)
+	kwh, therms := estimateEnergyUsage(mode, 1, false, runtime)
+	_, err := db.Exec(`INSERT INTO energy_intervals (started_at, ended_at, hvac_mode, stage, runtime_seconds, estimated_kwh, gas_therms, closed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, 1)`, dbTime(end.Add(-runtime)), dbTime(end), mode, stageLabel(mode, 1, false), int(runtime.Seconds()), kwh, therms)
+	return err
 }
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	kwhPerTherm           = 29.3071
+	defaultDegreeDayBase  = 18.0 // °C
+	outdoorHistoryMinimum = 12   // hourly readings needed to trust a day's mean
+)
+
+// DailyEnergy is one local day of energy use with the outdoor temperature
+// it was used in. OutdoorMean, HDD and CDD are only meaningful when
+// HasWeather is set.
+type DailyEnergy struct {
+	Date           string  `json:"date"`
+	HeatKWH        float64 `json:"heat_kwh"`
+	CoolKWH        float64 `json:"cool_kwh"`
+	FanKWH         float64 `json:"fan_kwh"`
+	GasTherms      float64 `json:"gas_therms"`
+	RuntimeMinutes int     `json:"runtime_minutes"`
+	Cost           float64 `json:"cost"`
+	HasWeather     bool    `json:"has_weather"`
+	OutdoorMean    float64 `json:"outdoor_mean_c"`
+	HDD            float64 `json:"hdd"`
+	CDD            float64 `json:"cdd"`
+}
+
+// EnergySummary totals a period. Heating energy counts gas at its kWh
+// equivalent so gas and electric heat can be compared.
+type EnergySummary struct {
+	From           string  `json:"from"`
+	To             string  `json:"to"`
+	HeatKWH        float64 `json:"heat_kwh"`
+	CoolKWH        float64 `json:"cool_kwh"`
+	FanKWH         float64 `json:"fan_kwh"`
+	GasTherms      float64 `json:"gas_therms"`
+	HeatingEnergy  float64 `json:"heating_energy_kwh"`
+	RuntimeMinutes int     `json:"runtime_minutes"`
+	Cost           float64 `json:"cost"`
+	HDD            float64 `json:"hdd"`
+	CDD            float64 `json:"cdd"`
+	WeatherDays    int     `json:"weather_days"`
+	Days           int     `json:"days"`
+}
+
+// EnergyComparison explains the change from a baseline period. The change
+// in heating and cooling energy is split into the part the difference in
+// degree days accounts for and the part from using more or less energy per
+// degree day, which is down to behavior, settings or the equipment.
+type EnergyComparison struct {
+	Label          string        `json:"label"`
+	Baseline       EnergySummary `json:"baseline"`
+	Change         float64       `json:"change_kwh"`
+	WeatherEffect  float64       `json:"weather_effect_kwh"`
+	BehaviorEffect float64       `json:"behavior_effect_kwh"`
+	Normalized     bool          `json:"normalized"` // false without degree days for both periods
+}
+
+// EnergyReport is a period's daily breakdown and its comparisons.
+type EnergyReport struct {
+	Currency      string             `json:"currency"`
+	DegreeDayBase float64            `json:"degree_day_base_c"`
+	Summary       EnergySummary      `json:"summary"`
+	Daily         []DailyEnergy      `json:"daily"`
+	Comparisons   []EnergyComparison `json:"comparisons"`
+}
+
+func degreeDayBase() float64 {
+	return GetSettingFloat("degree_day_base", defaultDegreeDayBase)
+}
+
+// recordOutdoorTemperature folds a fresh reading for the home location into
+// its hourly average, kept for degree-day normalization.
+func recordOutdoorTemperature(location string, weather WeatherData) {
+	home := GetSetting("weather_location", "")
+	if home == "" || cacheKey(home) != cacheKey(location) {
+		return
+	}
+	hour := weather.Timestamp
+	if hour.IsZero() {
+		hour = time.Now()
+	}
+	_, err := db.Exec(`INSERT INTO outdoor_temperatures (hour, temperature, samples) VALUES (?, ?, 1)
+		ON CONFLICT(hour) DO UPDATE SET temperature = (temperature * samples + excluded.temperature) / (samples + 1), samples = samples + 1`,
+		dbTime(hour.Truncate(time.Hour)), weather.Temperature)
+	if err != nil {
+		LogEvent("weather_error", "Could not store outdoor temperature: "+err.Error(), "system", "warning")
+	}
+}
+
+// dailyOutdoorMeans returns the mean outdoor temperature of each local day in
+// [from, to) that has enough hourly history, keyed by YYYY-MM-DD.
+func dailyOutdoorMeans(from, to time.Time) (map[string]float64, error) {
+	rows, err := db.Query("SELECT hour, temperature FROM outdoor_temperatures WHERE hour >= ? AND hour < ?", dbTime(from), dbTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sums := map[string]float64{}
+	counts := map[string]int{}
+	for rows.Next() {
+		var hour time.Time
+		var temp float64
+		if err := rows.Scan(&hour, &temp); err != nil {
+			continue
+		}
+		day := hour.Local().Format("2006-01-02")
+		sums[day] += temp
+		counts[day]++
+	}
+	means := map[string]float64{}
+	for day, n := range counts {
+		if n >= outdoorHistoryMinimum {
+			means[day] = sums[day] / float64(n)
+		}
+	}
+	return means, nil
+}
+
+// dailyEnergy breaks [from, to) into local days. from and to should be
+// local midnights.
+func dailyEnergy(from, to time.Time) ([]DailyEnergy, error) {
+	intervals, err := meteredIntervals(from, to)
+	if err != nil {
+		return nil, err
+	}
+	byDay := map[string]*DailyEnergy{}
+	seconds := map[string]float64{}
+	for _, m := range intervals {
+		// Split intervals running over midnight between the days.
+		for start := m.Start.Local(); start.Before(m.End); {
+			midnight := time.Date(start.Year(), start.Month(), start.Day()+1, 0, 0, 0, 0, time.Local)
+			part, ok := m.clip(start, midnight)
+			start = midnight
+			if !ok {
+				continue
+			}
+			key := part.Start.Local().Format("2006-01-02")
+			day, ok := byDay[key]
+			if !ok {
+				day = &DailyEnergy{Date: key}
+				byDay[key] = day
+			}
+			switch part.Mode {
+			case "heat":
+				day.HeatKWH += part.KWH
+			case "cool":
+				day.CoolKWH += part.KWH
+			case "fan":
+				day.FanKWH += part.KWH
+			}
+			day.GasTherms += part.Therms
+			seconds[key] += part.Seconds()
+		}
+	}
+	for key, day := range byDay {
+		day.RuntimeMinutes = int(math.Round(seconds[key] / 60))
+	}
+
+	means, err := dailyOutdoorMeans(from, to)
+	if err != nil {
+		return nil, err
+	}
+	base := degreeDayBase()
+	days := []DailyEnergy{}
+	for start := from; start.Before(to); start = start.AddDate(0, 0, 1) {
+		key := start.Format("2006-01-02")
+		day := DailyEnergy{Date: key}
+		if d, ok := byDay[key]; ok {
+			day = *d
+		}
+		if day.Cost, err = EnergyCost(start, start.AddDate(0, 0, 1)); err != nil {
+			return nil, err
+		}
+		if mean, ok := means[key]; ok {
+			day.HasWeather, day.OutdoorMean = true, mean
+			day.HDD, day.CDD = math.Max(0, base-mean), math.Max(0, mean-base)
+		}
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+func summarize(from, to time.Time, days []DailyEnergy) EnergySummary {
+	s := EnergySummary{From: from.Format("2006-01-02"), To: to.AddDate(0, 0, -1).Format("2006-01-02"), Days: len(days)}
+	for _, d := range days {
+		s.HeatKWH += d.HeatKWH
+		s.CoolKWH += d.CoolKWH
+		s.FanKWH += d.FanKWH
+		s.GasTherms += d.GasTherms
+		s.RuntimeMinutes += d.RuntimeMinutes
+		s.Cost += d.Cost
+		if d.HasWeather {
+			s.HDD += d.HDD
+			s.CDD += d.CDD
+			s.WeatherDays++
+		}
+	}
+	s.HeatingEnergy = s.HeatKWH + s.GasTherms*kwhPerTherm
+	return s
+}
+
+// compareEnergy splits the change in heating and cooling energy from
+// baseline to current into weather and behavior, using energy per degree
+// day. It needs degree days for every day of both periods.
+func compareEnergy(label string, current, baseline EnergySummary) EnergyComparison {
+	c := EnergyComparison{Label: label, Baseline: baseline}
+	cur := current.HeatingEnergy + current.CoolKWH
+	base := baseline.HeatingEnergy + baseline.CoolKWH
+	c.Change = cur - base
+	if current.WeatherDays < current.Days || baseline.WeatherDays < baseline.Days {
+		return c
+	}
+	c.Normalized = true
+	for _, part := range []struct{ curEnergy, baseEnergy, curDD, baseDD float64 }{
+		{current.HeatingEnergy, baseline.HeatingEnergy, current.HDD, baseline.HDD},
+		{current.CoolKWH, baseline.CoolKWH, current.CDD, baseline.CDD},
+	} {
+		if part.baseDD == 0 || part.curDD == 0 {
+			// Without degree days on both sides all of it is behavior.
+			c.BehaviorEffect += part.curEnergy - part.baseEnergy
+			continue
+		}
+		baseIntensity, curIntensity := part.baseEnergy/part.baseDD, part.curEnergy/part.curDD
+		c.WeatherEffect += baseIntensity * (part.curDD - part.baseDD)
+		c.BehaviorEffect += (curIntensity - baseIntensity) * part.curDD
+	}
+	return c
+}
+
+// BuildEnergyReport covers the last days complete days, compared with the
+// previous equal period and the same dates last year.
+func BuildEnergyReport(days int, now time.Time) (*EnergyReport, error) {
+	if days < 1 || days > 366 {
+		return nil, errors.New("report period must be 1-366 days")
+	}
+	now = now.Local()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	from := to.AddDate(0, 0, -days)
+
+	daily, err := dailyEnergy(from, to)
+	if err != nil {
+		return nil, err
+	}
+	report := &EnergyReport{Currency: GetCurrency(), DegreeDayBase: degreeDayBase(), Daily: daily, Summary: summarize(from, to, daily)}
+	for _, baseline := range []struct {
+		label    string
+		from, to time.Time
+	}{
+		{"previous period", from.AddDate(0, 0, -days), from},
+		{"same period last year", from.AddDate(-1, 0, 0), to.AddDate(-1, 0, 0)},
+	} {
+		baseDaily, err := dailyEnergy(baseline.from, baseline.to)
+		if err != nil {
+			return nil, err
+		}
+		report.Comparisons = append(report.Comparisons, compareEnergy(baseline.label, report.Summary, summarize(baseline.from, baseline.to, baseDaily)))
+	}
+	return report, nil
+}
+
+// WriteEnergyCSV writes the daily breakdown, one row per day.
+func WriteEnergyCSV(w io.Writer, report *EnergyReport) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"date", "heat_kwh", "cool_kwh", "fan_kwh", "gas_therms", "runtime_minutes", "cost_" + report.Currency, "outdoor_mean_c", "hdd", "cdd"})
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, d := range report.Daily {
+		row := []string{d.Date, f(d.HeatKWH), f(d.CoolKWH), f(d.FanKWH), f(d.GasTherms), strconv.Itoa(d.RuntimeMinutes), strconv.FormatFloat(d.Cost, 'f', 2, 64), "", "", ""}
+		if d.HasWeather {
+			row[7], row[8], row[9] = strconv.FormatFloat(d.OutdoorMean, 'f', 1, 64), f(d.HDD), f(d.CDD)
+		}
+		out.Write(row)
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// WriteEnergyJSON writes the whole report, comparisons included.
+func WriteEnergyJSON(w io.Writer, report *EnergyReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// FormatEnergyComparisons describes the comparisons for the CLI.
+func FormatEnergyComparisons(report *EnergyReport) string {
+	s := report.Summary
+	output := fmt.Sprintf("%s to %s: heating %.1f kWh equivalent, cooling %.1f kWh, %.0f HDD / %.0f CDD (base %g°C, weather for %d of %d days)\n",
+		s.From, s.To, s.HeatingEnergy, s.CoolKWH, s.HDD, s.CDD, report.DegreeDayBase, s.WeatherDays, s.Days)
+	for _, c := range report.Comparisons {
+		b := c.Baseline
+		output += fmt.Sprintf("\nVs %s (%s to %s): heating %.1f, cooling %.1f kWh, cost %s -> %s\n",
+			c.Label, b.From, b.To, b.HeatingEnergy, b.CoolKWH, FormatMoney(b.Cost), FormatMoney(s.Cost))
+		output += fmt.Sprintf("  Change: %+.1f kWh", c.Change)
+		if c.Normalized {
+			output += fmt.Sprintf(" (weather %+.1f kWh, behavior %+.1f kWh)\n", c.WeatherEffect, c.BehaviorEffect)
+		} else {
+			output += " (not weather-normalized: outdoor history incomplete)\n"
+		}
+	}
+	return output
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	HeatTypeFurnace  = "furnace"
+	HeatTypeHeatPump = "heat_pump"
+	HeatTypeElectric = "electric"
+
+	btuPerTherm = 100000
+)
+
+// EquipmentConfig describes the installed heating and cooling equipment and
+// when the controller should stage it up or down.
+type EquipmentConfig struct {
+	HeatType   string
+	HeatStages int
+	CoolStages int
+	HasAuxHeat bool // heat pumps only
+
+	// Electrical ratings exclude the blower, which is billed separately at
+	// FanKW whenever it runs. Furnaces burn gas and use no heating kW.
+	HeatStage1KW float64
+	HeatStage2KW float64
+	AuxHeatKW    float64
+	CoolStage1KW float64
+	CoolStage2KW float64
+	FanKW        float64 // indoor blower
+
+	GasStage1BTUH  float64 // furnace gas input in BTU/h
+	GasStage2BTUH  float64 // total furnace input at stage 2
+	HeatEfficiency float64 // AFUE % for furnaces, COP for heat pumps
+	CoolSEER       float64
+
+	StageUpGap     float64 // °C from setpoint that brings on stage 2
+	StageUpMinutes float64 // minutes in stage 1 before stage 2 comes on anyway
+	StageDownGap   float64 // °C from setpoint below which upper stages drop out
+	AuxGap         float64 // °C from setpoint that brings on aux heat
+	AuxMinutes     float64 // minutes at top compressor stage before aux comes on
+}
+
+var (
+	equipmentMutex  sync.RWMutex
+	equipmentConfig = DefaultEquipmentConfig()
+)
+
+// DefaultEquipmentConfig is a single-stage 60,000 BTU/h gas furnace with
+// 3.0 kW cooling and a 0.5 kW blower.
+func DefaultEquipmentConfig() EquipmentConfig {
+	return EquipmentConfig{
+		HeatType:       HeatTypeFurnace,
+		HeatStages:     1,
+		CoolStages:     1,
+		HeatStage1KW:   2.5,
+		HeatStage2KW:   4.0,
+		AuxHeatKW:      5.0,
+		CoolStage1KW:   3.0,
+		CoolStage2KW:   4.5,
+		FanKW:          0.5,
+		GasStage1BTUH:  60000,
+		GasStage2BTUH:  90000,
+		HeatEfficiency: 95,
+		CoolSEER:       14,
+		StageUpGap:     1.5,
+		StageUpMinutes: 10,
+		StageDownGap:   0.5,
+		AuxGap:         3.0,
+		AuxMinutes:     20,
+	}
+}
+
+func ValidateEquipmentConfig(cfg EquipmentConfig) error {
+	if cfg.HeatType != HeatTypeFurnace && cfg.HeatType != HeatTypeHeatPump && cfg.HeatType != HeatTypeElectric {
+		return errors.New("invalid heat type")
+	}
+	if cfg.HeatStages < 1 || cfg.HeatStages > 2 || cfg.CoolStages < 0 || cfg.CoolStages > 2 {
+		return errors.New("heating must have 1-2 stages and cooling 0-2 stages")
+	}
+	if cfg.HasAuxHeat && cfg.HeatType != HeatTypeHeatPump {
+		return errors.New("auxiliary heat is only supported with a heat pump")
+	}
+	for _, kw := range []float64{cfg.HeatStage1KW, cfg.HeatStage2KW, cfg.AuxHeatKW, cfg.CoolStage1KW, cfg.CoolStage2KW, cfg.FanKW} {
+		if kw < 0 || kw > 50 {
+			return errors.New("power ratings must be 0-50 kW")
+		}
+	}
+	if cfg.GasStage1BTUH < 0 || cfg.GasStage1BTUH > 300000 || cfg.GasStage2BTUH < 0 || cfg.GasStage2BTUH > 300000 {
+		return errors.New("gas input must be 0-300,000 BTU/h")
+	}
+	switch cfg.HeatType {
+	case HeatTypeFurnace:
+		if cfg.HeatEfficiency < 50 || cfg.HeatEfficiency > 99 {
+			return errors.New("furnace AFUE must be 50-99%")
+		}
+	case HeatTypeHeatPump:
+		if cfg.HeatEfficiency < 1 || cfg.HeatEfficiency > 6 {
+			return errors.New("heat pump COP must be 1-6")
+		}
+	}
+	if cfg.CoolStages > 0 && (cfg.CoolSEER < 8 || cfg.CoolSEER > 40) {
+		return errors.New("cooling SEER must be 8-40")
+	}
+	if cfg.StageUpGap <= cfg.StageDownGap || cfg.StageDownGap < 0 || cfg.AuxGap < cfg.StageUpGap {
+		return errors.New("staging gaps must satisfy stage-down < stage-up <= aux")
+	}
+	if cfg.StageUpMinutes < 1 || cfg.AuxMinutes < 1 {
+		return errors.New("staging delays must be at least 1 minute")
+	}
+	return nil
+}
+
+// LoadEquipmentConfig reads the stored configuration into memory, keeping the
+// defaults if none has been saved yet.
+func LoadEquipmentConfig() error {
+	cfg := DefaultEquipmentConfig()
+	var hasAux int
+	err := db.QueryRow(`SELECT heat_type, heat_stages, cool_stages, has_aux_heat, heat_stage1_kw, heat_stage2_kw, aux_heat_kw,
+		cool_stage1_kw, cool_stage2_kw, fan_kw, stage_up_gap, stage_up_minutes, stage_down_gap, aux_gap, aux_minutes,
+		gas_stage1_btuh, gas_stage2_btuh, heat_efficiency, cool_seer
+		FROM equipment_config WHERE id = 1`).Scan(&cfg.HeatType, &cfg.HeatStages, &cfg.CoolStages, &hasAux,
+		&cfg.HeatStage1KW, &cfg.HeatStage2KW, &cfg.AuxHeatKW, &cfg.CoolStage1KW, &cfg.CoolStage2KW, &cfg.FanKW,
+		&cfg.StageUpGap, &cfg.StageUpMinutes, &cfg.StageDownGap, &cfg.AuxGap, &cfg.AuxMinutes,
+		&cfg.GasStage1BTUH, &cfg.GasStage2BTUH, &cfg.HeatEfficiency, &cfg.CoolSEER)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	cfg.HasAuxHeat = hasAux == 1
+	equipmentMutex.Lock()
+	equipmentConfig = cfg
+	equipmentMutex.Unlock()
+	return nil
+}
+
+func GetEquipmentConfig() EquipmentConfig {
+	equipmentMutex.RLock()
+	defer equipmentMutex.RUnlock()
+	return equipmentConfig
+}
+
+func SaveEquipmentConfig(cfg EquipmentConfig, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can configure equipment")
+	}
+	if err := ValidateEquipmentConfig(cfg); err != nil {
+		return err
+	}
+	hasAux := 0
+	if cfg.HasAuxHeat {
+		hasAux = 1
+	}
+	_, err := db.Exec(`INSERT OR REPLACE INTO equipment_config (id, heat_type, heat_stages, cool_stages, has_aux_heat,
+		heat_stage1_kw, heat_stage2_kw, aux_heat_kw, cool_stage1_kw, cool_stage2_kw, fan_kw,
+		stage_up_gap, stage_up_minutes, stage_down_gap, aux_gap, aux_minutes,
+		gas_stage1_btuh, gas_stage2_btuh, heat_efficiency, cool_seer, updated_by, updated_at)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+		cfg.HeatType, cfg.HeatStages, cfg.CoolStages, hasAux, cfg.HeatStage1KW, cfg.HeatStage2KW, cfg.AuxHeatKW,
+		cfg.CoolStage1KW, cfg.CoolStage2KW, cfg.FanKW, cfg.StageUpGap, cfg.StageUpMinutes, cfg.StageDownGap,
+		cfg.AuxGap, cfg.AuxMinutes, cfg.GasStage1BTUH, cfg.GasStage2BTUH, cfg.HeatEfficiency, cfg.CoolSEER, user.Username)
+	if err != nil {
+		return err
+	}
+	equipmentMutex.Lock()
+	equipmentConfig = cfg
+	equipmentMutex.Unlock()
+	LogEvent("equipment_config", fmt.Sprintf("Equipment set to %s, %d heat / %d cool stages, aux heat %v",
+		cfg.HeatType, cfg.HeatStages, cfg.CoolStages, cfg.HasAuxHeat), user.Username, "info")
+	return nil
+}
+
+// stageKW is the electrical load of the given stage combination, including
+// the blower.
+func stageKW(mode HVACMode, stage int, aux bool) float64 {
+	cfg := GetEquipmentConfig()
+	kw := 0.0
+	switch mode {
+	case ModeHeat:
+		if cfg.HeatType != HeatTypeFurnace {
+			if stage >= 1 {
+				kw += cfg.HeatStage1KW
+			}
+			if stage >= 2 {
+				kw += cfg.HeatStage2KW - cfg.HeatStage1KW
+			}
+		}
+		if aux {
+			kw += cfg.AuxHeatKW
+		}
+	case ModeCool:
+		if stage >= 1 {
+			kw += cfg.CoolStage1KW
+		}
+		if stage >= 2 {
+			kw += cfg.CoolStage2KW - cfg.CoolStage1KW
+		}
+	}
+	if mode == ModeFan || stage >= 1 || aux {
+		kw += cfg.FanKW
+	}
+	return kw
+}
+
+// stageGasBTUH is the gas input of the given stage combination.
+func stageGasBTUH(mode HVACMode, stage int) float64 {
+	cfg := GetEquipmentConfig()
+	if mode != ModeHeat || cfg.HeatType != HeatTypeFurnace {
+		return 0
+	}
+	switch {
+	case stage >= 2:
+		return cfg.GasStage2BTUH
+	case stage == 1:
+		return cfg.GasStage1BTUH
+	}
+	return 0
+}
+
+// stageLabel names a stage combination for logs and energy records.
+func stageLabel(mode HVACMode, stage int, aux bool) string {
+	switch {
+	case mode == ModeFan:
+		return "fan"
+	case aux && stage == 0:
+		return "emergency"
+	case aux:
+		return fmt.Sprintf("stage %d + aux", stage)
+	case stage > 0:
+		return fmt.Sprintf("stage %d", stage)
+	}
+	return ""
+}
+
+// updateStaging moves the running call between stages. Stage 2 comes on when
+// the gap to setpoint or the time in stage 1 exceeds its threshold, aux heat
+// likewise from the top compressor stage, and both drop out once the gap has
+// closed below the stage-down threshold. Callers must hold hvacMutex.
+func updateStaging(call HVACMode, current, target float64, now time.Time) {
+	cfg := GetEquipmentConfig()
+	gap := target - current
+	if call == ModeCool {
+		gap = current - target
+	}
+	stage, aux := hvacState.Stage, hvacState.AuxHeat
+	inStage := now.Sub(stageStart).Minutes()
+
+	switch {
+	case hvacState.Mode == ModeEmergencyHeat:
+		stage, aux = 0, true
+	case gap < cfg.StageDownGap:
+		if aux {
+			aux = false
+		} else if stage > 1 {
+			stage--
+		}
+	default:
+		maxStage := cfg.HeatStages
+		if call == ModeCool {
+			maxStage = cfg.CoolStages
+		}
+		if stage < maxStage && (gap >= cfg.StageUpGap || inStage >= cfg.StageUpMinutes) {
+			stage++
+		} else if call == ModeHeat && cfg.HasAuxHeat && !aux && stage == maxStage &&
+			(gap >= cfg.AuxGap || inStage >= cfg.AuxMinutes) {
+			aux = true
+		}
+	}
+	if call == ModeHeat {
+		stage, aux = applyHeatLockouts(stage, aux)
+	}
+	if stage == hvacState.Stage && aux == hvacState.AuxHeat {
+		return
+	}
+	old := stageLabel(call, hvacState.Stage, hvacState.AuxHeat)
+	hvacState.Stage, hvacState.AuxHeat = stage, aux
+	stageStart = now
+	// Close the old stage's interval and meter the new stage from now.
+	syncMeter(now)
+	LogEvent("hvac_stage", fmt.Sprintf("%s staged from %s to %s (%.1f°C from setpoint)", call, old, stageLabel(call, stage, aux), gap), "system", "info")
+}
+
+// startStaging sets the initial stage when a call starts. Callers must hold hvacMutex.
+func startStaging(call HVACMode, now time.Time) {
+	hvacState.Stage, hvacState.AuxHeat = 1, false
+	if hvacState.Mode == ModeEmergencyHeat {
+		hvacState.Stage, hvacState.AuxHeat = 0, true
+	} else if call == ModeHeat {
+		hvacState.Stage, hvacState.AuxHeat = applyHeatLockouts(1, false)
+	}
+	stageStart = now
+}
+
+// checkEmergencyHeatAllowed reports whether the equipment can run emergency heat.
+func checkEmergencyHeatAllowed() error {
+	cfg := GetEquipmentConfig()
+	if cfg.HeatType != HeatTypeHeatPump || !cfg.HasAuxHeat {
+		return errors.New("emergency heat requires a heat pump with auxiliary heat")
+	}
+	return nil
+}
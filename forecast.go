@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	forecastHours          = 48
+	forecastRefresh        = time.Hour
+	forecastAutoBandMargin = 1.0 // °C kept between an adjusted auto setpoint and the opposite one
+)
+
+// ForecastSettings control pre-cooling ahead of forecast heat and
+// pre-heating ahead of a cold front. Pre-heating only runs in off-peak
+// hours, when energy is cheap.
+type ForecastSettings struct {
+	Enabled        bool
+	LookaheadHours float64
+	HeatSpike      float64 // °C outdoor forecast that triggers pre-cooling
+	PrecoolOffset  float64 // °C the cooling target is lowered by
+	ColdDrop       float64 // °C fall in outdoor temperature that counts as a cold front
+	PreheatOffset  float64 // °C the heating target is raised by
+	OffPeakStart   string  // HH:MM
+	OffPeakEnd     string  // HH:MM
+}
+
+// forecastDecision is what the forecast control last decided.
+type forecastDecision struct {
+	kind   string  // precool, preheat, deferred, or "" for no adjustment
+	offset float64 // °C added to the target, negative to pre-cool
+	reason string
+}
+
+var (
+	forecastMutex sync.Mutex
+	forecastLast  forecastDecision
+)
+
+func LoadForecastSettings() ForecastSettings {
+	return ForecastSettings{
+		Enabled:        GetSetting("forecast_enabled", "0") == "1",
+		LookaheadHours: GetSettingFloat("forecast_lookahead_hours", 6),
+		HeatSpike:      GetSettingFloat("forecast_heat_spike", 30),
+		PrecoolOffset:  GetSettingFloat("forecast_precool_offset", 1.5),
+		ColdDrop:       GetSettingFloat("forecast_cold_drop", 8),
+		PreheatOffset:  GetSettingFloat("forecast_preheat_offset", 1.5),
+		OffPeakStart:   GetSetting("forecast_offpeak_start", "22:00"),
+		OffPeakEnd:     GetSetting("forecast_offpeak_end", "07:00"),
+	}
+}
+
+func SetForecastSettings(s ForecastSettings, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change forecast control")
+	}
+	if s.LookaheadHours < 1 || s.LookaheadHours > 24 {
+		return errors.New("lookahead must be 1-24 hours")
+	}
+	if s.HeatSpike < 20 || s.HeatSpike > 50 || s.ColdDrop < 2 || s.ColdDrop > 30 {
+		return errors.New("heat spike must be 20-50°C and cold drop 2-30°C")
+	}
+	if s.PrecoolOffset < 0 || s.PrecoolOffset > 3 || s.PreheatOffset < 0 || s.PreheatOffset > 3 {
+		return errors.New("pre-cool and pre-heat offsets must be 0-3°C")
+	}
+	if _, err := time.Parse("15:04", s.OffPeakStart); err != nil {
+		return errors.New("off-peak start must be HH:MM")
+	}
+	if _, err := time.Parse("15:04", s.OffPeakEnd); err != nil {
+		return errors.New("off-peak end must be HH:MM")
+	}
+	enabled := "0"
+	if s.Enabled {
+		enabled = "1"
+	}
+	for _, kv := range [][2]string{
+		{"forecast_enabled", enabled},
+		{"forecast_lookahead_hours", fmt.Sprintf("%g", s.LookaheadHours)},
+		{"forecast_heat_spike", fmt.Sprintf("%g", s.HeatSpike)},
+		{"forecast_precool_offset", fmt.Sprintf("%g", s.PrecoolOffset)},
+		{"forecast_cold_drop", fmt.Sprintf("%g", s.ColdDrop)},
+		{"forecast_preheat_offset", fmt.Sprintf("%g", s.PreheatOffset)},
+		{"forecast_offpeak_start", s.OffPeakStart},
+		{"forecast_offpeak_end", s.OffPeakEnd},
+	} {
+		if err := SetSetting(kv[0], kv[1], user.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isOffPeak reports whether energy is on the cheap rate at t, from the
+// active time-of-use tariff if there is one, else the off-peak window.
+func isOffPeak(s ForecastSettings, t time.Time) bool {
+	if offPeak, known := tariffOffPeak(t); known {
+		return offPeak
+	}
+	return inTimeWindow(t, s.OffPeakStart, s.OffPeakEnd)
+}
+
+// RefreshForecast fetches the hourly forecast for location from the weather
+// provider and stores it, unless it was fetched within the last hour.
+func RefreshForecast(location string, force bool) error {
+	if len(location) < 2 || len(location) > 100 {
+		return errors.New("invalid location")
+	}
+	key := cacheKey(location)
+	if !force {
+		var recent int
+		err := db.QueryRow("SELECT COUNT(*) FROM weather_forecasts WHERE location = ? AND fetched_at > ?",
+			key, dbTime(time.Now().Add(-forecastRefresh))).Scan(&recent)
+		if err == nil && recent > 0 {
+			return nil
+		}
+	}
+	if weatherCache.recentlyFailed(location, weatherRetryAfter) {
+		return errors.New("weather unavailable, retrying shortly")
+	}
+	provider := weatherProvider()
+	forecast, err := provider.Forecast(location, forecastHours)
+	if err != nil {
+		weatherCache.fail(location)
+		LogEvent("weather_error", fmt.Sprintf("Forecast fetch for %s from %s failed: %v", location, provider.Name(), err), "system", "warning")
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := dbTime(time.Now())
+	for _, h := range forecast {
+		_, err := tx.Exec(`INSERT INTO weather_forecasts (location, forecast_for, temperature, humidity, conditions, fetched_at) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(location, forecast_for) DO UPDATE SET temperature = excluded.temperature, humidity = excluded.humidity,
+			conditions = excluded.conditions, fetched_at = excluded.fetched_at`,
+			key, dbTime(h.Time), h.Temperature, h.Humidity, h.Conditions, now)
+		if err != nil {
+			return err
+		}
+	}
+	// Hours that have passed are no longer useful.
+	if _, err := tx.Exec("DELETE FROM weather_forecasts WHERE forecast_for < ?", dbTime(time.Now().Add(-24*time.Hour))); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	LogEvent("weather_forecast", fmt.Sprintf("Stored %d-hour forecast for %s from %s", len(forecast), location, provider.Name()), "system", "info")
+	return nil
+}
+
+// GetForecast returns the stored forecast for location between from and to.
+func GetForecast(location string, from, to time.Time) ([]ForecastHour, error) {
+	rows, err := db.Query(`SELECT forecast_for, temperature, humidity, conditions FROM weather_forecasts
+		WHERE location = ? AND forecast_for >= ? AND forecast_for < ? ORDER BY forecast_for`,
+		cacheKey(location), dbTime(from.Truncate(time.Hour)), dbTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	forecast := []ForecastHour{}
+	for rows.Next() {
+		var h ForecastHour
+		if err := rows.Scan(&h.Time, &h.Temperature, &h.Humidity, &h.Conditions); err != nil {
+			continue
+		}
+		forecast = append(forecast, h)
+	}
+	return forecast, nil
+}
+
+// decideForecastAdjustment looks ahead for a heat spike while cooling, or a
+// cold front while heating in off-peak hours, and returns the target offset
+// with an explanation. outdoor is the current outdoor temperature.
+func decideForecastAdjustment(s ForecastSettings, mode HVACMode, outdoor float64, forecast []ForecastHour, now time.Time) forecastDecision {
+	if len(forecast) == 0 {
+		return forecastDecision{}
+	}
+	peak, trough := forecast[0], forecast[0]
+	for _, h := range forecast[1:] {
+		if h.Temperature > peak.Temperature {
+			peak = h
+		}
+		if h.Temperature < trough.Temperature {
+			trough = h
+		}
+	}
+	coolingMode := mode == ModeCool || mode == ModeAuto
+	heatingMode := mode == ModeHeat || mode == ModeAuto || mode == ModeEmergencyHeat
+
+	if coolingMode && s.PrecoolOffset > 0 && outdoor < s.HeatSpike && peak.Temperature >= s.HeatSpike {
+		return forecastDecision{
+			kind:   "precool",
+			offset: -s.PrecoolOffset,
+			reason: fmt.Sprintf("pre-cooling %.1f°C: forecast %.1f°C at %s, now %.1f°C outside",
+				s.PrecoolOffset, peak.Temperature, peak.Time.Local().Format("15:04"), outdoor),
+		}
+	}
+	if heatingMode && s.PreheatOffset > 0 && outdoor-trough.Temperature >= s.ColdDrop {
+		if !isOffPeak(s, now) {
+			return forecastDecision{
+				kind: "deferred",
+				reason: fmt.Sprintf("cold front to %.1f°C by %s, pre-heating deferred to off-peak hours",
+					trough.Temperature, trough.Time.Local().Format("15:04")),
+			}
+		}
+		return forecastDecision{
+			kind:   "preheat",
+			offset: s.PreheatOffset,
+			reason: fmt.Sprintf("pre-heating %.1f°C off-peak: cold front to %.1f°C by %s, now %.1f°C outside",
+				s.PreheatOffset, trough.Temperature, trough.Time.Local().Format("15:04"), outdoor),
+		}
+	}
+	return forecastDecision{}
+}
+
+// UpdateForecastControl refreshes the forecast and decides whether to
+// pre-cool or pre-heat. Changes in the decision are explained in the audit
+// log. It must not be called with hvacMutex held.
+func UpdateForecastControl(now time.Time) error {
+	s := LoadForecastSettings()
+	location := GetSetting("weather_location", "")
+	decision := forecastDecision{}
+	var err error
+	if state := GetOccupancy().State; s.Enabled && location != "" && state != OccupancyAway && state != OccupancyVacation {
+		decision, err = forecastAdjustment(s, location, now)
+	}
+
+	hvacMutex.Lock()
+	if hvacState.SafetyOverride != "" {
+		decision = forecastDecision{}
+	}
+	hvacState.ForecastOffset = decision.offset
+	hvacState.ForecastReason = decision.reason
+	hvacMutex.Unlock()
+
+	forecastMutex.Lock()
+	defer forecastMutex.Unlock()
+	if decision.kind != forecastLast.kind {
+		if decision.kind == "" {
+			LogEvent("forecast_control", "Forecast adjustment ended: "+forecastEndReason(forecastLast, s.Enabled), "system", "info")
+		} else {
+			LogEvent("forecast_control", "Forecast adjustment: "+decision.reason, "system", "info")
+		}
+	}
+	forecastLast = decision
+	return err
+}
+
+func forecastEndReason(last forecastDecision, enabled bool) string {
+	switch {
+	case !enabled:
+		return "forecast control disabled"
+	case last.kind == "precool":
+		return "no heat spike forecast ahead"
+	case last.kind == "preheat":
+		return "cold front passed or off-peak hours over"
+	}
+	return "cold front no longer forecast"
+}
+
+func forecastAdjustment(s ForecastSettings, location string, now time.Time) (forecastDecision, error) {
+	refreshErr := RefreshForecast(location, false)
+	forecast, err := GetForecast(location, now, now.Add(time.Duration(s.LookaheadHours*float64(time.Hour))))
+	if err != nil {
+		return forecastDecision{}, err
+	}
+	// An older forecast is still good enough to act on.
+	if len(forecast) == 0 && refreshErr != nil {
+		return forecastDecision{}, refreshErr
+	}
+	weather, err := GetOutdoorWeather(location)
+	if err != nil {
+		return forecastDecision{}, err
+	}
+	return decideForecastAdjustment(s, GetHVACStatus().Mode, weather.Temperature, forecast, now), nil
+}
+
+// applyForecast adds the forecast offset to a target: a negative offset
+// pre-cools and a positive one pre-heats. In auto mode an adjusted setpoint
+// stays clear of the opposite one. Callers must hold hvacMutex.
+func applyForecast(call HVACMode, target float64) float64 {
+	offset := hvacState.ForecastOffset
+	switch {
+	case call == ModeCool && offset < 0:
+		target += offset
+		if hvacState.Mode == ModeAuto {
+			target = math.Max(target, hvacState.HeatSetpoint+forecastAutoBandMargin)
+		}
+	case call == ModeHeat && offset > 0 && hvacState.HoldTemp == 0:
+		target += offset
+		if hvacState.Mode == ModeAuto {
+			target = math.Min(target, hvacState.CoolSetpoint-forecastAutoBandMargin)
+		}
+	}
+	return math.Max(10, math.Min(35, target))
+}
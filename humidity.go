@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	DefaultHumidifySetpoint   = 35.0 // %RH below which the humidifier runs
+	DefaultDehumidifySetpoint = 55.0 // %RH above which the dehumidifier runs
+	DefaultMaxOvercool        = 1.0  // °C the cooling setpoint may drop to remove moisture
+	humidityBand              = 3.0  // %RH hysteresis on both outputs
+	dewPointMargin            = 1.0  // °C kept between an overcooled setpoint and the dew point
+)
+
+type HumiditySettings struct {
+	HumidifySetpoint   float64
+	DehumidifySetpoint float64
+	MaxOvercool        float64
+	FrostProtection    bool   // cap humidification by outdoor temperature
+	Location           string // weather location used for frost protection
+}
+
+type HumidityStatus struct {
+	Humidity     float64
+	DewPoint     float64
+	Humidifier   bool
+	Dehumidifier bool
+	Overcool     float64
+	FrostLimit   float64 // 0 when frost protection is not limiting
+}
+
+func LoadHumiditySettings() HumiditySettings {
+	return HumiditySettings{
+		HumidifySetpoint:   GetSettingFloat("humidity_humidify_setpoint", DefaultHumidifySetpoint),
+		DehumidifySetpoint: GetSettingFloat("humidity_dehumidify_setpoint", DefaultDehumidifySetpoint),
+		MaxOvercool:        GetSettingFloat("humidity_max_overcool", DefaultMaxOvercool),
+		FrostProtection:    GetSetting("humidity_frost_protection", "1") == "1",
+		Location:           GetSetting("weather_location", ""),
+	}
+}
+
+func SetHumiditySettings(s HumiditySettings, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change humidity settings")
+	}
+	if s.HumidifySetpoint < 10 || s.HumidifySetpoint > 60 || s.DehumidifySetpoint < 30 || s.DehumidifySetpoint > 80 {
+		return errors.New("humidify setpoint must be 10-60% and dehumidify setpoint 30-80%")
+	}
+	if s.DehumidifySetpoint-s.HumidifySetpoint < 2*humidityBand {
+		return fmt.Errorf("dehumidify setpoint must be at least %.0f%% above humidify setpoint", 2*humidityBand)
+	}
+	if s.MaxOvercool < 0 || s.MaxOvercool > 3 {
+		return errors.New("max overcool must be 0-3°C")
+	}
+	if s.FrostProtection && s.Location != "" && (len(s.Location) < 2 || len(s.Location) > 100) {
+		return errors.New("invalid location")
+	}
+	frost := "0"
+	if s.FrostProtection {
+		frost = "1"
+	}
+	for _, kv := range [][2]string{
+		{"humidity_humidify_setpoint", fmt.Sprintf("%g", s.HumidifySetpoint)},
+		{"humidity_dehumidify_setpoint", fmt.Sprintf("%g", s.DehumidifySetpoint)},
+		{"humidity_max_overcool", fmt.Sprintf("%g", s.MaxOvercool)},
+		{"humidity_frost_protection", frost},
+		{"weather_location", s.Location},
+	} {
+		if err := SetSetting(kv[0], kv[1], user.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dewPoint uses the Magnus approximation, accurate to a few tenths of a
+// degree over normal indoor conditions.
+func dewPoint(temp, rh float64) float64 {
+	if rh <= 0 {
+		return math.Inf(-1)
+	}
+	const b, c = 17.62, 243.12
+	gamma := math.Log(rh/100) + b*temp/(c+temp)
+	return c * gamma / (b - gamma)
+}
+
+// frostLimit is the highest indoor humidity that will not condense on
+// windows at the given outdoor temperature.
+func frostLimit(outdoor float64) float64 {
+	switch {
+	case outdoor <= -30:
+		return 15
+	case outdoor <= -20:
+		return 20
+	case outdoor <= -10:
+		return 25
+	case outdoor <= -5:
+		return 30
+	case outdoor <= 0:
+		return 35
+	}
+	return 45
+}
+
+// UpdateHumidityControl samples humidity, drives the humidifier and
+// dehumidifier outputs and sets how far cooling may overcool to dry the air.
+func UpdateHumidityControl() error {
+	rh, err := ReadHumidity()
+	if err != nil {
+		return err
+	}
+	s := LoadHumiditySettings()
+
+	humidifyAt := s.HumidifySetpoint
+	frost := 0.0
+	if s.FrostProtection && s.Location != "" {
+		if weather, err := GetOutdoorWeather(s.Location); err == nil {
+			if limit := frostLimit(weather.Temperature); limit < humidifyAt {
+				humidifyAt, frost = limit, limit
+			}
+		}
+	}
+
+	hvacMutex.Lock()
+	defer hvacMutex.Unlock()
+	hvacState.CurrentHumidity = rh
+	hvacState.DewPoint = dewPoint(hvacState.CurrentTemp, rh)
+	hvacState.FrostLimit = frost
+	mode := effectiveMode()
+	if hvacState.SafetyOverride == SafetyOverrideCO {
+		// The CO interlock has already switched both outputs off
+		return nil
+	}
+
+	faulty := sensorDegraded("humidity")
+
+	// The humidifier needs the heating air stream to evaporate into.
+	humidify := OutputState(OutputHumidifier)
+	if faulty || hvacState.Mode == ModeOff || mode == ModeCool || !hvacState.IsRunning {
+		humidify = false
+	} else if rh < humidifyAt-humidityBand {
+		humidify = true
+	} else if rh >= humidifyAt {
+		humidify = false
+	}
+	reason := fmt.Sprintf("%.0f%% RH, setpoint %.0f%%", rh, humidifyAt)
+	if frost > 0 {
+		reason += " (frost protection)"
+	}
+	SetOutput(OutputHumidifier, humidify, reason)
+
+	dehumidify := OutputState(OutputDehumidifier)
+	if faulty || hvacState.Mode == ModeOff || humidify {
+		dehumidify = false
+	} else if rh > s.DehumidifySetpoint+humidityBand {
+		dehumidify = true
+	} else if rh <= s.DehumidifySetpoint {
+		dehumidify = false
+	}
+	SetOutput(OutputDehumidifier, dehumidify, fmt.Sprintf("%.0f%% RH, setpoint %.0f%%", rh, s.DehumidifySetpoint))
+
+	// Overcool grows with the excess humidity, up to the configured limit,
+	// and never takes the setpoint close to the dew point.
+	overcool := 0.0
+	if !faulty && mode == ModeCool && rh > s.DehumidifySetpoint {
+		overcool = math.Min(s.MaxOvercool, (rh-s.DehumidifySetpoint)/10)
+		target := hvacState.TargetTemp
+		if hvacState.Mode == ModeAuto {
+			target = hvacState.CoolSetpoint
+		}
+		if floor := hvacState.DewPoint + dewPointMargin; target-overcool < floor {
+			overcool = math.Max(0, target-floor)
+		}
+	}
+	if overcool != hvacState.Overcool {
+		LogEvent("humidity_control", fmt.Sprintf("Cooling overcool set to %.1f°C at %.0f%% RH", overcool, rh), "system", "info")
+		hvacState.Overcool = overcool
+	}
+	return nil
+}
+
+func GetHumidityStatus() HumidityStatus {
+	hvacMutex.RLock()
+	defer hvacMutex.RUnlock()
+	return HumidityStatus{
+		Humidity:     hvacState.CurrentHumidity,
+		DewPoint:     hvacState.DewPoint,
+		Humidifier:   OutputState(OutputHumidifier),
+		Dehumidifier: OutputState(OutputDehumidifier),
+		Overcool:     hvacState.Overcool,
+		FrostLimit:   hvacState.FrostLimit,
+	}
+}
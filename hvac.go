@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"sync"
 	"time"
 )
@@ -14,32 +15,68 @@ const (
 	ModeHeat HVACMode = "heat"
 	ModeCool HVACMode = "cool"
 	ModeFan  HVACMode = "fan"
+	ModeAuto HVACMode = "auto"
+	// ModeEmergencyHeat runs only the auxiliary heat of a heat pump.
+	ModeEmergencyHeat HVACMode = "emergency"
 )
 
 type HVACState struct {
-	Mode        HVACMode
-	TargetTemp  float64
-	CurrentTemp float64
-	IsRunning   bool
-	LastUpdate  time.Time
+	Mode         HVACMode
+	TargetTemp   float64
+	CurrentTemp  float64
+	IsRunning    bool
+	LastUpdate   time.Time
+	HeatSetpoint float64  // used in auto mode
+	CoolSetpoint float64  // used in auto mode
+	ActiveCall   HVACMode // heat or cool as selected by auto mode, empty until needed
+	WaitReason   string   // why a start or stop is being held back by protection timers
+	WaitUntil    time.Time
+	Stage        int  // running heating/cooling stage, 0 when idle or in emergency heat
+	AuxHeat      bool // auxiliary/emergency heat energised
+
+	CurrentHumidity float64
+	DewPoint        float64
+	Overcool        float64 // °C the cooling target is lowered to dehumidify
+	FrostLimit      float64 // humidifier cap from outdoor temperature, 0 if none
+
+	SafetyOverride string   // safety interlock holding the equipment, if any
+	ForcedMode     HVACMode // what the interlock is running instead of Mode
+	Setback        float64  // °C the occupancy state moves setpoints towards saving energy
+	HoldTemp       float64  // vacation heating temperature replacing the setpoint, 0 if none
+	ForecastOffset float64  // °C added to the target ahead of forecast weather
+	ForecastReason string   // why the forecast offset applies
+	EcoOffset      float64  // °C setpoints are widened by while an energy budget is at risk
+	EcoReason      string
+	Lockouts       LockoutStatus
+	ControlTarget  float64 // target the last heat or cool call controlled to, after every adjustment
 }
 
 var (
-	hvacMutex     sync.RWMutex
-	hvacState     HVACState
-	startTime     time.Time
-	lastEnergyLog time.Time
+	hvacMutex       sync.RWMutex
+	hvacState       HVACState
+	controlStrategy ControlStrategy
+	lastRunStop     time.Time
+	wasRunning      bool
+	stageStart      time.Time
 )
 
 func InitializeHVAC() error {
 	hvacMutex.Lock()
 	defer hvacMutex.Unlock()
 	hvacState = HVACState{
-		Mode:        ModeOff,
-		TargetTemp:  22.0,
-		CurrentTemp: 20.0,
-		IsRunning:   false,
-		LastUpdate:  time.Now(),
+		Mode:         ModeOff,
+		TargetTemp:   22.0,
+		CurrentTemp:  20.0,
+		IsRunning:    false,
+		LastUpdate:   time.Now(),
+		HeatSetpoint: DefaultHeatSetpoint,
+		CoolSetpoint: DefaultCoolSetpoint,
+	}
+	openRun = nil
+	closeStaleIntervals()
+	loadControlStrategy()
+	if err := LoadEquipmentConfig(); err != nil {
+		LogEvent("hvac_init", "Equipment config unavailable, using defaults: "+err.Error(), "system", "warning")
 	}
 	LogEvent("hvac_init", "HVAC system initialized", "system", "info")
 	return nil
@@ -53,17 +90,38 @@ func SetHVACMode(mode string, user *User) error {
 	mode = SanitizeInput(mode)
 	// --- Guest restriction removed ---
 	hvacMode := HVACMode(mode)
-	if hvacMode != ModeOff && hvacMode != ModeHeat && hvacMode != ModeCool && hvacMode != ModeFan {
+	if hvacState.SafetyOverride == SafetyOverrideCO {
+		AuditSecurityEvent("co_override_denied", "HVAC mode change to "+mode+" blocked by CO alarm", user.Username)
+		return errors.New("CO alarm active: HVAC is locked out until a homeowner acknowledges the alarm")
+	}
+	if hvacMode != ModeOff && hvacMode != ModeHeat && hvacMode != ModeCool && hvacMode != ModeFan && hvacMode != ModeAuto && hvacMode != ModeEmergencyHeat {
 		return errors.New("invalid HVAC mode")
 	}
+	if hvacMode == ModeEmergencyHeat {
+		if err := checkEmergencyHeatAllowed(); err != nil {
+			return err
+		}
+	}
+	if (hvacMode == ModeCool || hvacMode == ModeAuto) && GetEquipmentConfig().CoolStages == 0 {
+		return errors.New("no cooling equipment is configured")
+	}
 	oldMode := hvacState.Mode
 	hvacState.Mode = hvacMode
 	hvacState.LastUpdate = time.Now()
-	if hvacMode == ModeOff {
-		hvacState.IsRunning = false
+	if oldMode != hvacMode {
+		controlStrategy.Reset()
+		hvacState.ActiveCall = ""
+		hvacState.ControlTarget = 0
+		if hvacState.IsRunning && hvacState.ForcedMode == "" {
+			// The call has changed, so stop the run and make the new one
+			// pass the start checks, including the minimum off-time
+			setWaitState("", time.Time{})
+			hvacState.IsRunning = false
+			hvacState.Stage, hvacState.AuxHeat = 0, false
+			LogEvent("hvac_stop", fmt.Sprintf("%s mode stopped for mode change to %s", oldMode, hvacMode), "system", "info")
+		}
 	}
-	db.Exec("INSERT INTO hvac_state (mode, target_temp, current_temp, is_running) VALUES (?, ?, ?, ?)",
-		mode, hvacState.TargetTemp, hvacState.CurrentTemp, hvacState.IsRunning)
+	recordHVACState()
 	LogEvent("hvac_mode_change", fmt.Sprintf("Mode changed from %s to %s", oldMode, hvacMode), user.Username, "info")
 	return nil
 }
@@ -76,11 +134,18 @@ func SetTargetTemperature(temp float64, user *User) error {
 		AuditSecurityEvent("invalid_temp", fmt.Sprintf("Invalid temperature attempted: %.1f", temp), user.Username)
 		return err
 	}
+	if hvacState.Mode == ModeAuto {
+		// Move the auto band so it is centred on the new target.
+		half := (hvacState.CoolSetpoint - hvacState.HeatSetpoint) / 2
+		if err := ValidateAutoSetpoints(temp-half, temp+half); err != nil {
+			return err
+		}
+		hvacState.HeatSetpoint, hvacState.CoolSetpoint = temp-half, temp+half
+	}
 	oldTemp := hvacState.TargetTemp
 	hvacState.TargetTemp = temp
 	hvacState.LastUpdate = time.Now()
-	db.Exec("INSERT INTO hvac_state (mode, target_temp, current_temp, is_running) VALUES (?, ?, ?, ?)",
-		hvacState.Mode, temp, hvacState.CurrentTemp, hvacState.IsRunning)
+	recordHVACState()
 	LogEvent("hvac_temp_change", fmt.Sprintf("Target temp changed from %.1f to %.1f", oldTemp, temp), user.Username, "info")
 	return nil
 }
@@ -92,110 +157,162 @@ func GetHVACStatus() HVACState {
 }
 
 func UpdateHVACLogic() error {
+	lockouts := evaluateLockouts(time.Now())
 	hvacMutex.Lock()
 	defer hvacMutex.Unlock()
-	currentTemp, err := ReadTemperature()
+	// Whatever this tick decides, the meter follows it and checkpoints.
+	defer func() { syncMeter(time.Now()) }()
+	setLockouts(lockouts)
+	currentTemp, err := ReadControlTemperature()
 	if err != nil {
 		return err
 	}
+	if sensorUnreliable("temperature") {
+		currentTemp = fallbackTemperature(currentTemp)
+	} else {
+		lastGoodTemp = currentTemp
+	}
 	hvacState.CurrentTemp = currentTemp
-	if hvacState.Mode == ModeOff {
+	now := time.Now()
+	if hvacState.SafetyOverride == SafetyOverrideCO {
+		// The CO interlock owns the equipment until it is acknowledged
+		hvacState.LastUpdate = now
+		return nil
+	}
+	if checkSensorFailSafe(currentTemp) {
+		hvacState.LastUpdate = now
+		return nil
+	}
+	checkTemperatureSafety(currentTemp)
+	if hvacState.Mode == ModeOff && hvacState.ForcedMode == "" {
+		setWaitState("", time.Time{})
 		if hvacState.IsRunning {
-			logRuntime()
 			hvacState.IsRunning = false
+			hvacState.Stage, hvacState.AuxHeat = 0, false
+			recordHVACState()
 		}
 		return nil
 	}
-	if hvacState.Mode == ModeHeat {
-		if currentTemp < hvacState.TargetTemp-1.0 {
-			if !hvacState.IsRunning {
-				hvacState.IsRunning = true
-				startTime = time.Now()
-				LogEvent("hvac_start", "Heating started", "system", "info")
-			} else {
-				// Log periodic energy for long-running operations
-				logPeriodicRuntime()
-			}
-		} else if currentTemp > hvacState.TargetTemp+0.5 {
-			if hvacState.IsRunning {
-				logRuntime()
-				hvacState.IsRunning = false
-				LogEvent("hvac_stop", "Heating stopped", "system", "info")
-			}
+	if hvacState.ForcedMode == ModeHeat || hvacState.Mode == ModeHeat || hvacState.Mode == ModeCool || hvacState.Mode == ModeAuto || hvacState.Mode == ModeEmergencyHeat {
+		callMode, target := effectiveMode(), hvacState.TargetTemp
+		if hvacState.SafetyOverride == SafetyOverrideFreeze {
+			target = freezeTarget(LoadSafetyLimits())
+		} else if hvacState.Mode == ModeAuto {
+			selectAutoCall(currentTemp)
+			callMode, target = hvacState.ActiveCall, autoTarget()
+		} else {
+			target = applyForecast(callMode, applySetback(callMode, target))
+		}
+		action := "Heating"
+		if callMode == ModeCool {
+			action = "Cooling"
+			target -= hvacState.Overcool
+		}
+		hvacState.ControlTarget = target
+		shouldRun := callMode != "" && controlStrategy.ShouldRun(callMode, currentTemp, target, hvacState.IsRunning, now)
+		if hvacState.SafetyOverride == SafetyOverrideFreeze {
+			// Freeze protection heats until recovered, whatever the strategy
+			shouldRun = currentTemp < target
 		}
-	} else if hvacState.Mode == ModeCool {
-		if currentTemp > hvacState.TargetTemp+1.0 {
+		lockedOut := lockoutReason(callMode)
+		if lockedOut != "" {
+			shouldRun = false
+		}
+		if shouldRun {
 			if !hvacState.IsRunning {
-				hvacState.IsRunning = true
-				startTime = time.Now()
-				LogEvent("hvac_start", "Cooling started", "system", "info")
+				if ok, reason, until := checkStartAllowed(callMode, now); !ok {
+					setWaitState("waiting: "+reason, until)
+				} else {
+					setWaitState("", time.Time{})
+					hvacState.IsRunning = true
+					startStaging(callMode, now)
+					LogEvent("hvac_start", action+" started ("+stageLabel(callMode, hvacState.Stage, hvacState.AuxHeat)+")", "system", "info")
+					recordHVACState()
+				}
 			} else {
-				// Log periodic energy for long-running operations
-				logPeriodicRuntime()
+				setWaitState("", time.Time{})
+				updateStaging(callMode, currentTemp, target, now)
 			}
-		} else if currentTemp < hvacState.TargetTemp-0.5 {
-			if hvacState.IsRunning {
-				logRuntime()
+		} else if hvacState.IsRunning {
+			if ok, until := checkStopAllowed(now); !ok {
+				setWaitState("holding: minimum on-time", until)
+				updateStaging(callMode, currentTemp, target, now)
+			} else {
+				setWaitState("", time.Time{})
 				hvacState.IsRunning = false
-				LogEvent("hvac_stop", "Cooling stopped", "system", "info")
+				hvacState.Stage, hvacState.AuxHeat = 0, false
+				details := action + " stopped"
+				if lockedOut != "" {
+					details += ": " + lockedOut
+				}
+				LogEvent("hvac_stop", details, "system", "info")
+				recordHVACState()
 			}
+		} else {
+			setWaitState("", time.Time{})
 		}
 	} else if hvacState.Mode == ModeFan {
+		setWaitState("", time.Time{})
 		if !hvacState.IsRunning {
 			hvacState.IsRunning = true
-			startTime = time.Now()
 			LogEvent("hvac_start", "Fan started", "system", "info")
-		} else {
-			// Log periodic energy for fan mode
-			logPeriodicRuntime()
+			recordHVACState()
 		}
 	}
 	hvacState.LastUpdate = time.Now()
 	return nil
 }
 
-func logRuntime() {
-	if !startTime.IsZero() {
-		runtime := int(time.Since(startTime).Minutes())
-		if runtime > 0 {
-			kwh := estimateEnergyUsage(hvacState.Mode, runtime)
-			db.Exec("INSERT INTO energy_logs (hvac_mode, runtime_minutes, estimated_kwh) VALUES (?, ?, ?)",
-				hvacState.Mode, runtime, kwh)
-			LogEvent("energy_track", fmt.Sprintf("Tracked %.2f kWh for %s mode (%d minutes)", kwh, hvacState.Mode, runtime), "system", "info")
-		}
-		startTime = time.Time{}     // Reset startTime
-		lastEnergyLog = time.Time{} // Reset last log time
+// recordHVACState appends the current state to hvac_state history and
+// meters the change. Callers must hold hvacMutex.
+func recordHVACState() {
+	syncMeter(time.Now())
+	if wasRunning != hvacState.IsRunning {
+		noteRunTransition(hvacState.IsRunning, time.Now())
+	}
+	if wasRunning && !hvacState.IsRunning {
+		lastRunStop = time.Now()
+	}
+	wasRunning = hvacState.IsRunning
+	var activeCall, controlTarget interface{}
+	if hvacState.ForcedMode != "" {
+		activeCall = string(hvacState.ForcedMode)
+	} else if hvacState.Mode == ModeAuto && hvacState.ActiveCall != "" {
+		activeCall = string(hvacState.ActiveCall)
 	}
+	if hvacState.IsRunning && hvacState.ControlTarget != 0 {
+		controlTarget = hvacState.ControlTarget
+	}
+	db.Exec("INSERT INTO hvac_state (mode, target_temp, current_temp, is_running, active_call, control_target) VALUES (?, ?, ?, ?, ?, ?)",
+		hvacState.Mode, hvacState.TargetTemp, hvacState.CurrentTemp, hvacState.IsRunning, activeCall, controlTarget)
 }
 
-func logPeriodicRuntime() {
-	if !startTime.IsZero() {
-		// Only log every 2 minutes to avoid too many small entries
-		timeSinceLastLog := time.Since(lastEnergyLog)
-		if lastEnergyLog.IsZero() || timeSinceLastLog >= 2*time.Minute {
-			runtime := int(time.Since(startTime).Minutes())
-			if runtime > 0 {
-				kwh := estimateEnergyUsage(hvacState.Mode, runtime)
-				db.Exec("INSERT INTO energy_logs (hvac_mode, runtime_minutes, estimated_kwh) VALUES (?, ?, ?)",
-					hvacState.Mode, runtime, kwh)
-				//LogEvent("energy_track", fmt.Sprintf("Tracked %.2f kWh for %s mode (%d minutes)", kwh, hvacState.Mode, runtime), "system", "info")
-				// Reset startTime to track next period
-				startTime = time.Now()
-				lastEnergyLog = time.Now()
-			}
-		}
+// applySetback moves a setpoint by the occupancy setback and any eco mode
+// offset, down for heating and up for cooling, within the allowed
+// temperature range. A vacation hold temperature replaces the heating
+// setpoint instead. Callers must hold hvacMutex.
+func applySetback(call HVACMode, target float64) float64 {
+	setback := hvacState.Setback + hvacState.EcoOffset
+	if call == ModeCool {
+		return math.Min(35, target+setback)
+	}
+	if hvacState.HoldTemp > 0 {
+		return hvacState.HoldTemp
 	}
+	return math.Max(10, target-setback)
 }
 
-func estimateEnergyUsage(mode HVACMode, runtimeMinutes int) float64 {
-	kwhPerHour := 0.0
-	switch mode {
-	case ModeHeat:
-		kwhPerHour = 2.5
-	case ModeCool:
-		kwhPerHour = 3.0
-	case ModeFan:
-		kwhPerHour = 0.5
-	}
-	return kwhPerHour * (float64(runtimeMinutes) / 60.0)
+// effectiveMode is the mode the equipment is actually running in, which in
+// auto mode is the heat/cool call it selected. Callers must hold hvacMutex.
+func effectiveMode() HVACMode {
+	if hvacState.ForcedMode != "" {
+		return hvacState.ForcedMode
+	}
+	switch hvacState.Mode {
+	case ModeAuto:
+		return hvacState.ActiveCall
+	case ModeEmergencyHeat:
+		return ModeHeat
+	}
+	return hvacState.Mode
 }
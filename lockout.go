@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	lockoutMaxAge         = 90 * time.Minute // outdoor readings older than this are not trusted
+	lockoutWeatherRefresh = 5 * time.Minute
+)
+
+// LockoutSettings are outdoor temperatures beyond which equipment is not
+// used. Below the balance point a heat pump's compressor cannot keep up, so
+// aux heat takes over; aux heat is too expensive to use above AuxLockout;
+// and compressors must not cool in cold weather.
+type LockoutSettings struct {
+	Enabled      bool
+	BalancePoint float64 // °C below which compressor heating is locked out
+	AuxLockout   float64 // °C above which aux heat is locked out
+	CoolLockout  float64 // °C below which cooling is locked out
+}
+
+// LockoutStatus is the outcome of the last lockout evaluation.
+type LockoutStatus struct {
+	Outdoor        float64
+	Stale          bool // weather unavailable or too old; no lockouts applied
+	CompressorHeat bool
+	AuxHeat        bool
+	Cool           bool
+	Reason         string
+}
+
+func LoadLockoutSettings() LockoutSettings {
+	return LockoutSettings{
+		Enabled:      GetSetting("lockout_enabled", "0") == "1",
+		BalancePoint: GetSettingFloat("lockout_balance_point", -5),
+		AuxLockout:   GetSettingFloat("lockout_aux_above", 5),
+		CoolLockout:  GetSettingFloat("lockout_cool_below", 10),
+	}
+}
+
+func SetLockoutSettings(s LockoutSettings, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change outdoor lockouts")
+	}
+	if s.BalancePoint < -30 || s.BalancePoint > 15 {
+		return errors.New("balance point must be -30 to 15°C")
+	}
+	if s.AuxLockout < -20 || s.AuxLockout > 25 {
+		return errors.New("aux heat lockout must be -20 to 25°C")
+	}
+	if s.AuxLockout < s.BalancePoint {
+		return errors.New("aux heat lockout must not be below the balance point, or neither could heat")
+	}
+	if s.CoolLockout < -10 || s.CoolLockout > 25 {
+		return errors.New("cooling lockout must be -10 to 25°C")
+	}
+	enabled := "0"
+	if s.Enabled {
+		enabled = "1"
+	}
+	for _, kv := range [][2]string{
+		{"lockout_enabled", enabled},
+		{"lockout_balance_point", fmt.Sprintf("%g", s.BalancePoint)},
+		{"lockout_aux_above", fmt.Sprintf("%g", s.AuxLockout)},
+		{"lockout_cool_below", fmt.Sprintf("%g", s.CoolLockout)},
+	} {
+		if err := SetSetting(kv[0], kv[1], user.Username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RefreshLockoutWeather fetches the outdoor weather the lockouts are
+// evaluated from. It runs outside the control loop, which only reads the
+// cache, so a slow or failing provider never delays a control tick.
+func RefreshLockoutWeather() {
+	if !LoadLockoutSettings().Enabled {
+		return
+	}
+	if location := GetSetting("weather_location", ""); location != "" {
+		GetOutdoorWeather(location)
+	}
+}
+
+// evaluateLockouts decides the lockouts from the cached outdoor
+// temperature. Without a fresh reading it fails safe by applying none, so
+// heating is never lost to a weather outage.
+func evaluateLockouts(now time.Time) LockoutStatus {
+	s := LoadLockoutSettings()
+	if !s.Enabled {
+		return LockoutStatus{}
+	}
+	location := GetSetting("weather_location", "")
+	if location == "" {
+		return LockoutStatus{Stale: true, Reason: "no weather location set"}
+	}
+	weather, ok := weatherCache.get(location, weatherStaleLimit)
+	if !ok {
+		return LockoutStatus{Stale: true, Reason: "outdoor temperature unavailable"}
+	}
+	if age := now.Sub(weather.Timestamp); age > lockoutMaxAge {
+		return LockoutStatus{Stale: true, Reason: fmt.Sprintf("outdoor temperature %.0f minutes old", age.Minutes())}
+	}
+
+	eq := GetEquipmentConfig()
+	status := LockoutStatus{Outdoor: weather.Temperature}
+	reasons := []string{}
+	if eq.HeatType == HeatTypeHeatPump && weather.Temperature < s.BalancePoint {
+		status.CompressorHeat = true
+		reasons = append(reasons, fmt.Sprintf("compressor heat below balance point %.1f°C", s.BalancePoint))
+	}
+	if eq.HasAuxHeat && weather.Temperature > s.AuxLockout {
+		status.AuxHeat = true
+		reasons = append(reasons, fmt.Sprintf("aux heat above %.1f°C", s.AuxLockout))
+	}
+	if eq.CoolStages > 0 && weather.Temperature < s.CoolLockout {
+		status.Cool = true
+		reasons = append(reasons, fmt.Sprintf("cooling below %.1f°C", s.CoolLockout))
+	}
+	if len(reasons) > 0 {
+		status.Reason = fmt.Sprintf("outdoor %.1f°C: ", weather.Temperature) + strings.Join(reasons, ", ")
+	}
+	return status
+}
+
+// setLockouts records a new evaluation, auditing any change.
+// Callers must hold hvacMutex.
+func setLockouts(status LockoutStatus) {
+	old := hvacState.Lockouts
+	hvacState.Lockouts = status
+	if status.Stale != old.Stale && status.Stale {
+		LogEvent("outdoor_lockout", "Outdoor lockouts suspended: "+status.Reason, "system", "warning")
+		return
+	}
+	if status.CompressorHeat == old.CompressorHeat && status.AuxHeat == old.AuxHeat && status.Cool == old.Cool && status.Stale == old.Stale {
+		return
+	}
+	if status.Reason == "" {
+		LogEvent("outdoor_lockout", fmt.Sprintf("Outdoor lockouts cleared at %.1f°C", status.Outdoor), "system", "info")
+		return
+	}
+	LogEvent("outdoor_lockout", "Locked out: "+status.Reason, "system", "info")
+}
+
+// lockoutReason says why a call cannot run at all under the lockouts, or ""
+// if it can. Heat with the compressor locked out still runs on aux heat, and
+// freeze protection and emergency heat are never locked out.
+// Callers must hold hvacMutex.
+func lockoutReason(call HVACMode) string {
+	l := hvacState.Lockouts
+	switch {
+	case call == ModeCool && l.Cool:
+		return fmt.Sprintf("cooling locked out at %.1f°C outdoor", l.Outdoor)
+	case call == ModeHeat && l.CompressorHeat && (!GetEquipmentConfig().HasAuxHeat || l.AuxHeat) &&
+		hvacState.SafetyOverride != SafetyOverrideFreeze && hvacState.Mode != ModeEmergencyHeat:
+		return fmt.Sprintf("heat pump locked out at %.1f°C outdoor", l.Outdoor)
+	}
+	return ""
+}
+
+// applyHeatLockouts adjusts a heating stage choice for the lockouts: aux
+// heat replaces a locked-out compressor, and locked-out aux heat drops out.
+// Callers must hold hvacMutex.
+func applyHeatLockouts(stage int, aux bool) (int, bool) {
+	l := hvacState.Lockouts
+	if hvacState.Mode == ModeEmergencyHeat {
+		return stage, aux
+	}
+	if l.CompressorHeat && GetEquipmentConfig().HasAuxHeat && !l.AuxHeat {
+		return 0, true
+	}
+	if l.AuxHeat && stage > 0 {
+		aux = false
+	}
+	return stage, aux
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
@@ -14,6 +16,13 @@ import (
 var currentUser *User
 
 func main() {
+	stubAddr := flag.String("weather-stub", "", "only serve the local weather stub on this address, e.g. 127.0.0.1:8090")
+	flag.Parse()
+	if *stubAddr != "" {
+		runWeatherStub(*stubAddr)
+		return
+	}
+
 	fmt.Println("==============================================")
 	fmt.Println("   SMART THERMOSTAT SECURITY SYSTEM v1.0")
 	fmt.Println("   Secure-by-Design IoT Thermostat")
@@ -37,6 +46,12 @@ func main() {
 	if err := InitializeHVAC(); err != nil {
 		fmt.Printf("ERROR: HVAC initialization failed: %v\n", err)
 	}
+	if err := InitializeSafety(); err != nil {
+		fmt.Printf("ERROR: Safety initialization failed: %v\n", err)
+	}
+	if err := InitializeOccupancy(); err != nil {
+		fmt.Printf("ERROR: Occupancy initialization failed: %v\n", err)
+	}
 
 	// Setup graceful shutdown
 	setupGracefulShutdown()
@@ -45,17 +60,38 @@ func main() {
 	go hvacControlLoop()
 	go sensorMonitorLoop()
 	go sessionCleanupLoop()
+	go sensorRollupLoop()
+	go energyBudgetLoop()
+	go outdoorHistoryLoop()
+	go maintenanceLoop()
+	go lockoutWeatherLoop()
 
 	// Main CLI loop
 	runCLI()
 }
 
+// runWeatherStub serves the weather stub until interrupted. The API key it
+// expects, if any, comes from the same environment variable the client uses.
+func runWeatherStub(addr string) {
+	server, listening, err := StartWeatherStub(addr, &WeatherStub{APIKey: os.Getenv(weatherAPIKeyEnv)})
+	if err != nil {
+		fmt.Printf("FATAL: weather stub: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Weather stub serving http://%s/data/2.5/weather (Ctrl+C to stop)\n", listening)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	server.Close()
+}
+
 func setupGracefulShutdown() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		fmt.Println("\n\nShutting down gracefully...")
+		CloseEnergyMeter()
 		CloseDatabase()
 		os.Exit(0)
 	}()
@@ -65,9 +101,22 @@ func hvacControlLoop() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 	for range ticker.C {
+		now := time.Now()
+		if err := UpdateOccupancy(now); err != nil {
+			LogEvent("occupancy_error", "Occupancy update failed: "+err.Error(), "system", "warning")
+		}
+		if err := RunScheduler(now); err != nil {
+			LogEvent("schedule_error", "Schedule run failed: "+err.Error(), "system", "warning")
+		}
+		if err := UpdateForecastControl(now); err != nil {
+			LogEvent("weather_error", "Forecast control failed: "+err.Error(), "system", "warning")
+		}
 		if err := UpdateHVACLogic(); err != nil {
 			LogEvent("hvac_error", "HVAC update failed: "+err.Error(), "system", "warning")
 		}
+		if err := UpdateHumidityControl(); err != nil {
+			LogEvent("hvac_error", "Humidity update failed: "+err.Error(), "system", "warning")
+		}
 	}
 }
 
@@ -78,6 +127,9 @@ func sensorMonitorLoop() {
 		if _, err := ReadAllSensors(); err != nil {
 			LogEvent("sensor_error", "Sensor read failed: "+err.Error(), "system", "warning")
 		}
+		if _, err := DetectSensorFaults(); err != nil {
+			LogEvent("sensor_error", "Sensor fault detection failed: "+err.Error(), "system", "warning")
+		}
 	}
 }
 
@@ -91,6 +143,65 @@ func sessionCleanupLoop() {
 	}
 }
 
+func sensorRollupLoop() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+	lastPrune := time.Now()
+	for range ticker.C {
+		if err := RollupSensorReadings(); err != nil {
+			LogEvent("rollup_error", "Sensor rollup failed: "+err.Error(), "system", "warning")
+		}
+		if time.Since(lastPrune) >= time.Hour {
+			if err := PruneSensorHistory(); err != nil {
+				LogEvent("rollup_error", "Sensor history prune failed: "+err.Error(), "system", "warning")
+			}
+			lastPrune = time.Now()
+		}
+	}
+}
+
+func energyBudgetLoop() {
+	ticker := time.NewTicker(budgetCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := EvaluateEnergyBudgets(time.Now()); err != nil {
+			LogEvent("budget_error", "Energy budget check failed: "+err.Error(), "system", "warning")
+		}
+	}
+}
+
+func maintenanceLoop() {
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := CheckMaintenance(time.Now()); err != nil {
+			LogEvent("maintenance_error", "Maintenance check failed: "+err.Error(), "system", "warning")
+		}
+	}
+}
+
+// lockoutWeatherLoop keeps the weather the outdoor lockouts read current.
+func lockoutWeatherLoop() {
+	RefreshLockoutWeather()
+	ticker := time.NewTicker(lockoutWeatherRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		RefreshLockoutWeather()
+	}
+}
+
+// outdoorHistoryLoop keeps the outdoor temperature history used for degree
+// days current, whether or not any control feature is fetching weather.
+func outdoorHistoryLoop() {
+	ticker := time.NewTicker(15 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		if location := GetSetting("weather_location", ""); location != "" {
+			GetOutdoorWeather(location)
+		}
+	}
+}
+
 func runCLI() {
 	reader := bufio.NewReader(os.Stdin)
 
@@ -124,6 +235,9 @@ func runCLI() {
 }
 
 func displayMenu() {
+	if alarm := GetCOAlarm(); alarm.Active {
+		fmt.Printf("\n!!! CO ALARM: %.1f ppm (peak %.1f) - HVAC shut down, fan ventilating !!!\n", alarm.LastPPM, alarm.PeakPPM)
+	}
 	fmt.Println("\n=== MAIN MENU ===")
 	fmt.Println("1.  View Current Status")
 
@@ -132,12 +246,12 @@ func displayMenu() {
 	}
 
 	fmt.Println("3.  Change HVAC Mode")
-	fmt.Println("4.  View Sensor Readings")
+	fmt.Println("4.  Sensors")
 	fmt.Println("5.  View Weather")
 
 	// Homeowner and technician can view energy usage
 	if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
-		fmt.Println("6.  View Energy Usage")
+		fmt.Println("6.  Energy Usage & Costs")
 		fmt.Println("7.  Manage Profiles")
 		fmt.Println("8.  Manage Users")
 		fmt.Println("9.  Run Diagnostics")
@@ -153,6 +267,17 @@ func displayMenu() {
 
 	fmt.Println("11. Change Password")
 	fmt.Println("12. Logout")
+
+	if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+		fmt.Println("13. HVAC Settings")
+	}
+	if currentUser.Role == "homeowner" {
+		fmt.Println("14. Acknowledge CO Alarm")
+	}
+	fmt.Println("15. Occupancy")
+	if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+		fmt.Println("16. Service Tickets")
+	}
 	fmt.Println("0.  Exit")
 }
 
@@ -169,14 +294,14 @@ func handleMenuChoice(choice string, reader *bufio.Reader) {
 	case "3":
 		changeHVACMode(reader)
 	case "4":
-		viewSensorReadings()
+		sensorMenu(reader)
 	case "5":
 		viewWeather(reader)
 
 	// Homeowner or technician only
 	case "6":
 		if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
-			viewEnergyUsage(reader)
+			energyMenu(reader)
 		} else if currentUser.Role == "guest" {
 			manageProfiles(reader, currentUser)
 		} else {
@@ -211,8 +336,29 @@ func handleMenuChoice(choice string, reader *bufio.Reader) {
 		changePasswordCLI(reader)
 	case "12":
 		logout()
+	case "13":
+		if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+			hvacSettingsMenu(reader)
+		} else {
+			fmt.Println("Invalid choice")
+		}
+	case "14":
+		if currentUser.Role == "homeowner" {
+			acknowledgeCOAlarm()
+		} else {
+			fmt.Println("Invalid choice")
+		}
+	case "15":
+		occupancyMenu(reader)
+	case "16":
+		if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+			serviceTicketsMenu(reader)
+		} else {
+			fmt.Println("Invalid choice")
+		}
 	case "0":
 		fmt.Println("Goodbye!")
+		CloseEnergyMeter()
 		CloseDatabase()
 		os.Exit(0)
 	default:
@@ -224,9 +370,77 @@ func viewCurrentStatus() {
 	fmt.Println("\n=== CURRENT SYSTEM STATUS ===")
 	status := GetHVACStatus()
 	fmt.Printf("HVAC Mode: %s\n", status.Mode)
-	fmt.Printf("Target Temperature: %.1f°C\n", status.TargetTemp)
+	if status.Mode == ModeAuto {
+		fmt.Printf("Auto Setpoints: heat %.1f°C / cool %.1f°C\n", status.HeatSetpoint, status.CoolSetpoint)
+		call := "idle"
+		if status.ActiveCall != "" {
+			call = string(status.ActiveCall)
+		}
+		fmt.Printf("Auto Call: %s\n", call)
+	} else {
+		fmt.Printf("Target Temperature: %.1f°C\n", status.TargetTemp)
+	}
 	fmt.Printf("Current Temperature: %.1f°C\n", status.CurrentTemp)
+	if rooms, err := GetRoomSensorStatuses(); err == nil && len(rooms) > 0 {
+		mode, room := GetSensorAggregate()
+		if mode == AggregateActiveRoom {
+			mode += " (" + room + ")"
+		}
+		fmt.Printf("Room Sensors (%s):\n", mode)
+		for _, r := range rooms {
+			fmt.Println("  " + formatRoomSensorStatus(r))
+		}
+	}
+	if humidity := GetHumidityStatus(); humidity.Humidity > 0 {
+		fmt.Printf("Humidity: %.0f%% RH (dew point %.1f°C)\n", humidity.Humidity, humidity.DewPoint)
+		fmt.Printf("Humidifier: %v, Dehumidifier: %v\n", humidity.Humidifier, humidity.Dehumidifier)
+		if humidity.Overcool > 0 {
+			fmt.Printf("Dehumidifying: cooling %.1f°C below setpoint\n", humidity.Overcool)
+		}
+	}
 	fmt.Printf("System Running: %v\n", status.IsRunning)
+	if status.IsRunning && (status.Stage > 0 || status.AuxHeat) {
+		fmt.Printf("Equipment Stage: %s\n", stageLabel(ModeHeat, status.Stage, status.AuxHeat))
+	}
+	if status.SafetyOverride == SafetyOverrideCO {
+		alarm := GetCOAlarm()
+		fmt.Printf("SAFETY: CO alarm since %s (%s) - heating/cooling locked out, fan running\n",
+			alarm.TrippedAt.Format("15:04:05"), alarm.Threshold)
+	}
+	if status.SafetyOverride == SafetyOverrideSensor {
+		fmt.Println("SAFETY: temperature sensor degraded - heating and cooling held off")
+	}
+	if status.SafetyOverride == SafetyOverrideFreeze {
+		fmt.Printf("SAFETY: freeze protection forcing heat to %.1f°C\n", freezeTarget(LoadSafetyLimits()))
+	}
+	if status.ForecastOffset != 0 {
+		fmt.Println("Forecast: " + status.ForecastReason)
+	}
+	if status.EcoOffset != 0 {
+		fmt.Println("Eco Mode: " + status.EcoReason)
+	}
+	if status.Lockouts.Stale {
+		fmt.Println("Outdoor Lockouts: suspended, " + status.Lockouts.Reason)
+	} else if status.Lockouts.Reason != "" {
+		fmt.Println("Outdoor Lockouts: " + status.Lockouts.Reason)
+	}
+	if status.WaitReason != "" {
+		fmt.Printf("Equipment Protection: %s (until %s)\n", status.WaitReason, status.WaitUntil.Format("15:04:05"))
+	}
+	if v := NextVacation(time.Now()); v != nil {
+		fmt.Printf("Vacation: %s to %s, %s\n", v.StartAt.Local().Format("2006-01-02 15:04"), v.EndAt.Local().Format("2006-01-02 15:04"), formatVacationPlan(*v))
+	}
+	if occupancy := GetOccupancy(); occupancy.State != "" {
+		fmt.Printf("Occupancy: %s (%s, since %s)", occupancy.State, occupancy.Source, occupancy.Since.Format("15:04"))
+		if status.HoldTemp > 0 {
+			fmt.Printf(", heating held at %.1f°C", status.HoldTemp)
+		} else if status.Setback > 0 {
+			fmt.Printf(", setback %.1f°C", status.Setback)
+		}
+		fmt.Println()
+	}
+	strategy, output := GetControlStrategyInfo()
+	fmt.Printf("Control Strategy: %s (demand %.0f%%)\n", strategy, output*100)
 	fmt.Printf("Last Update: %s\n", status.LastUpdate.Format(time.RFC3339))
 }
 
@@ -258,11 +472,13 @@ func changeHVACMode(reader *bufio.Reader) {
 	fmt.Println("2. Heat")
 	fmt.Println("3. Cool")
 	fmt.Println("4. Fan")
+	fmt.Println("5. Auto (heat/cool)")
+	fmt.Println("6. Emergency Heat (heat pump aux only)")
 	fmt.Print("Choice: ")
 	input, _ := reader.ReadString('\n')
 	input = strings.TrimSpace(input)
 
-	modes := map[string]string{"1": "off", "2": "heat", "3": "cool", "4": "fan"}
+	modes := map[string]string{"1": "off", "2": "heat", "3": "cool", "4": "fan", "5": "auto", "6": "emergency"}
 	mode, ok := modes[input]
 	if !ok {
 		fmt.Println("Invalid mode")
@@ -274,63 +490,61 @@ func changeHVACMode(reader *bufio.Reader) {
 		return
 	}
 	fmt.Printf("HVAC mode set to %s\n", mode)
-}
-
-func viewSensorReadings() {
-	fmt.Println("\n=== SENSOR READINGS ===")
-	reading, err := ReadAllSensors()
-	if err != nil {
-		fmt.Printf("Error reading sensors: %v\n", err)
-		return
-	}
-	fmt.Printf("Temperature: %.1f°C\n", reading.Temperature)
-	fmt.Printf("Humidity: %.1f%%\n", reading.Humidity)
-	fmt.Printf("CO Level: %.2f ppm\n", reading.CO)
-	fmt.Printf("Timestamp: %s\n", reading.Timestamp.Format(time.RFC3339))
-}
 
-func viewWeather(reader *bufio.Reader) {
-	fmt.Print("Enter location: ")
-	location, _ := reader.ReadString('\n')
-	location = strings.TrimSpace(location)
-	weather, err := GetOutdoorWeather(location)
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+	// Only roles that may set the temperature get to change the auto band
+	if mode == "auto" && (currentUser.Role == "homeowner" || currentUser.Role == "technician") {
+		status := GetHVACStatus()
+		heat, cool, ok := readAutoSetpoints(reader, status.HeatSetpoint, status.CoolSetpoint)
+		if !ok {
+			return
+		}
+		if err := SetAutoSetpoints(heat, cool, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Auto setpoints: heat %.1f°C / cool %.1f°C\n", heat, cool)
 	}
-	fmt.Println("\n=== OUTDOOR WEATHER ===")
-	fmt.Println(DisplayWeather(weather))
 }
 
-func viewEnergyUsage(reader *bufio.Reader) {
-	fmt.Print("Enter number of days (default 7): ")
-	input, _ := reader.ReadString('\n')
-	input = strings.TrimSpace(input)
-	days := 7
-	if input != "" {
-		if d, err := strconv.Atoi(input); err == nil {
-			days = d
+// readAutoSetpoints prompts for heat and cool setpoints; blank keeps the default shown.
+func readAutoSetpoints(reader *bufio.Reader, heatDefault, coolDefault float64) (float64, float64, bool) {
+	fmt.Printf("Heat setpoint (default %.1f°C): ", heatDefault)
+	heatStr, _ := reader.ReadString('\n')
+	heatStr = strings.TrimSpace(heatStr)
+	heat := heatDefault
+	if heatStr != "" {
+		v, err := strconv.ParseFloat(heatStr, 64)
+		if err != nil {
+			fmt.Println("Invalid temperature")
+			return 0, 0, false
 		}
+		heat = v
 	}
-	stats, err := GetEnergyUsage(days)
-	if err != nil {
-		fmt.Printf("Error: %v\n", err)
-		return
+	fmt.Printf("Cool setpoint (default %.1f°C): ", coolDefault)
+	coolStr, _ := reader.ReadString('\n')
+	coolStr = strings.TrimSpace(coolStr)
+	cool := coolDefault
+	if coolStr != "" {
+		v, err := strconv.ParseFloat(coolStr, 64)
+		if err != nil {
+			fmt.Println("Invalid temperature")
+			return 0, 0, false
+		}
+		cool = v
 	}
-	fmt.Println("\n" + GenerateEnergyReport(stats))
+	return heat, cool, true
 }
 
-func manageProfiles(reader *bufio.Reader, currentUser *User) {
+func sensorMenu(reader *bufio.Reader) {
 	for {
-		fmt.Println("\n=== PROFILE MANAGEMENT ===")
-		fmt.Println("1. List Profiles")
-		fmt.Println("2. Apply Profile")
+		fmt.Println("\n=== SENSORS ===")
+		fmt.Println("1. Current Readings")
+		fmt.Println("2. Sensor History")
+		fmt.Println("3. Trend Charts")
 		if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
-			fmt.Println("3. Create Profile")
-			fmt.Println("4. Delete Profile")
-			fmt.Println("5. Add Schedule")
-			fmt.Println("6. View Schedules")
-
+			fmt.Println("4. Sensor Faults & Reference Readings")
+			fmt.Println("5. Room Sensors")
+			fmt.Println("6. Calibrate Sensor")
 		}
 		fmt.Println("0. Back to Main Menu")
 		fmt.Print("Enter choice: ")
@@ -340,33 +554,29 @@ func manageProfiles(reader *bufio.Reader, currentUser *User) {
 
 		switch choice {
 		case "1":
-			listProfiles(reader)
+			viewSensorReadings()
 		case "2":
-			applyProfile(reader)
+			viewSensorHistory(reader)
 		case "3":
-			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
-				fmt.Println("Invalid choice")
-				continue
-			}
-			createProfile(reader)
+			viewTrendCharts(reader)
 		case "4":
-			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+			if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+				sensorFaultsMenu(reader)
+			} else {
 				fmt.Println("Invalid choice")
-				continue
 			}
-			deleteProfile(reader)
 		case "5":
-			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+			if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+				roomSensorsMenu(reader)
+			} else {
 				fmt.Println("Invalid choice")
-				continue
 			}
-			addSchedule(reader)
 		case "6":
-			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+			if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+				calibrateSensor(reader)
+			} else {
 				fmt.Println("Invalid choice")
-				continue
 			}
-			viewSchedules(reader)
 		case "0":
 			return
 		default:
@@ -375,53 +585,1835 @@ func manageProfiles(reader *bufio.Reader, currentUser *User) {
 	}
 }
 
-func listProfiles(reader *bufio.Reader) {
-	profiles, err := ListProfiles(currentUser.Username, currentUser)
+func hvacSettingsMenu(reader *bufio.Reader) {
+	for {
+		fmt.Println("\n=== HVAC SETTINGS ===")
+		fmt.Println("1. View Control Strategy")
+		fmt.Println("2. Switch Control Strategy")
+		fmt.Println("3. Set PID Gains")
+		fmt.Println("4. Autotune PID from History")
+		fmt.Println("5. Auto Mode Deadband & Changeover")
+		fmt.Println("6. Equipment Protection Timers")
+		fmt.Println("7. Equipment Configuration")
+		fmt.Println("8. Humidity Control")
+		fmt.Println("9. Freeze & Overheat Limits")
+		fmt.Println("10. Weather Provider")
+		fmt.Println("11. Forecast Pre-conditioning")
+		fmt.Println("12. Outdoor Lockouts")
+		fmt.Println("13. Maintenance")
+		fmt.Println("0. Back to Main Menu")
+		fmt.Print("Enter choice: ")
+
+		choice, _ := reader.ReadString('\n')
+		choice = strings.TrimSpace(choice)
+
+		switch choice {
+		case "1":
+			viewControlStrategy()
+		case "2":
+			switchControlStrategy(reader)
+		case "3":
+			setPIDGains(reader)
+		case "4":
+			autotunePID()
+		case "5":
+			setAutoModeSettings(reader)
+		case "6":
+			setProtectionTimers(reader)
+		case "7":
+			configureEquipment(reader)
+		case "8":
+			setHumiditySettings(reader)
+		case "9":
+			setSafetyLimits(reader)
+		case "10":
+			configureWeather(reader)
+		case "11":
+			configureForecastControl(reader)
+		case "12":
+			configureLockouts(reader)
+		case "13":
+			maintenanceMenu(reader)
+		case "0":
+			return
+		default:
+			fmt.Println("Invalid choice")
+		}
+	}
+}
+
+func maintenanceMenu(reader *bufio.Reader) {
+	statuses, err := GetMaintenanceStatuses(time.Now())
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return
 	}
-	fmt.Println("Name    | Temp (°C) | Mode | Guest Accessible")
-	fmt.Println("-----------------------------------------------")
-	for _, p := range profiles {
-		guest := "No"
-		if p.GuestAccessible == 1 {
-			guest = "Yes"
+	fmt.Println("\n=== MAINTENANCE ===")
+	if len(statuses) == 0 {
+		fmt.Println("No maintenance items")
+	}
+	for i, s := range statuses {
+		fmt.Printf("  [%d] %s\n", i+1, formatMaintenanceStatus(s))
+	}
+	fmt.Println("1. Log Service Visit")
+	fmt.Println("2. Add or Change Item")
+	fmt.Println("3. Remove Item")
+	fmt.Println("4. Visit History")
+	fmt.Println("0. Back")
+	fmt.Print("Choice: ")
+	choice, _ := reader.ReadString('\n')
+	readLine := func(label string) string {
+		fmt.Print(label)
+		input, _ := reader.ReadString('\n')
+		return strings.TrimSpace(input)
+	}
+	switch strings.TrimSpace(choice) {
+	case "1":
+		v := ServiceVisit{}
+		for _, field := range strings.Split(readLine("Items serviced, by number, comma separated (blank for none): "), ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 1 || n > len(statuses) {
+				fmt.Println("Invalid item number")
+				return
+			}
+			v.Items = append(v.Items, statuses[n-1].Name)
+		}
+		v.Parts = readLine("Parts used: ")
+		v.Notes = readLine("Notes: ")
+		if _, err := LogServiceVisit(v, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Service visit logged")
+	case "2":
+		item := MaintenanceItem{Name: readLine("Name: ")}
+		item.Kind = strings.ToLower(readLine("Kind (" + strings.Join(maintenanceKinds, "/") + "): "))
+		hours, err := strconv.ParseFloat(readLine("Replace after blower hours (0 for none): "), 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return
+		}
+		days, err := strconv.Atoi(readLine("Replace after days (0 for none): "))
+		if err != nil {
+			fmt.Println("Invalid number")
+			return
+		}
+		item.RuntimeHours, item.IntervalDays = hours, days
+		if err := SetMaintenanceItem(item, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Maintenance item saved")
+	case "3":
+		n, err := strconv.Atoi(readLine("Item number: "))
+		if err != nil || n < 1 || n > len(statuses) {
+			fmt.Println("Invalid item number")
+			return
+		}
+		if err := DeleteMaintenanceItem(statuses[n-1].Name, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Maintenance item removed")
+	case "4":
+		visits, err := GetServiceVisits(20)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if len(visits) == 0 {
+			fmt.Println("No service visits logged")
+		}
+		for _, v := range visits {
+			fmt.Println(formatServiceVisit(v))
 		}
-		fmt.Printf("%-8s | %9.1f | %-4s | %-15s\n", p.Name, p.TargetTemp, p.HVACMode, guest)
 	}
 }
 
-func createProfile(reader *bufio.Reader) {
-	fmt.Print("Profile name: ")
-	name, _ := reader.ReadString('\n')
-	name = strings.TrimSpace(name)
-
-	fmt.Print("Target temperature (10-35°C): ")
-	tempStr, _ := reader.ReadString('\n')
-	temp, err := strconv.ParseFloat(strings.TrimSpace(tempStr), 64)
-	if err != nil {
-		fmt.Println("Invalid temperature")
+func configureForecastControl(reader *bufio.Reader) {
+	fs := LoadForecastSettings()
+	fmt.Printf("Enabled: %v, lookahead %gh, location: %s\n", fs.Enabled, fs.LookaheadHours, GetSetting("weather_location", "(not set)"))
+	fmt.Printf("Pre-cool %g°C when %g°C or more is forecast\n", fs.PrecoolOffset, fs.HeatSpike)
+	fmt.Printf("Pre-heat %g°C off-peak (%s-%s) when a drop of %g°C is forecast\n", fs.PreheatOffset, fs.OffPeakStart, fs.OffPeakEnd, fs.ColdDrop)
+	if t, ok := ActiveTariff(); ok && len(t.Periods) > 0 {
+		fmt.Println("Off-peak hours come from the " + t.Name + " tariff while it is active")
+	}
+	if status := GetHVACStatus(); status.ForecastReason != "" {
+		fmt.Println("Now: " + status.ForecastReason)
+	}
+	fmt.Print("Enable forecast pre-conditioning? (yes/no): ")
+	input, _ := reader.ReadString('\n')
+	input = strings.TrimSpace(strings.ToLower(input))
+	fs.Enabled = input == "yes" || input == "y"
+	if fs.Enabled && GetSetting("weather_location", "") == "" {
+		fmt.Println("Note: set a weather location under Humidity Control first")
+	}
+	readFloat := func(label string, fallback float64) (float64, bool) {
+		fmt.Printf("%s [%g]: ", label, fallback)
+		input, _ := reader.ReadString('\n')
+		if input = strings.TrimSpace(input); input == "" {
+			return fallback, true
+		}
+		v, err := strconv.ParseFloat(input, 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return 0, false
+		}
+		return v, true
+	}
+	var ok bool
+	if fs.LookaheadHours, ok = readFloat("Lookahead hours (1-24)", fs.LookaheadHours); !ok {
 		return
 	}
-
-	// FIX: Add this section to get HVAC mode!
-	fmt.Print("HVAC mode (off/heat/cool/fan): ")
-	mode, _ := reader.ReadString('\n')
-	mode = strings.TrimSpace(mode)
-
-	// New: prompt for guest accessibility
-	fmt.Print("Allow guests to view/apply this profile? (yes/no): ")
-	guestInput, _ := reader.ReadString('\n')
-	guestInput = strings.TrimSpace(strings.ToLower(guestInput))
-	guestAccessible := 0
-	if guestInput == "yes" || guestInput == "y" {
-		guestAccessible = 1
+	if fs.HeatSpike, ok = readFloat("Heat spike outdoor °C (20-50)", fs.HeatSpike); !ok {
+		return
 	}
-
-	// Call CreateProfile with the new parameter
-	if err := CreateProfile(name, temp, mode, currentUser.Username, currentUser, guestAccessible); err != nil {
-		fmt.Printf("Error: %v\n", err)
+	if fs.PrecoolOffset, ok = readFloat("Pre-cool offset °C (0-3)", fs.PrecoolOffset); !ok {
+		return
+	}
+	if fs.ColdDrop, ok = readFloat("Cold front drop °C (2-30)", fs.ColdDrop); !ok {
+		return
+	}
+	if fs.PreheatOffset, ok = readFloat("Pre-heat offset °C (0-3)", fs.PreheatOffset); !ok {
+		return
+	}
+	fmt.Printf("Off-peak start HH:MM [%s]: ", fs.OffPeakStart)
+	if input, _ = reader.ReadString('\n'); strings.TrimSpace(input) != "" {
+		fs.OffPeakStart = strings.TrimSpace(input)
+	}
+	fmt.Printf("Off-peak end HH:MM [%s]: ", fs.OffPeakEnd)
+	if input, _ = reader.ReadString('\n'); strings.TrimSpace(input) != "" {
+		fs.OffPeakEnd = strings.TrimSpace(input)
+	}
+	if err := SetForecastSettings(fs, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Forecast pre-conditioning updated")
+}
+
+func configureLockouts(reader *bufio.Reader) {
+	ls := LoadLockoutSettings()
+	fmt.Printf("Enabled: %v, location: %s\n", ls.Enabled, GetSetting("weather_location", "(not set)"))
+	fmt.Printf("Heat pump balance point %g°C, aux heat locked out above %g°C, cooling locked out below %g°C\n",
+		ls.BalancePoint, ls.AuxLockout, ls.CoolLockout)
+	if l := GetHVACStatus().Lockouts; l.Reason != "" {
+		fmt.Println("Now: " + l.Reason)
+	}
+	fmt.Print("Enable outdoor lockouts? (yes/no): ")
+	input, _ := reader.ReadString('\n')
+	input = strings.TrimSpace(strings.ToLower(input))
+	ls.Enabled = input == "yes" || input == "y"
+	if ls.Enabled && GetSetting("weather_location", "") == "" {
+		fmt.Println("Note: lockouts stay off until a weather location is set under Humidity Control")
+	}
+	readFloat := func(label string, fallback float64) (float64, bool) {
+		fmt.Printf("%s [%g]: ", label, fallback)
+		input, _ := reader.ReadString('\n')
+		if input = strings.TrimSpace(input); input == "" {
+			return fallback, true
+		}
+		v, err := strconv.ParseFloat(input, 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return 0, false
+		}
+		return v, true
+	}
+	var ok bool
+	if ls.BalancePoint, ok = readFloat("Balance point °C (-30 to 15)", ls.BalancePoint); !ok {
+		return
+	}
+	if ls.AuxLockout, ok = readFloat("Aux heat lockout above °C (-20 to 25)", ls.AuxLockout); !ok {
+		return
+	}
+	if ls.CoolLockout, ok = readFloat("Cooling lockout below °C (-10 to 25)", ls.CoolLockout); !ok {
+		return
+	}
+	if err := SetLockoutSettings(ls, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	go RefreshLockoutWeather()
+	fmt.Println("Outdoor lockouts updated")
+}
+
+func configureWeather(reader *bufio.Reader) {
+	cfg := LoadWeatherConfig()
+	fmt.Printf("Provider: %s, base URL: %s, timeout %gs, %d retries\n", cfg.Provider, cfg.BaseURL, cfg.TimeoutSeconds, cfg.Retries)
+	if os.Getenv(weatherAPIKeyEnv) != "" {
+		fmt.Printf("API key: from %s\n", weatherAPIKeyEnv)
+	} else if weatherAPIKey() != "" {
+		fmt.Println("API key: stored")
+	}
+	readString := func(label, fallback string) string {
+		fmt.Printf("%s [%s]: ", label, fallback)
+		input, _ := reader.ReadString('\n')
+		if input = strings.TrimSpace(input); input != "" {
+			return input
+		}
+		return fallback
+	}
+	cfg.Provider = strings.ToLower(readString("Provider (simulated/openweathermap)", cfg.Provider))
+	cfg.BaseURL = readString("Base URL", cfg.BaseURL)
+	timeout, err := strconv.ParseFloat(readString("Timeout in seconds", fmt.Sprintf("%g", cfg.TimeoutSeconds)), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	cfg.TimeoutSeconds = timeout
+	retries, err := strconv.Atoi(readString("Retries", strconv.Itoa(cfg.Retries)))
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	cfg.Retries = retries
+	apiKey := ""
+	if cfg.Provider == WeatherProviderOpenWeatherMap {
+		fmt.Print("API key (blank to keep the current one): ")
+		apiKey, _ = reader.ReadString('\n')
+		apiKey = strings.TrimSpace(apiKey)
+	}
+	if err := SetWeatherConfig(cfg, apiKey, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Weather provider updated")
+}
+
+func viewControlStrategy() {
+	strategy, output := GetControlStrategyInfo()
+	gains := LoadPIDGains()
+	fmt.Printf("Active strategy: %s (demand %.0f%%)\n", strategy, output*100)
+	fmt.Println("Hysteresis bands: start 1.0°C past target, stop 0.5°C past target")
+	fmt.Printf("PID gains: Kp=%.3f Ki=%.4f Kd=%.3f, cycle %.0f minutes\n", gains.Kp, gains.Ki, gains.Kd, gains.CycleMinutes)
+}
+
+func switchControlStrategy(reader *bufio.Reader) {
+	fmt.Print("Strategy (hysteresis/pid): ")
+	name, _ := reader.ReadString('\n')
+	name = strings.TrimSpace(strings.ToLower(name))
+	if err := SetControlStrategy(name, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Control strategy set to %s\n", name)
+}
+
+func setPIDGains(reader *bufio.Reader) {
+	current := LoadPIDGains()
+	readGain := func(label string, fallback float64) (float64, bool) {
+		fmt.Printf("%s (current %g): ", label, fallback)
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+		if input == "" {
+			return fallback, true
+		}
+		v, err := strconv.ParseFloat(input, 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return 0, false
+		}
+		return v, true
+	}
+	gains := PIDGains{}
+	var ok bool
+	if gains.Kp, ok = readGain("Kp", current.Kp); !ok {
+		return
+	}
+	if gains.Ki, ok = readGain("Ki", current.Ki); !ok {
+		return
+	}
+	if gains.Kd, ok = readGain("Kd", current.Kd); !ok {
+		return
+	}
+	if gains.CycleMinutes, ok = readGain("Cycle length in minutes", current.CycleMinutes); !ok {
+		return
+	}
+	if err := SetPIDGains(gains, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("PID gains updated")
+}
+
+func autotunePID() {
+	fmt.Println("Analysing the last 7 days of heating/cooling history...")
+	result, err := AutotunePID(currentUser)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Runs analysed: %d (idle periods: %d)\n", result.RunsAnalysed, result.IdlesAnalysed)
+	fmt.Printf("Response while running: %.3f°C/min, while idle: %.3f°C/min\n", result.RunSlope, result.IdleSlope)
+	fmt.Printf("Dead time: %.1f minutes\n", result.DeadTime)
+	fmt.Printf("New gains: Kp=%.3f Ki=%.4f Kd=%.3f\n", result.Gains.Kp, result.Gains.Ki, result.Gains.Kd)
+}
+
+func setAutoModeSettings(reader *bufio.Reader) {
+	fmt.Printf("Minimum deadband in °C (current %.1f): ", autoDeadband())
+	input, _ := reader.ReadString('\n')
+	deadband, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	fmt.Printf("Changeover delay in minutes (current %.0f): ", autoChangeoverDelay().Minutes())
+	input, _ = reader.ReadString('\n')
+	delay, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	if err := SetAutoModeSettings(deadband, delay, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Auto mode settings updated")
+}
+
+func setProtectionTimers(reader *bufio.Reader) {
+	for _, p := range GetProtectionStatus() {
+		fmt.Printf("%s: min on %.0f min, min off %.0f min, max %d cycles/hour (%d in last hour)\n",
+			p.Stage, p.Timers.MinOnMinutes, p.Timers.MinOffMinutes, p.Timers.MaxCyclesPerHour, p.CyclesLastHour)
+	}
+	fmt.Print("Stage to change (heat/cool, blank to cancel): ")
+	stage, _ := reader.ReadString('\n')
+	stage = strings.TrimSpace(strings.ToLower(stage))
+	if stage == "" {
+		return
+	}
+	fmt.Print("Minimum on-time (minutes): ")
+	input, _ := reader.ReadString('\n')
+	minOn, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	fmt.Print("Minimum off-time (minutes): ")
+	input, _ = reader.ReadString('\n')
+	minOff, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	fmt.Print("Maximum cycles per hour: ")
+	input, _ = reader.ReadString('\n')
+	maxCycles, err := strconv.Atoi(strings.TrimSpace(input))
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	timers := ProtectionTimers{MinOnMinutes: minOn, MinOffMinutes: minOff, MaxCyclesPerHour: maxCycles}
+	if err := SetProtectionTimers(HVACMode(stage), timers, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Protection timers updated")
+}
+
+func configureEquipment(reader *bufio.Reader) {
+	cfg := GetEquipmentConfig()
+	fmt.Println("\n=== EQUIPMENT CONFIGURATION ===")
+	fmt.Printf("Heat type: %s, %d heat stage(s), %d cool stage(s), aux heat: %v\n",
+		cfg.HeatType, cfg.HeatStages, cfg.CoolStages, cfg.HasAuxHeat)
+	fmt.Printf("Heat: stage 1 %.1f kW, stage 2 %.1f kW, aux %.1f kW\n", cfg.HeatStage1KW, cfg.HeatStage2KW, cfg.AuxHeatKW)
+	fmt.Printf("Cool: stage 1 %.1f kW, stage 2 %.1f kW, SEER %g; blower %.1f kW\n", cfg.CoolStage1KW, cfg.CoolStage2KW, cfg.CoolSEER, cfg.FanKW)
+	switch cfg.HeatType {
+	case HeatTypeFurnace:
+		fmt.Printf("Gas: stage 1 %.0f BTU/h, stage 2 %.0f BTU/h, AFUE %g%%\n", cfg.GasStage1BTUH, cfg.GasStage2BTUH, cfg.HeatEfficiency)
+	case HeatTypeHeatPump:
+		fmt.Printf("Heat pump COP %g\n", cfg.HeatEfficiency)
+	}
+	fmt.Printf("Stage up at %.1f°C or after %.0f min, down below %.1f°C; aux at %.1f°C or after %.0f min\n",
+		cfg.StageUpGap, cfg.StageUpMinutes, cfg.StageDownGap, cfg.AuxGap, cfg.AuxMinutes)
+
+	fmt.Print("Edit configuration? (y/n): ")
+	input, _ := reader.ReadString('\n')
+	if strings.TrimSpace(strings.ToLower(input)) != "y" {
+		return
+	}
+
+	// Blank input keeps the current value
+	readString := func(prompt, current string) string {
+		fmt.Printf("%s [%s]: ", prompt, current)
+		in, _ := reader.ReadString('\n')
+		if in = strings.TrimSpace(in); in != "" {
+			return in
+		}
+		return current
+	}
+	readFloat := func(prompt string, current float64) (float64, bool) {
+		in := readString(prompt, strconv.FormatFloat(current, 'f', -1, 64))
+		v, err := strconv.ParseFloat(in, 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return 0, false
+		}
+		return v, true
+	}
+
+	cfg.HeatType = readString("Heat type (furnace/heat_pump/electric)", cfg.HeatType)
+	heatStages, ok := readFloat("Heat stages (1-2)", float64(cfg.HeatStages))
+	if !ok {
+		return
+	}
+	coolStages, ok := readFloat("Cool stages (0-2)", float64(cfg.CoolStages))
+	if !ok {
+		return
+	}
+	cfg.HeatStages, cfg.CoolStages = int(heatStages), int(coolStages)
+	if cfg.HeatType == HeatTypeHeatPump {
+		current := "n"
+		if cfg.HasAuxHeat {
+			current = "y"
+		}
+		cfg.HasAuxHeat = strings.ToLower(readString("Auxiliary heat installed (y/n)", current)) == "y"
+	} else {
+		cfg.HasAuxHeat = false
+	}
+	// Gas input may be given in therms/h with a "th" suffix.
+	readGas := func(prompt string, current float64) (float64, bool) {
+		in := strings.ToLower(readString(prompt+" (BTU/h, or therms/h with th)", strconv.FormatFloat(current, 'f', -1, 64)))
+		scale := 1.0
+		if strings.HasSuffix(in, "th") {
+			in, scale = strings.TrimSpace(strings.TrimSuffix(in, "th")), btuPerTherm
+		}
+		v, err := strconv.ParseFloat(in, 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return 0, false
+		}
+		return v * scale, true
+	}
+	switch cfg.HeatType {
+	case HeatTypeFurnace:
+		if cfg.GasStage1BTUH, ok = readGas("Gas input stage 1", cfg.GasStage1BTUH); !ok {
+			return
+		}
+		if cfg.GasStage2BTUH, ok = readGas("Gas input stage 2 (total)", cfg.GasStage2BTUH); !ok {
+			return
+		}
+		if cfg.HeatEfficiency, ok = readFloat("Furnace AFUE %", cfg.HeatEfficiency); !ok {
+			return
+		}
+	case HeatTypeHeatPump:
+		if cfg.HeatEfficiency, ok = readFloat("Heat pump COP", cfg.HeatEfficiency); !ok {
+			return
+		}
+	}
+	fields := []struct {
+		prompt string
+		value  *float64
+	}{
+		{"Heat stage 1 kW (excluding blower)", &cfg.HeatStage1KW},
+		{"Heat stage 2 kW (total)", &cfg.HeatStage2KW},
+		{"Aux heat kW", &cfg.AuxHeatKW},
+		{"Cool stage 1 kW (excluding blower)", &cfg.CoolStage1KW},
+		{"Cool stage 2 kW (total)", &cfg.CoolStage2KW},
+		{"Cooling SEER", &cfg.CoolSEER},
+		{"Blower kW", &cfg.FanKW},
+		{"Stage-up gap (°C)", &cfg.StageUpGap},
+		{"Stage-up delay (minutes)", &cfg.StageUpMinutes},
+		{"Stage-down gap (°C)", &cfg.StageDownGap},
+		{"Aux heat gap (°C)", &cfg.AuxGap},
+		{"Aux heat delay (minutes)", &cfg.AuxMinutes},
+	}
+	for _, f := range fields {
+		v, ok := readFloat(f.prompt, *f.value)
+		if !ok {
+			return
+		}
+		*f.value = v
+	}
+
+	if err := SaveEquipmentConfig(cfg, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Equipment configuration saved")
+}
+
+func setHumiditySettings(reader *bufio.Reader) {
+	s := LoadHumiditySettings()
+	status := GetHumidityStatus()
+	fmt.Printf("Humidify below %.0f%%, dehumidify above %.0f%%, max overcool %.1f°C\n",
+		s.HumidifySetpoint, s.DehumidifySetpoint, s.MaxOvercool)
+	fmt.Printf("Frost protection: %v (location %q)\n", s.FrostProtection, s.Location)
+	if status.FrostLimit > 0 {
+		fmt.Printf("Humidifier currently capped at %.0f%% by outdoor temperature\n", status.FrostLimit)
+	}
+
+	fmt.Print("Humidify setpoint % (blank to cancel): ")
+	input, _ := reader.ReadString('\n')
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return
+	}
+	humidify, err := strconv.ParseFloat(input, 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	fmt.Print("Dehumidify setpoint %: ")
+	input, _ = reader.ReadString('\n')
+	dehumidify, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	fmt.Print("Max overcool for dehumidification (°C): ")
+	input, _ = reader.ReadString('\n')
+	overcool, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	fmt.Print("Frost protection location (blank to disable): ")
+	location, _ := reader.ReadString('\n')
+	location = strings.TrimSpace(location)
+
+	s = HumiditySettings{
+		HumidifySetpoint:   humidify,
+		DehumidifySetpoint: dehumidify,
+		MaxOvercool:        overcool,
+		FrostProtection:    location != "",
+		Location:           location,
+	}
+	if err := SetHumiditySettings(s, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Humidity settings updated")
+}
+
+func setSafetyLimits(reader *bufio.Reader) {
+	limits := LoadSafetyLimits()
+	fmt.Printf("Freeze limit: %.1f°C (heat forced on below this in any mode)\n", limits.FreezeLimit)
+	fmt.Printf("Overheat limit: %.1f°C (homeowners alerted above this)\n", limits.OverheatLimit)
+	fmt.Print("New freeze limit (4-12°C, blank to cancel): ")
+	input, _ := reader.ReadString('\n')
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return
+	}
+	freeze, err := strconv.ParseFloat(input, 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	fmt.Print("New overheat limit (28-40°C): ")
+	input, _ = reader.ReadString('\n')
+	overheat, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	if err := SetSafetyLimits(SafetyLimits{FreezeLimit: freeze, OverheatLimit: overheat}, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Safety limits updated")
+}
+
+func acknowledgeCOAlarm() {
+	if err := AcknowledgeCOAlarm(currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("CO alarm acknowledged. Normal HVAC control resumed.")
+}
+
+func formatVacationPlan(v Vacation) string {
+	hold := "vacation setback"
+	if v.HoldTemp > 0 {
+		hold = fmt.Sprintf("hold %.1f°C", v.HoldTemp)
+	}
+	if v.PreconditionAt.IsZero() {
+		return hold
+	}
+	return fmt.Sprintf("%s, preconditioning from %s (%.1f°C/h)", hold, v.PreconditionAt.Local().Format("2006-01-02 15:04"), v.HeatingRate)
+}
+
+func occupancyMenu(reader *bufio.Reader) {
+	for {
+		occupancy := GetOccupancy()
+		fmt.Println("\n=== OCCUPANCY ===")
+		fmt.Printf("State: %s (%s, since %s)\n", occupancy.State, occupancy.Source, occupancy.Since.Format("2006-01-02 15:04"))
+		if manual := GetSetting("occupancy_manual", ""); manual != "" {
+			fmt.Printf("Manual hold: %s\n", manual)
+		}
+		if signals := OccupancySignalNames(); len(signals) > 0 {
+			fmt.Printf("Signals: %s\n", strings.Join(signals, ", "))
+		}
+		fmt.Println("1. Set Home")
+		fmt.Println("2. Set Away")
+		fmt.Println("3. Set Sleep")
+		fmt.Println("4. Resume Automatic")
+		if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+			fmt.Println("5. Configure States")
+			fmt.Println("6. Sleep Hours")
+		}
+		if currentUser.Role == "homeowner" {
+			fmt.Println("7. Occupancy Signals")
+			fmt.Println("8. Vacations")
+		}
+		fmt.Println("0. Back")
+		fmt.Print("Choice: ")
+		choice, _ := reader.ReadString('\n')
+		choice = strings.TrimSpace(choice)
+
+		states := map[string]string{"1": OccupancyHome, "2": OccupancyAway, "3": OccupancySleep, "4": "auto"}
+		if state, ok := states[choice]; ok {
+			if err := SetOccupancyState(state, currentUser); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			} else {
+				fmt.Printf("Occupancy is now %s\n", GetOccupancy().State)
+			}
+			continue
+		}
+		switch choice {
+		case "5":
+			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			configureOccupancyStates(reader)
+		case "6":
+			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			configureSleepHours(reader)
+		case "7":
+			if currentUser.Role != "homeowner" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			configureOccupancySignals(reader)
+		case "8":
+			if currentUser.Role != "homeowner" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			manageVacations(reader)
+		case "0":
+			return
+		default:
+			fmt.Println("Invalid choice")
+		}
+	}
+}
+
+func configureOccupancyStates(reader *bufio.Reader) {
+	fmt.Println("\nState      Setback  Profile")
+	for _, state := range occupancyStates {
+		cfg := LoadOccupancyConfig(state)
+		profile := cfg.Profile
+		if profile == "" {
+			profile = "-"
+		}
+		fmt.Printf("%-10s %5.1f°C  %s\n", state, cfg.Setback, profile)
+	}
+	fmt.Print("State to change (blank to cancel): ")
+	state, _ := reader.ReadString('\n')
+	state = strings.TrimSpace(strings.ToLower(state))
+	if state == "" {
+		return
+	}
+	cfg := LoadOccupancyConfig(state)
+	fmt.Printf("Setback in °C (0-%.0f) [%.1f]: ", occupancyMaxSetback, cfg.Setback)
+	input, _ := reader.ReadString('\n')
+	if input = strings.TrimSpace(input); input != "" {
+		v, err := strconv.ParseFloat(input, 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return
+		}
+		cfg.Setback = v
+	}
+	fmt.Printf("Profile to apply on entering %s (blank for none, '-' to keep '%s'): ", state, cfg.Profile)
+	input, _ = reader.ReadString('\n')
+	if input = strings.TrimSpace(input); input != "-" {
+		cfg.Profile = input
+	}
+	if err := SetOccupancyConfig(cfg, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Occupancy state updated")
+}
+
+func configureSleepHours(reader *bufio.Reader) {
+	start, end := GetSleepHours()
+	if start != "" {
+		fmt.Printf("Current sleep hours: %s - %s\n", start, end)
+	} else {
+		fmt.Println("No sleep hours set")
+	}
+	fmt.Print("Sleep start (HH:MM, blank to disable): ")
+	start, _ = reader.ReadString('\n')
+	start = strings.TrimSpace(start)
+	end = ""
+	if start != "" {
+		fmt.Print("Sleep end (HH:MM): ")
+		end, _ = reader.ReadString('\n')
+		end = strings.TrimSpace(end)
+	}
+	if err := SetSleepHours(start, end, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Sleep hours updated")
+}
+
+func configureOccupancySignals(reader *bufio.Reader) {
+	s := LoadOccupancySignalSettings()
+	fmt.Printf("Motion sensor file ('-' to disable) [%s]: ", s.MotionFile)
+	input, _ := reader.ReadString('\n')
+	if input = strings.TrimSpace(input); input == "-" {
+		s.MotionFile = ""
+	} else if input != "" {
+		s.MotionFile = input
+	}
+	if s.MotionFile != "" {
+		fmt.Printf("Minutes without motion before away [%.0f]: ", s.MotionTimeout)
+		input, _ = reader.ReadString('\n')
+		if input = strings.TrimSpace(input); input != "" {
+			v, err := strconv.ParseFloat(input, 64)
+			if err != nil {
+				fmt.Println("Invalid number")
+				return
+			}
+			s.MotionTimeout = v
+		}
+	}
+	fmt.Printf("Presence webhook listen address, e.g. 127.0.0.1:8089 ('-' to disable) [%s]: ", s.WebhookAddr)
+	input, _ = reader.ReadString('\n')
+	if input = strings.TrimSpace(input); input == "-" {
+		s.WebhookAddr = ""
+	} else if input != "" {
+		s.WebhookAddr = input
+	}
+	token := ""
+	if s.WebhookAddr != "" {
+		fmt.Print("Generate a new webhook token? (yes/no): ")
+		input, _ = reader.ReadString('\n')
+		if input = strings.TrimSpace(strings.ToLower(input)); input == "yes" || input == "y" {
+			token = GenerateSessionToken()
+		}
+	}
+	if err := SetOccupancySignalSettings(s, token, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Occupancy signals updated")
+	if token != "" {
+		fmt.Printf("Webhook token (shown once, send as X-Presence-Token): %s\n", token)
+		fmt.Printf("POST {\"present\": true|false} to http://%s%s\n", s.WebhookAddr, presenceWebhookPath)
+	}
+}
+
+func manageVacations(reader *bufio.Reader) {
+	vacations, err := ListVacations()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("\n=== VACATIONS ===")
+	if len(vacations) == 0 {
+		fmt.Println("No upcoming vacations")
+	}
+	for _, v := range vacations {
+		status := ""
+		if v.Cancelled {
+			status = " (cancelled)"
+		}
+		fmt.Printf("#%d: %s to %s by %s%s\n", v.ID, v.StartAt.Local().Format("2006-01-02 15:04"), v.EndAt.Local().Format("2006-01-02 15:04"), v.CreatedBy, status)
+		if !v.Cancelled {
+			fmt.Println("    " + formatVacationPlan(v))
+		}
+	}
+	fmt.Println("1. Add Vacation")
+	fmt.Println("2. Cancel Vacation")
+	fmt.Println("0. Back")
+	fmt.Print("Choice: ")
+	choice, _ := reader.ReadString('\n')
+	switch strings.TrimSpace(choice) {
+	case "1":
+		fmt.Print("Leaving (YYYY-MM-DD HH:MM): ")
+		input, _ := reader.ReadString('\n')
+		start, err := time.ParseInLocation("2006-01-02 15:04", strings.TrimSpace(input), time.Local)
+		if err != nil {
+			fmt.Println("Invalid date")
+			return
+		}
+		fmt.Print("Returning (YYYY-MM-DD HH:MM): ")
+		input, _ = reader.ReadString('\n')
+		end, err := time.ParseInLocation("2006-01-02 15:04", strings.TrimSpace(input), time.Local)
+		if err != nil {
+			fmt.Println("Invalid date")
+			return
+		}
+		fmt.Print("Hold temperature while away (10-35°C, blank for the vacation setback): ")
+		input, _ = reader.ReadString('\n')
+		hold := 0.0
+		if input = strings.TrimSpace(input); input != "" {
+			if hold, err = strconv.ParseFloat(input, 64); err != nil {
+				fmt.Println("Invalid temperature")
+				return
+			}
+		}
+		if err := AddVacation(start, end, hold, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Vacation scheduled")
+	case "2":
+		fmt.Print("Vacation #: ")
+		input, _ := reader.ReadString('\n')
+		id, err := strconv.Atoi(strings.TrimSpace(input))
+		if err != nil {
+			fmt.Println("Invalid number")
+			return
+		}
+		if err := CancelVacation(id, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Vacation cancelled")
+	}
+}
+
+func viewSensorReadings() {
+	fmt.Println("\n=== SENSOR READINGS ===")
+	reading, err := ReadAllSensors()
+	if err != nil {
+		fmt.Printf("Error reading sensors: %v\n", err)
+		return
+	}
+	fmt.Printf("Temperature: %.1f°C\n", reading.Temperature)
+	fmt.Printf("Humidity: %.1f%%\n", reading.Humidity)
+	fmt.Printf("CO Level: %.2f ppm\n", reading.CO)
+	fmt.Printf("Timestamp: %s\n", reading.Timestamp.Format(time.RFC3339))
+	if status := GetSensorStatus(); status.Degraded {
+		fmt.Println("WARNING: sensor degraded, readings may be unreliable")
+	}
+}
+
+func roomSensorsMenu(reader *bufio.Reader) {
+	for {
+		rooms, err := GetRoomSensorStatuses()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		mode, room := GetSensorAggregate()
+		fmt.Println("\n=== ROOM SENSORS ===")
+		if len(rooms) == 0 {
+			fmt.Println("No room sensors registered; the thermostat's own sensor is used")
+		}
+		for _, r := range rooms {
+			fmt.Println("  " + formatRoomSensorStatus(r))
+		}
+		fmt.Printf("Aggregate: %s", mode)
+		if mode == AggregateActiveRoom {
+			fmt.Printf(" (active room: %s)", room)
+		}
+		fmt.Println()
+		fmt.Println("1. Register Sensor")
+		fmt.Println("2. Update Sensor")
+		fmt.Println("3. Remove Sensor")
+		fmt.Println("4. Set Aggregate")
+		fmt.Println("5. Set Active Room")
+		fmt.Println("0. Back")
+		fmt.Print("Enter choice: ")
+		choice, _ := reader.ReadString('\n')
+
+		switch strings.TrimSpace(choice) {
+		case "1":
+			fmt.Print("Name: ")
+			name, _ := reader.ReadString('\n')
+			fmt.Print("Location: ")
+			location, _ := reader.ReadString('\n')
+			offset, weight, ok := readOffsetAndWeight(reader)
+			if !ok {
+				continue
+			}
+			err = RegisterRoomSensor(strings.TrimSpace(name), strings.TrimSpace(location), offset, weight, currentUser)
+		case "2":
+			fmt.Print("Name: ")
+			name, _ := reader.ReadString('\n')
+			offset, weight, ok := readOffsetAndWeight(reader)
+			if !ok {
+				continue
+			}
+			fmt.Print("Active? (y/n): ")
+			active, _ := reader.ReadString('\n')
+			err = UpdateRoomSensor(strings.TrimSpace(name), offset, weight, strings.TrimSpace(strings.ToLower(active)) == "y", currentUser)
+		case "3":
+			fmt.Print("Name: ")
+			name, _ := reader.ReadString('\n')
+			err = RemoveRoomSensor(strings.TrimSpace(name), currentUser)
+		case "4":
+			fmt.Print("Aggregate (weighted_average/min/max/active_room): ")
+			mode, _ := reader.ReadString('\n')
+			err = SetSensorAggregate(strings.TrimSpace(mode), currentUser)
+		case "5":
+			fmt.Print("Active room sensor name: ")
+			name, _ := reader.ReadString('\n')
+			err = SetActiveRoom(strings.TrimSpace(name), currentUser.Username)
+		case "0":
+			return
+		default:
+			fmt.Println("Invalid choice")
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+		} else {
+			fmt.Println("Done")
+		}
+	}
+}
+
+// calibrateSensor walks through a one-point calibration against a reference meter.
+func calibrateSensor(reader *bufio.Reader) {
+	fmt.Println("\n=== SENSOR CALIBRATION ===")
+	for _, channel := range []string{ChannelTemperature, ChannelHumidity, ChannelCO} {
+		c := GetCalibration(channel)
+		fmt.Printf("%s: offset %+.2f, scale %.3f\n", channel, c.Offset, c.Scale)
+	}
+	if rooms, err := ListRoomSensors(); err == nil {
+		for _, r := range rooms {
+			fmt.Printf("room:%s: offset %+.2f\n", r.Name, r.Offset)
+		}
+	}
+
+	fmt.Print("Channel to calibrate (temperature/humidity/co/room:<name>, blank to cancel): ")
+	channel, _ := reader.ReadString('\n')
+	channel = strings.TrimSpace(channel)
+	if channel == "" {
+		return
+	}
+
+	fmt.Println("Place the reference meter next to the sensor and let both settle.")
+	fmt.Print("Press Enter to sample the sensor...")
+	reader.ReadString('\n')
+	raw, err := SampleRawChannel(channel)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Sensor raw reading (average of %d samples): %.2f\n", calibrationSamples, raw)
+
+	fmt.Print("Reference meter reading: ")
+	input, _ := reader.ReadString('\n')
+	reference, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	scale := 0.0
+	if !strings.HasPrefix(channel, roomChannelPrefix) {
+		fmt.Print("Scale (blank to keep current): ")
+		input, _ = reader.ReadString('\n')
+		if input = strings.TrimSpace(input); input != "" {
+			if scale, err = strconv.ParseFloat(input, 64); err != nil {
+				fmt.Println("Invalid number")
+				return
+			}
+		}
+	}
+
+	record, err := CalibrateChannel(channel, reference, raw, scale, currentUser)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Calibrated %s: offset %+.2f -> %+.2f, scale %.3f -> %.3f\n",
+		record.Channel, record.OldOffset, record.NewOffset, record.OldScale, record.NewScale)
+}
+
+func readOffsetAndWeight(reader *bufio.Reader) (float64, float64, bool) {
+	fmt.Print("Calibration offset (°C, e.g. -0.5): ")
+	input, _ := reader.ReadString('\n')
+	offset, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return 0, 0, false
+	}
+	fmt.Print("Weight (0-10): ")
+	input, _ = reader.ReadString('\n')
+	weight, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return 0, 0, false
+	}
+	return offset, weight, true
+}
+
+func sensorFaultsMenu(reader *bufio.Reader) {
+	faults, err := DetectSensorFaults()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(faults) == 0 {
+		fmt.Println("No sensor faults detected")
+	}
+	for _, f := range faults {
+		fmt.Printf("%s %s since %s: %s\n", f.Metric, f.Kind, f.Since.Format("15:04:05"), f.Detail)
+	}
+	for _, metric := range []string{"temperature", "humidity", "co"} {
+		if value, at, ok := GetSensorReference(metric); ok {
+			fmt.Printf("Reference %s: %.1f at %s\n", metric, value, at.Local().Format("2006-01-02 15:04"))
+		}
+	}
+
+	fmt.Print("Record a reference reading for (temperature/humidity/co, blank to skip): ")
+	metric, _ := reader.ReadString('\n')
+	metric = strings.TrimSpace(strings.ToLower(metric))
+	if metric == "" {
+		return
+	}
+	fmt.Print("Reference value from trusted instrument: ")
+	input, _ := reader.ReadString('\n')
+	value, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+	if err != nil {
+		fmt.Println("Invalid number")
+		return
+	}
+	if err := SetSensorReference(metric, value, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Reference recorded; drift will be checked for the next hour")
+}
+
+func viewSensorHistory(reader *bufio.Reader) {
+	fmt.Print("Metric (temperature/humidity/co): ")
+	metric, _ := reader.ReadString('\n')
+	metric = strings.TrimSpace(strings.ToLower(metric))
+
+	fmt.Print("Window in hours (default 24): ")
+	input, _ := reader.ReadString('\n')
+	input = strings.TrimSpace(input)
+	hours := 24
+	if input != "" {
+		if h, err := strconv.Atoi(input); err == nil && h > 0 {
+			hours = h
+		}
+	}
+
+	fmt.Print("Resolution (auto/raw/1m/1h/1d, default auto): ")
+	resolution, _ := reader.ReadString('\n')
+	resolution = strings.TrimSpace(strings.ToLower(resolution))
+
+	to := time.Now()
+	from := to.Add(-time.Duration(hours) * time.Hour)
+	points, err := GetSensorHistory(metric, from, to, resolution)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(points) == 0 {
+		fmt.Println("No history recorded for this window.")
+		return
+	}
+	fmt.Printf("\n=== %s HISTORY (last %d hours) ===\n", strings.ToUpper(metric), hours)
+	fmt.Println("Time             |     Min |     Avg |     Max | Samples")
+	fmt.Println("---------------------------------------------------------")
+	for _, p := range points {
+		fmt.Printf("%-16s | %7.2f | %7.2f | %7.2f | %7d\n",
+			p.Timestamp.Local().Format("2006-01-02 15:04"), p.Min, p.Avg, p.Max, p.Count)
+	}
+}
+
+func viewTrendCharts(reader *bufio.Reader) {
+	fmt.Print("Window in hours (default 24): ")
+	input, _ := reader.ReadString('\n')
+	input = strings.TrimSpace(input)
+	hours := 24
+	if input != "" {
+		if h, err := strconv.Atoi(input); err == nil && h > 0 {
+			hours = h
+		}
+	}
+	to := time.Now()
+	from := to.Add(-time.Duration(hours) * time.Hour)
+	chart, err := BuildTrendCharts(from, to, DefaultChartWidth)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println()
+	fmt.Print(chart)
+}
+
+func viewWeather(reader *bufio.Reader) {
+	fmt.Print("Enter location: ")
+	location, _ := reader.ReadString('\n')
+	location = strings.TrimSpace(location)
+	weather, err := GetOutdoorWeather(location)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("\n=== OUTDOOR WEATHER ===")
+	fmt.Println(DisplayWeather(weather))
+	if err := RefreshForecast(location, false); err != nil {
+		fmt.Printf("Forecast unavailable: %v\n", err)
+		return
+	}
+	forecast, err := GetForecast(location, time.Now(), time.Now().Add(12*time.Hour))
+	if err != nil || len(forecast) == 0 {
+		return
+	}
+	fmt.Println("\nNext 12 hours:")
+	for _, h := range forecast {
+		fmt.Printf("  %s  %5.1f°C  %3.0f%%  %s\n", h.Time.Local().Format("15:04"), h.Temperature, h.Humidity, h.Conditions)
+	}
+}
+
+func energyMenu(reader *bufio.Reader) {
+	for {
+		fmt.Println("\n=== ENERGY ===")
+		fmt.Println("1. Energy Report")
+		fmt.Println("2. Tariffs")
+		if currentUser.Role == "homeowner" {
+			fmt.Println("3. Set Currency")
+			fmt.Println("4. Set Gas Price")
+			fmt.Println("5. Budgets & Alerts")
+		}
+		fmt.Println("6. Compare & Export")
+		fmt.Println("7. Equipment Runtime")
+		fmt.Println("0. Back to Main Menu")
+		fmt.Print("Enter choice: ")
+
+		choice, _ := reader.ReadString('\n')
+		switch strings.TrimSpace(choice) {
+		case "1":
+			viewEnergyUsage(reader)
+		case "2":
+			manageTariffs(reader)
+		case "3":
+			if currentUser.Role != "homeowner" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			fmt.Printf("Currency code [%s]: ", GetCurrency())
+			input, _ := reader.ReadString('\n')
+			if input = strings.ToUpper(strings.TrimSpace(input)); input == "" {
+				continue
+			}
+			if err := SetCurrency(input, currentUser); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Println("Currency updated")
+		case "4":
+			if currentUser.Role != "homeowner" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			fmt.Printf("Gas price per therm [%g]: ", GetGasRate())
+			input, _ := reader.ReadString('\n')
+			if input = strings.TrimSpace(input); input == "" {
+				continue
+			}
+			rate, err := strconv.ParseFloat(input, 64)
+			if err != nil {
+				fmt.Println("Invalid number")
+				continue
+			}
+			if err := SetGasRate(rate, currentUser); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Println("Gas price updated")
+		case "5":
+			if currentUser.Role != "homeowner" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			manageBudgets(reader)
+		case "6":
+			exportEnergyReport(reader)
+		case "7":
+			viewRuntimeReport(reader)
+		case "0":
+			return
+		default:
+			fmt.Println("Invalid choice")
+		}
+	}
+}
+
+func serviceTicketsMenu(reader *bufio.Reader) {
+	readLine := func(label string) string {
+		fmt.Print(label)
+		input, _ := reader.ReadString('\n')
+		return strings.TrimSpace(input)
+	}
+	readTicket := func() (int, bool) {
+		id, err := strconv.Atoi(strings.TrimPrefix(readLine("Ticket number: "), "#"))
+		if err != nil {
+			fmt.Println("Invalid ticket number")
+			return 0, false
+		}
+		return id, true
+	}
+	for {
+		tickets, err := ListServiceTickets(false, currentUser)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("\n=== SERVICE TICKETS ===")
+		if len(tickets) == 0 {
+			fmt.Println("No open tickets")
+		}
+		for _, t := range tickets {
+			fmt.Printf("  #%d %s - %s, access until %s\n", t.ID, t.Title, t.Technician, t.AccessUntil.Local().Format("2006-01-02 15:04"))
+		}
+		if currentUser.Role == "homeowner" {
+			fmt.Println("1. Open Ticket")
+		}
+		fmt.Println("2. View Ticket")
+		fmt.Println("3. Add Note")
+		if currentUser.Role == "technician" {
+			fmt.Println("4. Attach Diagnostics")
+		}
+		fmt.Println("5. Close Ticket")
+		fmt.Println("6. Service History")
+		fmt.Println("0. Back to Main Menu")
+		fmt.Print("Enter choice: ")
+
+		choice, _ := reader.ReadString('\n')
+		switch strings.TrimSpace(choice) {
+		case "1":
+			if currentUser.Role != "homeowner" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			title := readLine("Title: ")
+			description := readLine("Describe the issue: ")
+			tech := readLine("Technician username: ")
+			hours, err := strconv.Atoi(readLine("Access in hours: "))
+			if err != nil {
+				fmt.Println("Invalid duration")
+				continue
+			}
+			id, err := OpenServiceTicket(title, description, tech, hours, currentUser)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Printf("Ticket #%d opened; %s has access for %d hours\n", id, tech, hours)
+		case "2":
+			id, ok := readTicket()
+			if !ok {
+				continue
+			}
+			t, err := GetServiceTicket(id, currentUser)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			history, err := FormatServiceHistory([]ServiceTicket{t})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Println(history)
+		case "3":
+			id, ok := readTicket()
+			if !ok {
+				continue
+			}
+			if err := AddTicketNote(id, readLine("Note: "), currentUser); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Println("Note added")
+		case "4":
+			if currentUser.Role != "technician" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			id, ok := readTicket()
+			if !ok {
+				continue
+			}
+			report, err := AttachTicketDiagnostics(id, currentUser)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Println(GenerateDiagnosticReport(report))
+			fmt.Println("Diagnostics attached")
+		case "5":
+			id, ok := readTicket()
+			if !ok {
+				continue
+			}
+			if err := CloseServiceTicket(id, readLine("Resolution: "), currentUser); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Println("Ticket closed")
+			if currentUser.Role == "technician" && !IsTechnicianAccessAllowed(db, currentUser.Username) {
+				fmt.Println("Your access has ended")
+				logout()
+				return
+			}
+		case "6":
+			printServiceHistory(reader)
+		case "0":
+			return
+		default:
+			fmt.Println("Invalid choice")
+		}
+	}
+}
+
+// printServiceHistory shows every ticket and optionally saves it for printing.
+func printServiceHistory(reader *bufio.Reader) {
+	tickets, err := GetServiceHistory(currentUser)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	history, err := FormatServiceHistory(tickets)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("\n" + history)
+	fmt.Print("Save to a file for printing? (yes/no): ")
+	input, _ := reader.ReadString('\n')
+	if input = strings.ToLower(strings.TrimSpace(input)); input != "yes" && input != "y" {
+		return
+	}
+	if err := os.MkdirAll("exports", 0700); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	path := filepath.Join("exports", fmt.Sprintf("service-history-%s.txt", time.Now().Format("2006-01-02")))
+	if err := os.WriteFile(path, []byte(history), 0600); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	LogEvent("service_history_export", "Service history exported to "+path, currentUser.Username, "info")
+	fmt.Println("Saved to " + path)
+}
+
+func viewRuntimeReport(reader *bufio.Reader) {
+	fmt.Print("Number of days (default 7): ")
+	input, _ := reader.ReadString('\n')
+	days := 7
+	if input = strings.TrimSpace(input); input != "" {
+		d, err := strconv.Atoi(input)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return
+		}
+		days = d
+	}
+	report, err := GetRuntimeReport(days, currentUser)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("\n" + FormatRuntimeReport(report))
+}
+
+func exportEnergyReport(reader *bufio.Reader) {
+	fmt.Print("Number of complete days (default 30): ")
+	input, _ := reader.ReadString('\n')
+	days := 30
+	if input = strings.TrimSpace(input); input != "" {
+		d, err := strconv.Atoi(input)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return
+		}
+		days = d
+	}
+	report, err := BuildEnergyReport(days, time.Now())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("\n" + FormatEnergyComparisons(report))
+	fmt.Print("Export as csv, json or blank to skip: ")
+	input, _ = reader.ReadString('\n')
+	format := strings.ToLower(strings.TrimSpace(input))
+	if format != "csv" && format != "json" {
+		return
+	}
+	if err := os.MkdirAll("exports", 0700); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	path := filepath.Join("exports", fmt.Sprintf("energy-%s-%s.%s", report.Summary.From, report.Summary.To, format))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if format == "csv" {
+		err = WriteEnergyCSV(file, report)
+	} else {
+		err = WriteEnergyJSON(file, report)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	LogEvent("energy_export", "Energy report exported to "+path, currentUser.Username, "info")
+	fmt.Println("Exported to " + path)
+}
+
+func manageBudgets(reader *bufio.Reader) {
+	statuses, err := GetBudgetStatuses(time.Now())
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	s := LoadBudgetSettings()
+	fmt.Println("\n=== ENERGY BUDGETS ===")
+	if len(statuses) == 0 {
+		fmt.Println("No budgets set")
+	}
+	for _, b := range statuses {
+		risk := ""
+		if b.AtRisk {
+			risk = " - AT RISK"
+		}
+		fmt.Printf("%s: %s of %s, projected %s%s\n", budgetLabel(b.Period), formatBudgetAmount(b.Unit, b.Used),
+			formatBudgetAmount(b.Unit, b.Limit), formatBudgetAmount(b.Unit, b.Projected), risk)
+	}
+	fmt.Printf("Alerts at %v%% of budget; eco mode %v (widen %.1f°C)\n", s.AlertPercents, s.EcoEnabled, s.EcoWiden)
+	fmt.Println("1. Set Budget")
+	fmt.Println("2. Remove Budget")
+	fmt.Println("3. Alerts & Eco Mode")
+	fmt.Println("0. Back")
+	fmt.Print("Choice: ")
+	choice, _ := reader.ReadString('\n')
+	readLine := func(label string) string {
+		fmt.Print(label)
+		input, _ := reader.ReadString('\n')
+		return strings.TrimSpace(input)
+	}
+	switch strings.TrimSpace(choice) {
+	case "1":
+		b := EnergyBudget{Period: strings.ToLower(readLine("Period (" + strings.Join(budgetPeriods, "/") + "): "))}
+		b.Unit = strings.ToLower(readLine("Budget in kwh or cost: "))
+		limit, err := strconv.ParseFloat(readLine("Limit: "), 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return
+		}
+		b.Limit = limit
+		if err := SetEnergyBudget(b, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Budget set")
+	case "2":
+		if err := ClearEnergyBudget(strings.ToLower(readLine("Period: ")), currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Budget removed")
+	case "3":
+		if input := readLine(fmt.Sprintf("Alert percentages, comma separated [%s]: ", GetSetting("budget_alert_percents", "50,80,100"))); input != "" {
+			s.AlertPercents = nil
+			for _, field := range strings.Split(input, ",") {
+				p, err := strconv.Atoi(strings.TrimSpace(field))
+				if err != nil {
+					fmt.Println("Invalid percentage")
+					return
+				}
+				s.AlertPercents = append(s.AlertPercents, p)
+			}
+		}
+		input := strings.ToLower(readLine("Widen setpoints automatically when a budget is at risk? (yes/no): "))
+		s.EcoEnabled = input == "yes" || input == "y"
+		if input := readLine(fmt.Sprintf("Widen by °C (0.5-4) [%g]: ", s.EcoWiden)); input != "" {
+			v, err := strconv.ParseFloat(input, 64)
+			if err != nil {
+				fmt.Println("Invalid number")
+				return
+			}
+			s.EcoWiden = v
+		}
+		if err := SetBudgetSettings(s, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Budget alerts updated")
+	}
+}
+
+func manageTariffs(reader *bufio.Reader) {
+	tariffs, err := ListTariffs()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	active, configured := ActiveTariff()
+	fmt.Println("\n=== TARIFFS ===")
+	if !configured {
+		fmt.Printf("No tariff active, billing a flat %s per kWh\n", FormatMoney(active.BaseRate))
+	}
+	for _, t := range tariffs {
+		marker := ""
+		if configured && t.ID == active.ID {
+			marker = " (active)"
+		}
+		fmt.Printf("#%d: %s%s - standard %g/kWh, %g/day\n", t.ID, t.Name, marker, t.BaseRate, t.DailyCharge)
+		for _, p := range t.Periods {
+			fmt.Printf("    %s: %g/kWh, %s %s-%s, months %d-%d\n", p.Name, p.Rate, p.DayType, p.StartTime, p.EndTime, p.StartMonth, p.EndMonth)
+		}
+		for _, tier := range t.Tiers {
+			fmt.Printf("    above %g kWh/month: %+g/kWh\n", tier.AboveKWH, tier.Adder)
+		}
+	}
+	if currentUser.Role != "homeowner" {
+		return
+	}
+	fmt.Println("1. Create Tariff")
+	fmt.Println("2. Activate Tariff")
+	fmt.Println("3. Delete Tariff")
+	fmt.Println("0. Back")
+	fmt.Print("Choice: ")
+	choice, _ := reader.ReadString('\n')
+	switch strings.TrimSpace(choice) {
+	case "1":
+		createTariff(reader)
+	case "2", "3":
+		fmt.Print("Tariff #: ")
+		input, _ := reader.ReadString('\n')
+		id, err := strconv.Atoi(strings.TrimSpace(input))
+		if err != nil {
+			fmt.Println("Invalid number")
+			return
+		}
+		if strings.TrimSpace(choice) == "2" {
+			err = SetActiveTariff(id, currentUser)
+		} else {
+			err = DeleteTariff(id, currentUser)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Println("Tariffs updated")
+	}
+}
+
+func createTariff(reader *bufio.Reader) {
+	readLine := func(label string) string {
+		fmt.Print(label)
+		input, _ := reader.ReadString('\n')
+		return strings.TrimSpace(input)
+	}
+	readFloat := func(label string) (float64, bool) {
+		v, err := strconv.ParseFloat(readLine(label), 64)
+		if err != nil {
+			fmt.Println("Invalid number")
+			return 0, false
+		}
+		return v, true
+	}
+	var t Tariff
+	var ok bool
+	t.Name = readLine("Tariff name: ")
+	if t.BaseRate, ok = readFloat("Standard rate per kWh: "); !ok {
+		return
+	}
+	if t.DailyCharge, ok = readFloat("Fixed daily charge: "); !ok {
+		return
+	}
+	for strings.ToLower(readLine("Add a time-of-use period? (yes/no): ")) == "yes" {
+		p := TariffPeriod{Name: readLine("Period name (e.g. peak): "), DayType: readLine("Days (all/weekday/weekend): ")}
+		p.StartTime = readLine("Starts HH:MM: ")
+		p.EndTime = readLine("Ends HH:MM: ")
+		if _, err := fmt.Sscanf(readLine("Season months (e.g. 6-9, 1-12 for all year): "), "%d-%d", &p.StartMonth, &p.EndMonth); err != nil {
+			fmt.Println("Invalid months")
+			return
+		}
+		if p.Rate, ok = readFloat("Rate per kWh: "); !ok {
+			return
+		}
+		t.Periods = append(t.Periods, p)
+	}
+	for strings.ToLower(readLine("Add a consumption tier? (yes/no): ")) == "yes" {
+		var tier TariffTier
+		if tier.AboveKWH, ok = readFloat("Applies above kWh per month: "); !ok {
+			return
+		}
+		if tier.Adder, ok = readFloat("Extra per kWh: "); !ok {
+			return
+		}
+		t.Tiers = append(t.Tiers, tier)
+	}
+	id, err := CreateTariff(t, currentUser)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Tariff #%d created\n", id)
+	if strings.ToLower(readLine("Make it the active tariff? (yes/no): ")) == "yes" {
+		if err := SetActiveTariff(id, currentUser); err != nil {
+			fmt.Printf("Error: %v\n", err)
+		}
+	}
+}
+
+func viewEnergyUsage(reader *bufio.Reader) {
+	fmt.Print("Enter number of days (default 7): ")
+	input, _ := reader.ReadString('\n')
+	input = strings.TrimSpace(input)
+	days := 7
+	if input != "" {
+		if d, err := strconv.Atoi(input); err == nil {
+			days = d
+		}
+	}
+	stats, err := GetEnergyUsage(days)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("\n" + GenerateEnergyReport(stats))
+}
+
+func manageProfiles(reader *bufio.Reader, currentUser *User) {
+	for {
+		fmt.Println("\n=== PROFILE MANAGEMENT ===")
+		fmt.Println("1. List Profiles")
+		fmt.Println("2. Apply Profile")
+		if currentUser.Role == "homeowner" || currentUser.Role == "technician" {
+			fmt.Println("3. Create Profile")
+			fmt.Println("4. Delete Profile")
+			fmt.Println("5. Add Schedule")
+			fmt.Println("6. View Schedules")
+			fmt.Println("7. Set Active Schedule")
+		}
+		fmt.Println("0. Back to Main Menu")
+		fmt.Print("Enter choice: ")
+
+		choice, _ := reader.ReadString('\n')
+		choice = strings.TrimSpace(choice)
+
+		switch choice {
+		case "1":
+			listProfiles(reader)
+		case "2":
+			applyProfile(reader)
+		case "3":
+			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			createProfile(reader)
+		case "4":
+			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			deleteProfile(reader)
+		case "5":
+			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			addSchedule(reader)
+		case "6":
+			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			viewSchedules(reader)
+		case "7":
+			if currentUser.Role != "homeowner" && currentUser.Role != "technician" {
+				fmt.Println("Invalid choice")
+				continue
+			}
+			setScheduleProfile(reader)
+		case "0":
+			return
+		default:
+			fmt.Println("Invalid choice")
+		}
+	}
+}
+
+func listProfiles(reader *bufio.Reader) {
+	profiles, err := ListProfiles(currentUser.Username, currentUser)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println("Name    | Temp (°C) | Mode | Guest Accessible")
+	fmt.Println("-----------------------------------------------")
+	for _, p := range profiles {
+		guest := "No"
+		if p.GuestAccessible == 1 {
+			guest = "Yes"
+		}
+		fmt.Printf("%-8s | %9.1f | %-4s | %-15s\n", p.Name, p.TargetTemp, p.HVACMode, guest)
+	}
+}
+
+func createProfile(reader *bufio.Reader) {
+	fmt.Print("Profile name: ")
+	name, _ := reader.ReadString('\n')
+	name = strings.TrimSpace(name)
+
+	fmt.Print("Target temperature (10-35°C): ")
+	tempStr, _ := reader.ReadString('\n')
+	temp, err := strconv.ParseFloat(strings.TrimSpace(tempStr), 64)
+	if err != nil {
+		fmt.Println("Invalid temperature")
+		return
+	}
+
+	// FIX: Add this section to get HVAC mode!
+	fmt.Print("HVAC mode (off/heat/cool/fan/auto): ")
+	mode, _ := reader.ReadString('\n')
+	mode = strings.TrimSpace(mode)
+
+	heat, cool := 0.0, 0.0
+	if mode == "auto" {
+		var ok bool
+		if heat, cool, ok = readAutoSetpoints(reader, DefaultHeatSetpoint, DefaultCoolSetpoint); !ok {
+			return
+		}
+	}
+
+	// New: prompt for guest accessibility
+	fmt.Print("Allow guests to view/apply this profile? (yes/no): ")
+	guestInput, _ := reader.ReadString('\n')
+	guestInput = strings.TrimSpace(strings.ToLower(guestInput))
+	guestAccessible := 0
+	if guestInput == "yes" || guestInput == "y" {
+		guestAccessible = 1
+	}
+
+	// Call CreateProfile with the new parameter
+	if err := CreateProfile(name, temp, mode, currentUser.Username, currentUser, guestAccessible, heat, cool); err != nil {
+		fmt.Printf("Error: %v\n", err)
 		return
 	}
 	fmt.Println("Profile created successfully")
@@ -467,8 +2459,22 @@ func addSchedule(reader *bufio.Reader) {
 	fmt.Print("Target Temperature (Celsius): ")
 	targetStr, _ := reader.ReadString('\n')
 	targetTemp, _ := strconv.ParseFloat(strings.TrimSpace(targetStr), 64)
+	fmt.Print("Auto mode heat/cool setpoints? (yes/no): ")
+	autoInput, _ := reader.ReadString('\n')
+	autoInput = strings.TrimSpace(strings.ToLower(autoInput))
+	heat, cool := 0.0, 0.0
+	if autoInput == "yes" || autoInput == "y" {
+		var ok bool
+		if heat, cool, ok = readAutoSetpoints(reader, DefaultHeatSetpoint, DefaultCoolSetpoint); !ok {
+			return
+		}
+	}
 
-	err := AddSchedule(profileID, dayOfWeek, startTime, endTime, targetTemp, currentUser)
+	fmt.Print("Active room sensor during this schedule (blank to leave unchanged): ")
+	activeRoom, _ := reader.ReadString('\n')
+	activeRoom = strings.TrimSpace(activeRoom)
+
+	err := AddSchedule(profileID, dayOfWeek, startTime, endTime, targetTemp, heat, cool, activeRoom, currentUser)
 	if err != nil {
 		fmt.Printf("Error adding schedule: %v\n", err)
 	} else {
@@ -492,8 +2498,35 @@ func viewSchedules(reader *bufio.Reader) {
 	}
 	fmt.Println("Schedules for this profile:")
 	for _, s := range schedules {
+		if s.HeatSetpoint != 0 {
+			fmt.Printf("Day %d: %s - %s, Auto: heat %.1f°C / cool %.1f°C\n", s.DayOfWeek, s.StartTime, s.EndTime, s.HeatSetpoint, s.CoolSetpoint)
+			continue
+		}
 		fmt.Printf("Day %d: %s - %s, Target: %.1f°C\n", s.DayOfWeek, s.StartTime, s.EndTime, s.TargetTemp)
+		if s.ActiveRoom != "" {
+			fmt.Printf("    Active room: %s\n", s.ActiveRoom)
+		}
+	}
+}
+
+func setScheduleProfile(reader *bufio.Reader) {
+	if current := GetScheduleProfile(); current != "" {
+		fmt.Printf("Schedules now run from profile: %s\n", current)
+	} else {
+		fmt.Println("No schedule is active")
+	}
+	fmt.Print("Profile whose schedules should run (blank to disable): ")
+	name, _ := reader.ReadString('\n')
+	name = strings.TrimSpace(name)
+	if err := SetScheduleProfile(name, currentUser); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if name == "" {
+		fmt.Println("Schedules disabled")
+		return
 	}
+	fmt.Printf("Schedules from %s will now run\n", name)
 }
 
 func manageUsers(reader *bufio.Reader) {
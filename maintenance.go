@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maintenanceCheckInterval = time.Hour
+	maintenanceRemindEvery   = 7 * 24 * time.Hour // repeat reminders while an item stays overdue
+	maintenanceDueSoon       = 0.9                // fraction of an interval used before an item shows as due soon
+)
+
+var maintenanceKinds = []string{"filter", "humidifier_pad", "uv_bulb", "other"}
+
+// MaintenanceItem is a consumable replaced on a schedule: after RuntimeHours
+// of blower runtime, after IntervalDays, or whichever comes first when both
+// are set. Zero disables either limit.
+type MaintenanceItem struct {
+	ID           int
+	Name         string
+	Kind         string
+	RuntimeHours float64
+	IntervalDays int
+	LastServiced time.Time
+}
+
+// MaintenanceStatus is an item's progress towards its next service.
+type MaintenanceStatus struct {
+	MaintenanceItem
+	BlowerHours float64   // blower runtime since last serviced
+	DueAt       time.Time // calendar due date, zero without IntervalDays
+	Used        float64   // fraction of the interval used, the larger of runtime and calendar
+	Due         bool
+	DueSoon     bool
+	Reason      string
+}
+
+// ServiceVisit is a technician's visit: the items serviced, parts used and notes.
+type ServiceVisit struct {
+	ID         int
+	VisitedAt  time.Time
+	Technician string
+	Items      []string
+	Parts      string
+	Notes      string
+}
+
+// seedMaintenanceItems adds the usual consumables on first run.
+func seedMaintenanceItems() error {
+	if GetSetting("maintenance_seeded", "0") == "1" {
+		return nil
+	}
+	for _, item := range []MaintenanceItem{
+		{Name: "Air filter", Kind: "filter", RuntimeHours: 300, IntervalDays: 90},
+		{Name: "Humidifier pad", Kind: "humidifier_pad", IntervalDays: 365},
+		{Name: "UV bulb", Kind: "uv_bulb", IntervalDays: 365},
+	} {
+		if _, err := db.Exec("INSERT OR IGNORE INTO maintenance_items (name, kind, runtime_hours, interval_days, last_serviced_at, updated_by) VALUES (?, ?, ?, ?, ?, 'system')",
+			item.Name, item.Kind, item.RuntimeHours, item.IntervalDays, dbTime(time.Now())); err != nil {
+			return err
+		}
+	}
+	return SetSetting("maintenance_seeded", "1", "system")
+}
+
+// SetMaintenanceItem adds an item, or changes the kind and intervals of the
+// item with that name. A new item counts from now.
+func SetMaintenanceItem(item MaintenanceItem, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can manage maintenance items")
+	}
+	item.Name = SanitizeInput(item.Name)
+	if len(item.Name) < 2 || len(item.Name) > 40 {
+		return errors.New("invalid maintenance item name length")
+	}
+	known := false
+	for _, k := range maintenanceKinds {
+		known = known || item.Kind == k
+	}
+	if !known {
+		return errors.New("kind must be one of " + strings.Join(maintenanceKinds, ", "))
+	}
+	if item.RuntimeHours < 0 || item.RuntimeHours > 10000 || item.IntervalDays < 0 || item.IntervalDays > 3650 {
+		return errors.New("runtime interval must be 0-10000 hours and calendar interval 0-3650 days")
+	}
+	if item.RuntimeHours == 0 && item.IntervalDays == 0 {
+		return errors.New("set a runtime or calendar interval")
+	}
+	_, err := db.Exec(`INSERT INTO maintenance_items (name, kind, runtime_hours, interval_days, last_serviced_at, updated_by) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET kind = excluded.kind, runtime_hours = excluded.runtime_hours,
+		interval_days = excluded.interval_days, updated_by = excluded.updated_by`,
+		item.Name, item.Kind, item.RuntimeHours, item.IntervalDays, dbTime(time.Now()), user.Username)
+	if err != nil {
+		return err
+	}
+	LogEvent("maintenance_item", fmt.Sprintf("Maintenance item %s (%s) set to %s", item.Name, item.Kind, maintenanceInterval(item)), user.Username, "info")
+	return nil
+}
+
+func DeleteMaintenanceItem(name string, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can manage maintenance items")
+	}
+	result, err := db.Exec("DELETE FROM maintenance_items WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("maintenance item not found")
+	}
+	LogEvent("maintenance_item", "Maintenance item removed: "+name, user.Username, "info")
+	return nil
+}
+
+func ListMaintenanceItems() ([]MaintenanceItem, error) {
+	rows, err := db.Query("SELECT id, name, kind, runtime_hours, interval_days, last_serviced_at FROM maintenance_items ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []MaintenanceItem{}
+	for rows.Next() {
+		var item MaintenanceItem
+		if err := rows.Scan(&item.ID, &item.Name, &item.Kind, &item.RuntimeHours, &item.IntervalDays, &item.LastServiced); err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// blowerHours is the blower runtime in [from, to). The blower runs whenever
+// the equipment does, in every mode.
+func blowerHours(from, to time.Time) (float64, error) {
+	intervals, err := meteredIntervals(from, to)
+	if err != nil {
+		return 0, err
+	}
+	seconds := 0.0
+	for _, m := range intervals {
+		seconds += m.Seconds()
+	}
+	return seconds / 3600, nil
+}
+
+// GetMaintenanceStatuses measures every item against its intervals, most
+// worn first.
+func GetMaintenanceStatuses(now time.Time) ([]MaintenanceStatus, error) {
+	items, err := ListMaintenanceItems()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []MaintenanceStatus{}
+	for _, item := range items {
+		s := MaintenanceStatus{MaintenanceItem: item}
+		if s.BlowerHours, err = blowerHours(item.LastServiced, now); err != nil {
+			return nil, err
+		}
+		reasons := []string{}
+		if item.RuntimeHours > 0 {
+			s.Used = s.BlowerHours / item.RuntimeHours
+			if s.BlowerHours >= item.RuntimeHours {
+				reasons = append(reasons, fmt.Sprintf("%.0f of %.0f blower hours", s.BlowerHours, item.RuntimeHours))
+			}
+		}
+		if item.IntervalDays > 0 {
+			s.DueAt = item.LastServiced.AddDate(0, 0, item.IntervalDays)
+			if used := now.Sub(item.LastServiced).Hours() / 24 / float64(item.IntervalDays); used > s.Used {
+				s.Used = used
+			}
+			if !now.Before(s.DueAt) {
+				reasons = append(reasons, "due "+s.DueAt.Local().Format("2006-01-02"))
+			}
+		}
+		s.Due = len(reasons) > 0
+		s.DueSoon = !s.Due && s.Used >= maintenanceDueSoon
+		s.Reason = strings.Join(reasons, ", ")
+		statuses = append(statuses, s)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Used > statuses[j].Used })
+	return statuses, nil
+}
+
+// CheckMaintenance reminds homeowners of items that are due, once when they
+// fall due and weekly while they stay overdue.
+func CheckMaintenance(now time.Time) error {
+	statuses, err := GetMaintenanceStatuses(now)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		if !s.Due {
+			continue
+		}
+		result, err := db.Exec("UPDATE maintenance_items SET reminded_at = ? WHERE id = ? AND (reminded_at IS NULL OR reminded_at <= ?)",
+			dbTime(now), s.ID, dbTime(now.Add(-maintenanceRemindEvery)))
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		LogEvent("maintenance_due", fmt.Sprintf("%s due for service: %s", s.Name, s.Reason), "system", "warning")
+		usernames, err := activeUsernames("homeowner")
+		if err != nil {
+			return err
+		}
+		for _, username := range usernames {
+			SendMaintenanceReminder(username, s.Name, s.Reason)
+		}
+	}
+	return nil
+}
+
+// LogServiceVisit records a visit and restarts the intervals of the items
+// serviced. It returns the visit ID.
+func LogServiceVisit(v ServiceVisit, user *User) (int, error) {
+	if user.Role != "technician" && user.Role != "homeowner" {
+		return 0, errors.New("only technicians or homeowners can log service visits")
+	}
+	v.Parts, v.Notes = SanitizeInput(v.Parts), SanitizeInput(v.Notes)
+	if len(v.Parts) > 500 || len(v.Notes) > 1000 {
+		return 0, errors.New("parts must be at most 500 characters and notes at most 1000")
+	}
+	if len(v.Items) == 0 && v.Notes == "" {
+		return 0, errors.New("a visit needs serviced items or notes")
+	}
+	v.VisitedAt = time.Now()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO service_visits (visited_at, technician, parts, notes) VALUES (?, ?, ?, ?)",
+		dbTime(v.VisitedAt), user.Username, v.Parts, v.Notes)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range v.Items {
+		updated, err := tx.Exec("UPDATE maintenance_items SET last_serviced_at = ?, reminded_at = NULL WHERE name = ?", dbTime(v.VisitedAt), name)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := updated.RowsAffected(); n == 0 {
+			return 0, fmt.Errorf("maintenance item %q not found", name)
+		}
+		if _, err := tx.Exec("INSERT INTO service_visit_items (visit_id, item_name) VALUES (?, ?)", id, name); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	v.ID, v.Technician = int(id), user.Username
+	LogEvent("maintenance_visit", "Service visit "+formatServiceVisit(v), user.Username, "info")
+	return int(id), nil
+}
+
+// GetServiceVisits returns the most recent visits, newest first.
+func GetServiceVisits(limit int) ([]ServiceVisit, error) {
+	rows, err := db.Query("SELECT id, visited_at, technician, COALESCE(parts, ''), COALESCE(notes, '') FROM service_visits ORDER BY visited_at DESC, id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	visits := []ServiceVisit{}
+	for rows.Next() {
+		var v ServiceVisit
+		if err := rows.Scan(&v.ID, &v.VisitedAt, &v.Technician, &v.Parts, &v.Notes); err != nil {
+			continue
+		}
+		visits = append(visits, v)
+	}
+	rows.Close()
+	for i := range visits {
+		items, err := db.Query("SELECT item_name FROM service_visit_items WHERE visit_id = ? ORDER BY id", visits[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for items.Next() {
+			var name string
+			if items.Scan(&name) == nil {
+				visits[i].Items = append(visits[i].Items, name)
+			}
+		}
+		items.Close()
+	}
+	return visits, nil
+}
+
+// maintenanceInterval describes an item's service interval.
+func maintenanceInterval(item MaintenanceItem) string {
+	parts := []string{}
+	if item.RuntimeHours > 0 {
+		parts = append(parts, fmt.Sprintf("%.0f blower hours", item.RuntimeHours))
+	}
+	if item.IntervalDays > 0 {
+		parts = append(parts, fmt.Sprintf("%d days", item.IntervalDays))
+	}
+	return "every " + strings.Join(parts, " or ")
+}
+
+// formatMaintenanceStatus renders one item for menus and reports.
+func formatMaintenanceStatus(s MaintenanceStatus) string {
+	state := fmt.Sprintf("%.0f%% used", s.Used*100)
+	switch {
+	case s.Due:
+		state = "DUE - " + s.Reason
+	case s.DueSoon:
+		state += ", due soon"
+	}
+	return fmt.Sprintf("%s (%s, %s): serviced %s, %.1f blower hours since; %s", s.Name, s.Kind, maintenanceInterval(s.MaintenanceItem),
+		s.LastServiced.Local().Format("2006-01-02"), s.BlowerHours, state)
+}
+
+func formatServiceVisit(v ServiceVisit) string {
+	line := fmt.Sprintf("%s by %s", v.VisitedAt.Local().Format("2006-01-02 15:04"), v.Technician)
+	if len(v.Items) > 0 {
+		line += ": serviced " + strings.Join(v.Items, ", ")
+	}
+	if v.Parts != "" {
+		line += "; parts: " + v.Parts
+	}
+	if v.Notes != "" {
+		line += "; notes: " + v.Notes
+	}
+	return line
+}
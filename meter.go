@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Energy is metered in intervals: each stretch of continuous running in one
+// mode and stage is a row in energy_intervals with its exact start and end,
+// to the second. A row is written as soon as the interval opens and its end
+// is checkpointed while it runs, so a crash loses at most meterCheckpoint of
+// runtime. Every energy figure is derived from these intervals.
+
+const meterCheckpoint = time.Minute
+
+type meterRun struct {
+	id    int64
+	start time.Time
+	saved time.Time // last checkpoint
+	mode  HVACMode
+	stage int
+	aux   bool
+}
+
+// openRun is the interval being metered, nil while the equipment is idle.
+// It is guarded by hvacMutex.
+var openRun *meterRun
+
+// MeteredInterval is runtime read back from the meter, clipped to the range
+// it was loaded for with its energy prorated to the part inside.
+type MeteredInterval struct {
+	Start  time.Time
+	End    time.Time
+	Mode   string
+	Stage  string
+	KWH    float64
+	Therms float64
+}
+
+func (m MeteredInterval) Seconds() float64 {
+	return m.End.Sub(m.Start).Seconds()
+}
+
+// clip returns the part of m inside [from, to), if any.
+func (m MeteredInterval) clip(from, to time.Time) (MeteredInterval, bool) {
+	full := m.End.Sub(m.Start)
+	if full <= 0 {
+		return m, false
+	}
+	c := m
+	if from.After(c.Start) {
+		c.Start = from
+	}
+	if to.Before(c.End) {
+		c.End = to
+	}
+	part := c.End.Sub(c.Start)
+	if part <= 0 {
+		return c, false
+	}
+	share := float64(part) / float64(full)
+	c.KWH, c.Therms = m.KWH*share, m.Therms*share
+	return c, true
+}
+
+// syncMeter brings the meter in line with the HVAC state: the open interval
+// is closed when the equipment stops or changes mode or stage, a new one is
+// opened for whatever is now running, and a long run is checkpointed.
+// Consecutive intervals share their boundary, so no runtime falls between
+// them. Callers must hold hvacMutex.
+func syncMeter(now time.Time) {
+	now = now.Truncate(time.Second)
+	mode, stage, aux := effectiveMode(), hvacState.Stage, hvacState.AuxHeat
+	running := hvacState.IsRunning && mode != "" && mode != ModeOff
+	if r := openRun; r != nil {
+		if running && r.mode == mode && r.stage == stage && r.aux == aux {
+			if now.Sub(r.saved) >= meterCheckpoint {
+				saveMeterRun(r, now, false)
+			}
+			return
+		}
+		saveMeterRun(r, now, true)
+		openRun = nil
+	}
+	if running {
+		openRun = &meterRun{start: now, mode: mode, stage: stage, aux: aux}
+		saveMeterRun(openRun, now, false)
+	}
+}
+
+// saveMeterRun writes r as running until end, closing it if closed. An
+// interval closed within the second it opened is dropped.
+func saveMeterRun(r *meterRun, end time.Time, closed bool) {
+	runtime := end.Sub(r.start)
+	kwh, therms := estimateEnergyUsage(r.mode, r.stage, r.aux, runtime)
+	label := stageLabel(r.mode, r.stage, r.aux)
+	var err error
+	switch {
+	case closed && runtime <= 0:
+		if r.id != 0 {
+			_, err = db.Exec("DELETE FROM energy_intervals WHERE id = ?", r.id)
+		}
+	case r.id == 0:
+		result, insertErr := db.Exec(`INSERT INTO energy_intervals (started_at, ended_at, hvac_mode, stage, runtime_seconds, estimated_kwh, gas_therms, closed)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, dbTime(r.start), dbTime(end), r.mode, label, int(runtime.Seconds()), kwh, therms, closed)
+		if err = insertErr; err == nil {
+			r.id, _ = result.LastInsertId()
+		}
+	default:
+		_, err = db.Exec("UPDATE energy_intervals SET ended_at = ?, runtime_seconds = ?, estimated_kwh = ?, gas_therms = ?, closed = ? WHERE id = ?",
+			dbTime(end), int(runtime.Seconds()), kwh, therms, closed, r.id)
+	}
+	if err != nil {
+		LogEvent("energy_error", "Could not record energy interval: "+err.Error(), "system", "warning")
+		return
+	}
+	r.saved = end
+	if closed && runtime > 0 {
+		LogEvent("energy_track", fmt.Sprintf("Tracked %.2f kWh and %.3f therms for %s mode, %s (%s)",
+			kwh, therms, r.mode, label, runtime), "system", "info")
+	}
+}
+
+// CloseEnergyMeter closes the open interval at shutdown.
+func CloseEnergyMeter() {
+	hvacMutex.Lock()
+	defer hvacMutex.Unlock()
+	if openRun != nil {
+		saveMeterRun(openRun, time.Now().Truncate(time.Second), true)
+		openRun = nil
+	}
+}
+
+// closeStaleIntervals closes intervals left open by a crash at their last
+// checkpoint, the last time the equipment was known to be running.
+func closeStaleIntervals() {
+	result, err := db.Exec("UPDATE energy_intervals SET closed = 1 WHERE closed = 0")
+	if err != nil {
+		LogEvent("energy_error", "Could not close stale energy intervals: "+err.Error(), "system", "warning")
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		LogEvent("energy_track", fmt.Sprintf("Closed %d energy interval(s) left open at their last checkpoint", n), "system", "warning")
+	}
+}
+
+// meteredIntervals returns the metered runtime overlapping [from, to),
+// clipped to it, in start order. The interval still running counts up to its
+// last checkpoint. dbTime drops fractions of a second, so the query reaches a
+// second past to and clip trims the excess.
+func meteredIntervals(from, to time.Time) ([]MeteredInterval, error) {
+	rows, err := db.Query(`SELECT started_at, ended_at, hvac_mode, COALESCE(stage, ''), estimated_kwh, gas_therms FROM energy_intervals
+		WHERE started_at < ? AND ended_at > ? ORDER BY started_at, id`, dbTime(to.Add(time.Second)), dbTime(from))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	intervals := []MeteredInterval{}
+	for rows.Next() {
+		var m MeteredInterval
+		if err := rows.Scan(&m.Start, &m.End, &m.Mode, &m.Stage, &m.KWH, &m.Therms); err != nil {
+			continue
+		}
+		if c, ok := m.clip(from, to); ok {
+			intervals = append(intervals, c)
+		}
+	}
+	return intervals, rows.Err()
+}
+
+// estimateEnergyUsage bills runtime at the configured ratings of the stage
+// combination that was running, returning electricity in kWh and gas in therms.
+func estimateEnergyUsage(mode HVACMode, stage int, aux bool, runtime time.Duration) (kwh, therms float64) {
+	hours := runtime.Hours()
+	return stageKW(mode, stage, aux) * hours, stageGasBTUH(mode, stage) * hours / btuPerTherm
+}
@@ -35,13 +35,13 @@ func SendSystemAlert(username, alertMessage string) error {
 	return SendNotification(username, "system_alert", alertMessage)
 }
 
-func SendMaintenanceReminder(username string) error {
-	message := "Maintenance reminder: Schedule system checkup"
+func SendMaintenanceReminder(username, item, reason string) error {
+	message := fmt.Sprintf("Maintenance reminder: %s due for service (%s)", item, reason)
 	return SendNotification(username, "maintenance", message)
 }
 
-func SendEnergyUsageAlert(username string, usage float64, threshold float64) error {
-	message := fmt.Sprintf("Energy usage alert: %.2f kWh (threshold: %.2f kWh)", usage, threshold)
+func SendEnergyUsageAlert(username, period string, usage, threshold float64, unit string) error {
+	message := fmt.Sprintf("Energy usage alert: %s usage %.2f %s (threshold: %.2f %s)", period, usage, unit, threshold, unit)
 	return SendNotification(username, "energy_alert", message)
 }
 
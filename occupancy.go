@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Occupancy states. Each carries a setback (°C the setpoints move towards
+// saving energy) and optionally a profile applied when the state is entered.
+const (
+	OccupancyHome     = "home"
+	OccupancyAway     = "away"
+	OccupancySleep    = "sleep"
+	OccupancyVacation = "vacation"
+)
+
+const (
+	occupancyMaxSetback     = 10.0
+	defaultMotionTimeout    = 30.0 // minutes without motion before the home counts as empty
+	presenceWebhookPath     = "/presence"
+	presenceWebhookMaxBody  = 1024
+	presenceWebhookMinToken = 16
+)
+
+var occupancyStates = []string{OccupancyHome, OccupancyAway, OccupancySleep, OccupancyVacation}
+
+var defaultOccupancySetbacks = map[string]float64{
+	OccupancyHome:     0,
+	OccupancySleep:    2,
+	OccupancyAway:     4,
+	OccupancyVacation: 6,
+}
+
+// occupancyUser applies the profiles bound to occupancy states. The bindings
+// are set by homeowners or technicians, so it applies them with homeowner rights.
+var occupancyUser = &User{Username: "occupancy", Role: "homeowner"}
+
+type OccupancyStateConfig struct {
+	State   string
+	Setback float64
+	Profile string // applied on entering the state, "" for none
+}
+
+type OccupancyStatus struct {
+	State  string
+	Source string // what decided the state: manual, vacation, a signal name or schedule
+	Since  time.Time
+}
+
+// OccupancySignal reports whether anyone is home. known is false when the
+// signal has no opinion, e.g. a motion sensor that has never reported.
+type OccupancySignal interface {
+	Name() string
+	Poll(now time.Time) (occupied, known bool)
+}
+
+var (
+	occupancyMutex   sync.Mutex
+	occupancySignals []OccupancySignal
+	occupancyCurrent OccupancyStatus
+	presenceServer   *http.Server
+)
+
+func validOccupancyState(state string) bool {
+	for _, s := range occupancyStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func LoadOccupancyConfig(state string) OccupancyStateConfig {
+	return OccupancyStateConfig{
+		State:   state,
+		Setback: GetSettingFloat("occupancy_"+state+"_setback", defaultOccupancySetbacks[state]),
+		Profile: GetSetting("occupancy_"+state+"_profile", ""),
+	}
+}
+
+func SetOccupancyConfig(cfg OccupancyStateConfig, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can configure occupancy states")
+	}
+	if !validOccupancyState(cfg.State) {
+		return errors.New("invalid occupancy state")
+	}
+	if cfg.Setback < 0 || cfg.Setback > occupancyMaxSetback {
+		return fmt.Errorf("setback must be 0-%.0f°C", occupancyMaxSetback)
+	}
+	if cfg.Profile != "" {
+		if _, err := GetProfile(cfg.Profile); err != nil {
+			return errors.New("profile not found")
+		}
+	}
+	if err := SetSettingFloat("occupancy_"+cfg.State+"_setback", cfg.Setback, user.Username); err != nil {
+		return err
+	}
+	if err := SetSetting("occupancy_"+cfg.State+"_profile", cfg.Profile, user.Username); err != nil {
+		return err
+	}
+	if GetOccupancy().State == cfg.State {
+		hvacMutex.Lock()
+		hvacState.Setback = cfg.Setback
+		hvacMutex.Unlock()
+	}
+	return nil
+}
+
+// GetSleepHours returns the nightly sleep window as "HH:MM", both empty when
+// no window is set.
+func GetSleepHours() (string, string) {
+	return GetSetting("occupancy_sleep_start", ""), GetSetting("occupancy_sleep_end", "")
+}
+
+func SetSleepHours(start, end string, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can set sleep hours")
+	}
+	if start != "" || end != "" {
+		if _, err := time.Parse("15:04", start); err != nil {
+			return errors.New("sleep start must be HH:MM")
+		}
+		if _, err := time.Parse("15:04", end); err != nil {
+			return errors.New("sleep end must be HH:MM")
+		}
+		if start == end {
+			return errors.New("sleep start and end must differ")
+		}
+	}
+	if err := SetSetting("occupancy_sleep_start", start, user.Username); err != nil {
+		return err
+	}
+	return SetSetting("occupancy_sleep_end", end, user.Username)
+}
+
+// inTimeWindow reports whether now falls in [start, end), both "HH:MM".
+// Windows that cross midnight, such as 22:00-06:30, are supported.
+func inTimeWindow(now time.Time, start, end string) bool {
+	s, err1 := time.Parse("15:04", start)
+	e, err2 := time.Parse("15:04", end)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	from, to := s.Hour()*60+s.Minute(), e.Hour()*60+e.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// SetOccupancyState holds the given state until it is changed again, or
+// returns to automatic detection for "auto". A vacation in progress still
+// takes priority over a manual hold.
+func SetOccupancyState(state string, user *User) error {
+	if state != "auto" && !validOccupancyState(state) {
+		return errors.New("state must be home, away, sleep, vacation or auto")
+	}
+	if state == "auto" {
+		state = ""
+	}
+	if err := SetSetting("occupancy_manual", state, user.Username); err != nil {
+		return err
+	}
+	details := "Occupancy returned to automatic"
+	if state != "" {
+		details = "Occupancy held at " + state
+	}
+	LogEvent("occupancy_manual", details, user.Username, "info")
+	return UpdateOccupancy(time.Now())
+}
+
+// RegisterOccupancySignal adds a source of presence information.
+func RegisterOccupancySignal(signal OccupancySignal) {
+	occupancyMutex.Lock()
+	defer occupancyMutex.Unlock()
+	occupancySignals = append(occupancySignals, signal)
+}
+
+// pollOccupancySignals combines the signals: anyone reporting presence makes
+// the home occupied, and it is only empty if some signal knows it to be.
+func pollOccupancySignals(now time.Time) (occupied, known bool, source string) {
+	occupancyMutex.Lock()
+	signals := append([]OccupancySignal(nil), occupancySignals...)
+	occupancyMutex.Unlock()
+	for _, s := range signals {
+		o, k := s.Poll(now)
+		if !k {
+			continue
+		}
+		if o {
+			return true, true, s.Name()
+		}
+		if !known {
+			known, source = true, s.Name()
+		}
+	}
+	return false, known, source
+}
+
+// evaluateOccupancy decides the state and any vacation hold temperature. A
+// vacation date range comes first, until its preconditioning starts, then a
+// manual hold, then the occupancy signals; with no information the home is
+// assumed occupied, asleep during the sleep window.
+func evaluateOccupancy(now time.Time) (string, string, float64) {
+	if v, err := activeVacation(now); err == nil {
+		returning := v.EndAt.Local().Format("2006-01-02 15:04")
+		if !v.PreconditionAt.IsZero() && !now.Before(v.PreconditionAt) {
+			return OccupancyHome, "preconditioning for return " + returning, 0
+		}
+		return OccupancyVacation, "vacation until " + returning, v.HoldTemp
+	}
+	if manual := GetSetting("occupancy_manual", ""); validOccupancyState(manual) {
+		return manual, "manual", 0
+	}
+	occupied, known, source := pollOccupancySignals(now)
+	if known && !occupied {
+		return OccupancyAway, source, 0
+	}
+	if start, end := GetSleepHours(); inTimeWindow(now, start, end) {
+		return OccupancySleep, "sleep hours", 0
+	}
+	if known {
+		return OccupancyHome, source, 0
+	}
+	return OccupancyHome, "default", 0
+}
+
+// UpdateOccupancy re-evaluates the occupancy state. On a change the
+// transition is audited, the state's setback takes effect and its profile,
+// if any, is applied. It must not be called with hvacMutex held.
+func UpdateOccupancy(now time.Time) error {
+	refreshVacationPlans(now)
+	state, source, hold := evaluateOccupancy(now)
+	cfg := LoadOccupancyConfig(state)
+
+	occupancyMutex.Lock()
+	old := occupancyCurrent
+	changed := old.State != state
+	if changed {
+		occupancyCurrent = OccupancyStatus{State: state, Source: source, Since: now}
+	} else {
+		occupancyCurrent.Source = source
+	}
+	occupancyMutex.Unlock()
+
+	hvacMutex.Lock()
+	hvacState.Setback = cfg.Setback
+	hvacState.HoldTemp = hold
+	hvacMutex.Unlock()
+	if !changed {
+		return nil
+	}
+
+	from := old.State
+	if from == "" {
+		from = "startup"
+	}
+	LogEvent("occupancy_change", fmt.Sprintf("Occupancy %s -> %s (%s, setback %.1f°C)", from, state, source, cfg.Setback), "system", "info")
+	if cfg.Profile != "" && old.State != "" {
+		if err := ApplyProfile(cfg.Profile, occupancyUser); err != nil {
+			return fmt.Errorf("applying %s profile %s: %w", state, cfg.Profile, err)
+		}
+	}
+	resetScheduler()
+	return nil
+}
+
+func GetOccupancy() OccupancyStatus {
+	occupancyMutex.Lock()
+	defer occupancyMutex.Unlock()
+	return occupancyCurrent
+}
+
+// OccupancySignalNames lists the registered signals for display.
+func OccupancySignalNames() []string {
+	occupancyMutex.Lock()
+	defer occupancyMutex.Unlock()
+	names := []string{}
+	for _, s := range occupancySignals {
+		names = append(names, s.Name())
+	}
+	return names
+}
+
+// MotionFileSignal treats the modification time of a file as the last time
+// motion was seen. A motion sensor integration only has to touch the file.
+type MotionFileSignal struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (m *MotionFileSignal) Name() string { return "motion sensor" }
+
+func (m *MotionFileSignal) Poll(now time.Time) (bool, bool) {
+	info, err := os.Stat(m.Path)
+	if err != nil {
+		return false, false
+	}
+	return now.Sub(info.ModTime()) < m.Timeout, true
+}
+
+// PresenceWebhook receives presence updates, such as from a phone geofencing
+// app, as POST {"present": true|false}. Requests must carry the shared token
+// in the X-Presence-Token header; only its hash is stored.
+type PresenceWebhook struct {
+	tokenHash string
+	mu        sync.Mutex
+	present   bool
+	updated   time.Time
+}
+
+func hashWebhookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (p *PresenceWebhook) Name() string { return "presence webhook" }
+
+func (p *PresenceWebhook) Poll(now time.Time) (bool, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.present, !p.updated.IsZero()
+}
+
+func (p *PresenceWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !SecureCompare(hashWebhookToken(r.Header.Get("X-Presence-Token")), p.tokenHash) {
+		AuditSecurityEvent("presence_webhook_denied", "Presence update with invalid token from "+r.RemoteAddr, "system")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Present *bool `json:"present"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, presenceWebhookMaxBody)).Decode(&body); err != nil || body.Present == nil {
+		http.Error(w, "expected {\"present\": true|false}", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	p.present = *body.Present
+	p.updated = time.Now()
+	p.mu.Unlock()
+	LogEvent("presence_update", fmt.Sprintf("Presence webhook reported present=%v", *body.Present), "system", "info")
+	if err := UpdateOccupancy(time.Now()); err != nil {
+		LogEvent("occupancy_error", "Occupancy update failed: "+err.Error(), "system", "warning")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type OccupancySignalSettings struct {
+	MotionFile    string
+	MotionTimeout float64 // minutes
+	WebhookAddr   string  // host:port to listen on, "" to disable
+}
+
+func LoadOccupancySignalSettings() OccupancySignalSettings {
+	return OccupancySignalSettings{
+		MotionFile:    GetSetting("occupancy_motion_file", ""),
+		MotionTimeout: GetSettingFloat("occupancy_motion_timeout_minutes", defaultMotionTimeout),
+		WebhookAddr:   GetSetting("presence_webhook_addr", ""),
+	}
+}
+
+// SetOccupancySignalSettings stores the signal configuration and restarts
+// the signals. A non-empty token replaces the webhook token; the webhook
+// cannot be enabled without one.
+func SetOccupancySignalSettings(s OccupancySignalSettings, token string, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can configure occupancy signals")
+	}
+	if s.MotionTimeout < 1 || s.MotionTimeout > 240 {
+		return errors.New("motion timeout must be 1-240 minutes")
+	}
+	if len(s.MotionFile) > 200 {
+		return errors.New("motion file path too long")
+	}
+	if s.WebhookAddr != "" {
+		if _, _, err := net.SplitHostPort(s.WebhookAddr); err != nil {
+			return errors.New("webhook address must be host:port")
+		}
+		if token == "" && GetSetting("presence_webhook_token_hash", "") == "" {
+			return errors.New("a webhook token is required")
+		}
+	}
+	if token != "" && len(token) < presenceWebhookMinToken {
+		return fmt.Errorf("webhook token must be at least %d characters", presenceWebhookMinToken)
+	}
+	for _, kv := range [][2]string{
+		{"occupancy_motion_file", s.MotionFile},
+		{"occupancy_motion_timeout_minutes", fmt.Sprintf("%g", s.MotionTimeout)},
+		{"presence_webhook_addr", s.WebhookAddr},
+	} {
+		if err := SetSetting(kv[0], kv[1], user.Username); err != nil {
+			return err
+		}
+	}
+	if token != "" {
+		if err := SetSetting("presence_webhook_token_hash", hashWebhookToken(token), user.Username); err != nil {
+			return err
+		}
+	}
+	return startOccupancySignals()
+}
+
+// startOccupancySignals (re)creates the configured signals.
+func startOccupancySignals() error {
+	occupancyMutex.Lock()
+	occupancySignals = nil
+	server := presenceServer
+	presenceServer = nil
+	occupancyMutex.Unlock()
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		server.Shutdown(ctx)
+		cancel()
+	}
+
+	s := LoadOccupancySignalSettings()
+	if s.MotionFile != "" {
+		RegisterOccupancySignal(&MotionFileSignal{Path: s.MotionFile, Timeout: time.Duration(s.MotionTimeout * float64(time.Minute))})
+	}
+	tokenHash := GetSetting("presence_webhook_token_hash", "")
+	if s.WebhookAddr == "" || tokenHash == "" {
+		return nil
+	}
+	webhook := &PresenceWebhook{tokenHash: tokenHash}
+	listener, err := net.Listen("tcp", s.WebhookAddr)
+	if err != nil {
+		return fmt.Errorf("presence webhook: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(presenceWebhookPath, webhook)
+	server = &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	occupancyMutex.Lock()
+	presenceServer = server
+	occupancyMutex.Unlock()
+	RegisterOccupancySignal(webhook)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			LogEvent("occupancy_error", "Presence webhook stopped: "+err.Error(), "system", "warning")
+		}
+	}()
+	LogEvent("presence_webhook", "Presence webhook listening on "+s.WebhookAddr+presenceWebhookPath, "system", "info")
+	return nil
+}
+
+// InitializeOccupancy starts the configured signals and settles the initial
+// state without applying its profile, which was applied before the restart.
+func InitializeOccupancy() error {
+	err := startOccupancySignals()
+	if uerr := UpdateOccupancy(time.Now()); err == nil {
+		err = uerr
+	}
+	return err
+}
@@ -15,18 +15,33 @@ type Profile struct {
 	Owner           string
 	CreatedAt       time.Time
 	GuestAccessible int
+	HeatSetpoint    float64 // auto mode only, 0 otherwise
+	CoolSetpoint    float64 // auto mode only, 0 otherwise
 }
 
 type Schedule struct {
-	ID         int
-	ProfileID  int
-	DayOfWeek  int
-	StartTime  string
-	EndTime    string
-	TargetTemp float64
+	ID           int
+	ProfileID    int
+	DayOfWeek    int
+	StartTime    string
+	EndTime      string
+	TargetTemp   float64
+	HeatSetpoint float64 // auto mode only, 0 otherwise
+	CoolSetpoint float64 // auto mode only, 0 otherwise
+	ActiveRoom   string  // room sensor in control while the schedule runs, "" to leave unchanged
 }
 
-func CreateProfile(profileName string, targetTemp float64, hvacMode, owner string, user *User, guestAccessible int) error {
+// nullableSetpoint stores unused auto setpoints as NULL.
+func nullableSetpoint(v float64) interface{} {
+	if v == 0 {
+		return nil
+	}
+	return v
+}
+
+// CreateProfile stores a profile. heatSetpoint and coolSetpoint are only
+// used for auto mode and must be 0 otherwise.
+func CreateProfile(profileName string, targetTemp float64, hvacMode, owner string, user *User, guestAccessible int, heatSetpoint, coolSetpoint float64) error {
 	if user.Role != "homeowner" && user.Role != "technician" {
 		return errors.New("only homeowners or technicians can create a profile")
 	}
@@ -36,17 +51,24 @@ func CreateProfile(profileName string, targetTemp float64, hvacMode, owner strin
 	if targetTemp < 10 || targetTemp > 35 {
 		return errors.New("temperature out of range")
 	}
-	if hvacMode != "off" && hvacMode != "heat" && hvacMode != "cool" && hvacMode != "fan" {
+	if hvacMode != "off" && hvacMode != "heat" && hvacMode != "cool" && hvacMode != "fan" && hvacMode != "auto" {
 		return errors.New("invalid HVAC mode")
 	}
+	if hvacMode == "auto" {
+		if err := ValidateAutoSetpoints(heatSetpoint, coolSetpoint); err != nil {
+			return err
+		}
+	} else {
+		heatSetpoint, coolSetpoint = 0, 0
+	}
 	// Secure check: only allow guestAccessible to be 0 or 1
 	if guestAccessible != 0 && guestAccessible != 1 {
 		return errors.New("invalid guest accessible flag (must be 0 or 1)")
 	}
 
 	_, err := db.Exec(
-		"INSERT INTO profiles (profile_name, target_temp, hvac_mode, owner, guest_accessible) VALUES (?, ?, ?, ?, ?)",
-		profileName, targetTemp, hvacMode, owner, guestAccessible,
+		"INSERT INTO profiles (profile_name, target_temp, hvac_mode, owner, guest_accessible, heat_setpoint, cool_setpoint) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		profileName, targetTemp, hvacMode, owner, guestAccessible, nullableSetpoint(heatSetpoint), nullableSetpoint(coolSetpoint),
 	)
 	if err != nil {
 		return errors.New("profile already exists or database error")
@@ -57,8 +79,8 @@ func CreateProfile(profileName string, targetTemp float64, hvacMode, owner strin
 
 func GetProfile(profileName string) (*Profile, error) {
 	var profile Profile
-	err := db.QueryRow("SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at FROM profiles WHERE profile_name = ?", profileName).
-		Scan(&profile.ID, &profile.Name, &profile.TargetTemp, &profile.HVACMode, &profile.Owner, &profile.GuestAccessible, &profile.CreatedAt)
+	err := db.QueryRow("SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at, COALESCE(heat_setpoint, 0), COALESCE(cool_setpoint, 0) FROM profiles WHERE profile_name = ?", profileName).
+		Scan(&profile.ID, &profile.Name, &profile.TargetTemp, &profile.HVACMode, &profile.Owner, &profile.GuestAccessible, &profile.CreatedAt, &profile.HeatSetpoint, &profile.CoolSetpoint)
 	if err != nil {
 		return nil, errors.New("cannot apply this profile")
 	}
@@ -71,13 +93,13 @@ func ListProfiles(owner string, user *User) ([]Profile, error) {
 
 	if user.Role == "guest" {
 		// Guests: only see guest-accessible profiles
-		rows, err = db.Query("SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at FROM profiles WHERE guest_accessible = 1")
+		rows, err = db.Query("SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at, COALESCE(heat_setpoint, 0), COALESCE(cool_setpoint, 0) FROM profiles WHERE guest_accessible = 1")
 	} else if user.Role == "technician" {
 		// Technicians: see profiles they own OR guest-accessible profiles
-		rows, err = db.Query("SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at FROM profiles WHERE owner = ? OR guest_accessible = 1", user.Username)
+		rows, err = db.Query("SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at, COALESCE(heat_setpoint, 0), COALESCE(cool_setpoint, 0) FROM profiles WHERE owner = ? OR guest_accessible = 1", user.Username)
 	} else {
 		// Homeowner/Admin: see all profiles created by owner
-		rows, err = db.Query("SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at FROM profiles")
+		rows, err = db.Query("SELECT id, profile_name, target_temp, hvac_mode, owner, guest_accessible, created_at, COALESCE(heat_setpoint, 0), COALESCE(cool_setpoint, 0) FROM profiles")
 	}
 	if err != nil {
 		return nil, err
@@ -87,7 +109,7 @@ func ListProfiles(owner string, user *User) ([]Profile, error) {
 	profiles := []Profile{}
 	for rows.Next() {
 		var p Profile
-		if err := rows.Scan(&p.ID, &p.Name, &p.TargetTemp, &p.HVACMode, &p.Owner, &p.GuestAccessible, &p.CreatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.Name, &p.TargetTemp, &p.HVACMode, &p.Owner, &p.GuestAccessible, &p.CreatedAt, &p.HeatSetpoint, &p.CoolSetpoint); err != nil {
 			continue
 		}
 		profiles = append(profiles, p)
@@ -118,7 +140,11 @@ func ApplyProfile(profileName string, user *User) error {
 	if err != nil {
 		return err
 	}
-	err = SetTargetTemperature(profile.TargetTemp, user)
+	if profile.HVACMode == "auto" {
+		err = SetAutoSetpoints(profile.HeatSetpoint, profile.CoolSetpoint, user)
+	} else {
+		err = SetTargetTemperature(profile.TargetTemp, user)
+	}
 	if err != nil {
 		return err
 	}
@@ -149,17 +175,41 @@ func DeleteProfile(profileName, username, role string) error {
 	return nil
 }
 
-func AddSchedule(profileID, dayOfWeek int, startTime, endTime string, targetTemp float64, user *User) error {
+// AddSchedule adds a schedule entry. Non-zero heatSetpoint and coolSetpoint
+// make it an auto mode entry.
+func AddSchedule(profileID, dayOfWeek int, startTime, endTime string, targetTemp, heatSetpoint, coolSetpoint float64, activeRoom string, user *User) error {
 	if user.Role != "homeowner" && user.Role != "technician" {
 		return errors.New("only homeowners or technicians can add a schedule")
 	}
 	if dayOfWeek < 0 || dayOfWeek > 6 {
 		return errors.New("invalid day of week")
 	}
+	if _, err := time.Parse("15:04", startTime); err != nil {
+		return errors.New("start time must be HH:MM")
+	}
+	if _, err := time.Parse("15:04", endTime); err != nil {
+		return errors.New("end time must be HH:MM")
+	}
+	if startTime == endTime {
+		return errors.New("start and end time must differ")
+	}
 	if targetTemp < 10 || targetTemp > 35 {
 		return errors.New("temperature out of range")
 	}
-	_, err := db.Exec("INSERT INTO schedules (profile_id, day_of_week, start_time, end_time, target_temp) VALUES (?, ?, ?, ?, ?)", profileID, dayOfWeek, startTime, endTime, targetTemp)
+	if heatSetpoint != 0 || coolSetpoint != 0 {
+		if err := ValidateAutoSetpoints(heatSetpoint, coolSetpoint); err != nil {
+			return err
+		}
+	}
+	var room interface{}
+	if activeRoom != "" {
+		if !roomSensorExists(activeRoom) {
+			return errors.New("active room sensor not found")
+		}
+		room = activeRoom
+	}
+	_, err := db.Exec("INSERT INTO schedules (profile_id, day_of_week, start_time, end_time, target_temp, heat_setpoint, cool_setpoint, active_room) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		profileID, dayOfWeek, startTime, endTime, targetTemp, nullableSetpoint(heatSetpoint), nullableSetpoint(coolSetpoint), room)
 	if err != nil {
 		return errors.New("failed to add schedule")
 	}
@@ -171,7 +221,7 @@ func GetSchedules(profileID int, user *User) ([]Schedule, error) {
 	if user.Role != "homeowner" && user.Role != "technician" {
 		return nil, errors.New("permission denied")
 	}
-	rows, err := db.Query("SELECT day_of_week, start_time, end_time, target_temp FROM schedules WHERE profile_id = ?", profileID)
+	rows, err := db.Query("SELECT day_of_week, start_time, end_time, target_temp, COALESCE(heat_setpoint, 0), COALESCE(cool_setpoint, 0), COALESCE(active_room, '') FROM schedules WHERE profile_id = ?", profileID)
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +230,7 @@ func GetSchedules(profileID int, user *User) ([]Schedule, error) {
 	var schedules []Schedule
 	for rows.Next() {
 		var s Schedule
-		err := rows.Scan(&s.DayOfWeek, &s.StartTime, &s.EndTime, &s.TargetTemp)
+		err := rows.Scan(&s.DayOfWeek, &s.StartTime, &s.EndTime, &s.TargetTemp, &s.HeatSetpoint, &s.CoolSetpoint, &s.ActiveRoom)
 		if err != nil {
 			return nil, err
 		}
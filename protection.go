@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ProtectionTimers limit how often a stage may cycle, protecting compressors
+// and burners from short-cycling.
+type ProtectionTimers struct {
+	MinOnMinutes     float64
+	MinOffMinutes    float64
+	MaxCyclesPerHour int
+}
+
+type StageProtectionStatus struct {
+	Stage          HVACMode
+	Timers         ProtectionTimers
+	CyclesLastHour int
+	LastStart      time.Time
+	LastStop       time.Time
+}
+
+type stageTracker struct {
+	lastStart time.Time
+	lastStop  time.Time
+	starts    []time.Time
+}
+
+var defaultProtectionTimers = map[HVACMode]ProtectionTimers{
+	ModeHeat: {MinOnMinutes: 3, MinOffMinutes: 3, MaxCyclesPerHour: 6},
+	ModeCool: {MinOnMinutes: 5, MinOffMinutes: 5, MaxCyclesPerHour: 4},
+}
+
+// Guarded by hvacMutex.
+var (
+	stageTrackers = map[HVACMode]*stageTracker{}
+	runningStage  HVACMode
+)
+
+func protectedStages() []HVACMode {
+	return []HVACMode{ModeHeat, ModeCool}
+}
+
+func LoadProtectionTimers(stage HVACMode) ProtectionTimers {
+	def := defaultProtectionTimers[stage]
+	prefix := "protect_" + string(stage) + "_"
+	return ProtectionTimers{
+		MinOnMinutes:     GetSettingFloat(prefix+"min_on_minutes", def.MinOnMinutes),
+		MinOffMinutes:    GetSettingFloat(prefix+"min_off_minutes", def.MinOffMinutes),
+		MaxCyclesPerHour: int(GetSettingFloat(prefix+"max_cycles_per_hour", float64(def.MaxCyclesPerHour))),
+	}
+}
+
+func SetProtectionTimers(stage HVACMode, timers ProtectionTimers, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change protection timers")
+	}
+	if _, ok := defaultProtectionTimers[stage]; !ok {
+		return errors.New("invalid equipment stage")
+	}
+	if timers.MinOnMinutes < 0 || timers.MinOnMinutes > 30 || timers.MinOffMinutes < 0 || timers.MinOffMinutes > 30 {
+		return errors.New("minimum on/off times must be 0-30 minutes")
+	}
+	if timers.MaxCyclesPerHour < 1 || timers.MaxCyclesPerHour > 20 {
+		return errors.New("max cycles per hour must be 1-20")
+	}
+	prefix := "protect_" + string(stage) + "_"
+	if err := SetSettingFloat(prefix+"min_on_minutes", timers.MinOnMinutes, user.Username); err != nil {
+		return err
+	}
+	if err := SetSettingFloat(prefix+"min_off_minutes", timers.MinOffMinutes, user.Username); err != nil {
+		return err
+	}
+	if err := SetSettingFloat(prefix+"max_cycles_per_hour", float64(timers.MaxCyclesPerHour), user.Username); err != nil {
+		return err
+	}
+	LogEvent("protection_timers", fmt.Sprintf("%s stage: min on %.0f min, min off %.0f min, max %d cycles/hour",
+		stage, timers.MinOnMinutes, timers.MinOffMinutes, timers.MaxCyclesPerHour), user.Username, "info")
+	return nil
+}
+
+func trackerFor(stage HVACMode) *stageTracker {
+	t, ok := stageTrackers[stage]
+	if !ok {
+		t = &stageTracker{}
+		stageTrackers[stage] = t
+	}
+	return t
+}
+
+func (t *stageTracker) pruneStarts(now time.Time) {
+	kept := t.starts[:0]
+	for _, s := range t.starts {
+		if now.Sub(s) < time.Hour {
+			kept = append(kept, s)
+		}
+	}
+	t.starts = kept
+}
+
+// noteRunTransition updates the stage trackers when equipment starts or
+// stops. Callers must hold hvacMutex.
+func noteRunTransition(running bool, now time.Time) {
+	if running {
+		runningStage = effectiveMode()
+		t := trackerFor(runningStage)
+		t.lastStart = now
+		t.pruneStarts(now)
+		t.starts = append(t.starts, now)
+		return
+	}
+	if runningStage != "" {
+		trackerFor(runningStage).lastStop = now
+		runningStage = ""
+	}
+}
+
+// checkStartAllowed reports whether stage may start now. When it may not, it
+// returns why and when it next could. The off-time counts from the last stop
+// of any protected stage, so a changeover between heat and cool waits out
+// the new stage's minimum off-time too.
+func checkStartAllowed(stage HVACMode, now time.Time) (bool, string, time.Time) {
+	if _, ok := defaultProtectionTimers[stage]; !ok {
+		return true, "", time.Time{}
+	}
+	timers := LoadProtectionTimers(stage)
+	t := trackerFor(stage)
+	lastStop := t.lastStop
+	for _, other := range protectedStages() {
+		if stop := trackerFor(other).lastStop; stop.After(lastStop) {
+			lastStop = stop
+		}
+	}
+	if !lastStop.IsZero() {
+		until := lastStop.Add(time.Duration(timers.MinOffMinutes * float64(time.Minute)))
+		if now.Before(until) {
+			return false, "minimum off-time", until
+		}
+	}
+	t.pruneStarts(now)
+	if len(t.starts) >= timers.MaxCyclesPerHour {
+		return false, fmt.Sprintf("max %d cycles/hour", timers.MaxCyclesPerHour), t.starts[0].Add(time.Hour)
+	}
+	return true, "", time.Time{}
+}
+
+// checkStopAllowed reports whether the running stage has met its minimum
+// on-time. Callers must hold hvacMutex.
+func checkStopAllowed(now time.Time) (bool, time.Time) {
+	if _, ok := defaultProtectionTimers[runningStage]; !ok {
+		return true, time.Time{}
+	}
+	timers := LoadProtectionTimers(runningStage)
+	until := trackerFor(runningStage).lastStart.Add(time.Duration(timers.MinOnMinutes * float64(time.Minute)))
+	if now.Before(until) {
+		return false, until
+	}
+	return true, time.Time{}
+}
+
+// setWaitState records why the controller's request is being held back and
+// logs when that reason changes. Callers must hold hvacMutex.
+func setWaitState(reason string, until time.Time) {
+	if reason != "" && reason != hvacState.WaitReason {
+		LogEvent("hvac_wait", fmt.Sprintf("Equipment %s until %s", reason, until.Format("15:04:05")), "system", "info")
+	}
+	hvacState.WaitReason = reason
+	hvacState.WaitUntil = until
+}
+
+// GetProtectionStatus returns the timers and recent cycling for each stage.
+func GetProtectionStatus() []StageProtectionStatus {
+	hvacMutex.Lock()
+	defer hvacMutex.Unlock()
+	now := time.Now()
+	statuses := []StageProtectionStatus{}
+	for _, stage := range protectedStages() {
+		t := trackerFor(stage)
+		t.pruneStarts(now)
+		statuses = append(statuses, StageProtectionStatus{
+			Stage:          stage,
+			Timers:         LoadProtectionTimers(stage),
+			CyclesLastHour: len(t.starts),
+			LastStart:      t.lastStart,
+			LastStop:       t.lastStop,
+		})
+	}
+	return statuses
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ResolutionAuto = "auto"
+	ResolutionRaw  = "raw"
+	Resolution1m   = "1m"
+	Resolution1h   = "1h"
+	Resolution1d   = "1d"
+
+	// Retention per resolution; daily rollups are kept forever.
+	RawReadingRetentionDays   = 7
+	MinuteRollupRetentionDays = 30
+	HourlyRollupRetentionDays = 365
+)
+
+type SensorHistoryPoint struct {
+	Timestamp time.Time
+	Min       float64
+	Max       float64
+	Avg       float64
+	Count     int
+}
+
+// Metric names are whitelisted here because they are interpolated as column names.
+var sensorMetricColumns = map[string]string{
+	"temperature": "temperature",
+	"humidity":    "humidity",
+	"co":          "co_level",
+}
+
+var rollupTables = map[string]string{
+	Resolution1m: "sensor_rollup_1m",
+	Resolution1h: "sensor_rollup_1h",
+	Resolution1d: "sensor_rollup_1d",
+}
+
+var rollupBucketFormats = map[string]string{
+	Resolution1m: "%Y-%m-%d %H:%M:00",
+	Resolution1h: "%Y-%m-%d %H:00:00",
+	Resolution1d: "%Y-%m-%d 00:00:00",
+}
+
+// RollupSensorReadings folds raw readings into 1-minute buckets, 1-minute
+// buckets into hourly ones, and hourly into daily. The newest bucket of each
+// table is recomputed on every run, so calling it repeatedly is safe.
+func RollupSensorReadings() error {
+	for metric, column := range sensorMetricColumns {
+		from, err := latestRollupBucket(Resolution1m, metric)
+		if err != nil {
+			return err
+		}
+		query := fmt.Sprintf(`INSERT OR REPLACE INTO sensor_rollup_1m (metric, bucket_start, min_value, max_value, avg_value, sample_count)
+			SELECT ?, strftime('%s', timestamp) AS bucket, MIN(%s), MAX(%s), AVG(%s), COUNT(%s)
+			FROM sensor_readings WHERE timestamp >= ? AND %s IS NOT NULL GROUP BY bucket`,
+			rollupBucketFormats[Resolution1m], column, column, column, column, column)
+		if _, err := db.Exec(query, metric, from); err != nil {
+			return fmt.Errorf("failed to roll up %s readings: %w", metric, err)
+		}
+		if err := rollupFrom(Resolution1m, Resolution1h, metric); err != nil {
+			return err
+		}
+		if err := rollupFrom(Resolution1h, Resolution1d, metric); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rollupFrom(source, target, metric string) error {
+	from, err := latestRollupBucket(target, metric)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf(`INSERT OR REPLACE INTO %s (metric, bucket_start, min_value, max_value, avg_value, sample_count)
+		SELECT metric, strftime('%s', bucket_start) AS bucket, MIN(min_value), MAX(max_value),
+			SUM(avg_value * sample_count) / SUM(sample_count), SUM(sample_count)
+		FROM %s WHERE metric = ? AND bucket_start >= ? GROUP BY bucket`,
+		rollupTables[target], rollupBucketFormats[target], rollupTables[source])
+	if _, err := db.Exec(query, metric, from); err != nil {
+		return fmt.Errorf("failed to build %s rollup for %s: %w", target, metric, err)
+	}
+	return nil
+}
+
+// latestRollupBucket returns the start of the newest bucket already stored,
+// or an empty string when the table has nothing for the metric yet.
+func latestRollupBucket(resolution, metric string) (string, error) {
+	var latest string
+	err := db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(bucket_start), '') FROM %s WHERE metric = ?", rollupTables[resolution]), metric).Scan(&latest)
+	if err != nil {
+		return "", err
+	}
+	return latest, nil
+}
+
+// PruneSensorHistory drops raw readings and fine-grained rollups that have
+// aged out. Rollups are refreshed first so nothing is deleted unaggregated.
+func PruneSensorHistory() error {
+	if err := RollupSensorReadings(); err != nil {
+		return err
+	}
+	now := time.Now()
+	prunes := []struct {
+		table  string
+		column string
+		days   int
+	}{
+		{"sensor_readings", "timestamp", RawReadingRetentionDays},
+		{"room_sensor_readings", "timestamp", RawReadingRetentionDays},
+		{"sensor_rollup_1m", "bucket_start", MinuteRollupRetentionDays},
+		{"sensor_rollup_1h", "bucket_start", HourlyRollupRetentionDays},
+	}
+	for _, p := range prunes {
+		cutoff := dbTime(now.AddDate(0, 0, -p.days))
+		if _, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s < ?", p.table, p.column), cutoff); err != nil {
+			return fmt.Errorf("failed to prune %s: %w", p.table, err)
+		}
+	}
+	return nil
+}
+
+// pickResolution chooses the coarsest table that still gives a useful number
+// of points for the window, then moves up if that table no longer holds data
+// as old as from.
+func pickResolution(from, to time.Time) string {
+	span := to.Sub(from)
+	resolution := Resolution1d
+	switch {
+	case span <= 6*time.Hour:
+		resolution = Resolution1m
+	case span <= 14*24*time.Hour:
+		resolution = Resolution1h
+	}
+	age := time.Since(from)
+	if resolution == Resolution1m && age > MinuteRollupRetentionDays*24*time.Hour {
+		resolution = Resolution1h
+	}
+	if resolution == Resolution1h && age > HourlyRollupRetentionDays*24*time.Hour {
+		resolution = Resolution1d
+	}
+	return resolution
+}
+
+// bucketStart floors t to the start of the rollup bucket containing it.
+// Buckets are aligned in UTC, matching strftime over CURRENT_TIMESTAMP.
+func bucketStart(t time.Time, resolution string) time.Time {
+	t = t.UTC()
+	switch resolution {
+	case Resolution1m:
+		return t.Truncate(time.Minute)
+	case Resolution1h:
+		return t.Truncate(time.Hour)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// GetSensorHistory returns the stored history of one metric between from and
+// to. Pass ResolutionAuto (or "") to let the window size pick the table.
+func GetSensorHistory(metric string, from, to time.Time, resolution string) ([]SensorHistoryPoint, error) {
+	column, ok := sensorMetricColumns[metric]
+	if !ok {
+		return nil, errors.New("invalid sensor metric")
+	}
+	if !to.After(from) {
+		return nil, errors.New("invalid history window")
+	}
+	if resolution == "" || resolution == ResolutionAuto {
+		resolution = pickResolution(from, to)
+	}
+
+	var query string
+	var args []interface{}
+	if resolution == ResolutionRaw {
+		query = fmt.Sprintf("SELECT timestamp, %s, %s, %s, 1 FROM sensor_readings WHERE timestamp >= ? AND timestamp < ? AND %s IS NOT NULL ORDER BY timestamp",
+			column, column, column, column)
+		args = []interface{}{dbTime(from), dbTime(to)}
+	} else {
+		table, ok := rollupTables[resolution]
+		if !ok {
+			return nil, errors.New("invalid history resolution")
+		}
+		query = fmt.Sprintf("SELECT bucket_start, min_value, max_value, avg_value, sample_count FROM %s WHERE metric = ? AND bucket_start >= ? AND bucket_start < ? ORDER BY bucket_start", table)
+		args = []interface{}{metric, dbTime(bucketStart(from, resolution)), dbTime(to)}
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	points := []SensorHistoryPoint{}
+	for rows.Next() {
+		var p SensorHistoryPoint
+		if err := rows.Scan(&p.Timestamp, &p.Min, &p.Max, &p.Avg, &p.Count); err != nil {
+			continue
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways of combining room sensors into the temperature the controller uses.
+const (
+	AggregateWeighted   = "weighted_average"
+	AggregateMin        = "min"
+	AggregateMax        = "max"
+	AggregateActiveRoom = "active_room"
+)
+
+const (
+	roomSensorMinTemp = -40.0
+	roomSensorMaxTemp = 60.0
+	roomSensorStale   = 5 * time.Minute
+)
+
+type RoomSensor struct {
+	ID       int
+	Name     string
+	Location string
+	Offset   float64 // °C added to every raw reading
+	Weight   float64 // share in the weighted average
+	IsActive bool
+}
+
+type RoomSensorStatus struct {
+	RoomSensor
+	Temperature float64
+	ReadAt      time.Time
+	Healthy     bool
+	ErrorCount  int
+	LastError   string
+}
+
+type roomSensorState struct {
+	raw        float64
+	reading    float64
+	readAt     time.Time
+	healthy    bool
+	errorCount int
+	lastError  string
+}
+
+var (
+	roomSensorMutex  sync.Mutex
+	roomSensorStates = map[int]*roomSensorState{}
+	controlSource    string // what the control temperature was last taken from
+)
+
+func validateRoomSensor(offset, weight float64) error {
+	if offset < -5 || offset > 5 {
+		return errors.New("calibration offset must be between -5 and 5°C")
+	}
+	if weight < 0 || weight > 10 {
+		return errors.New("weight must be 0-10")
+	}
+	return nil
+}
+
+func RegisterRoomSensor(name, location string, offset, weight float64, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can register sensors")
+	}
+	name = SanitizeInput(name)
+	location = SanitizeInput(location)
+	if len(name) < 2 || len(name) > 50 || len(location) < 2 || len(location) > 50 {
+		return errors.New("sensor name and location must be 2-50 characters")
+	}
+	if err := validateRoomSensor(offset, weight); err != nil {
+		return err
+	}
+	_, err := db.Exec("INSERT INTO room_sensors (name, location, calibration_offset, weight, created_by) VALUES (?, ?, ?, ?, ?)",
+		name, location, offset, weight, user.Username)
+	if err != nil {
+		return errors.New("failed to register sensor (name may already exist)")
+	}
+	LogEvent("sensor_register", fmt.Sprintf("Sensor %s registered in %s (offset %+.1f°C, weight %.1f)", name, location, offset, weight), user.Username, "info")
+	return nil
+}
+
+func UpdateRoomSensor(name string, offset, weight float64, active bool, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change sensors")
+	}
+	if err := validateRoomSensor(offset, weight); err != nil {
+		return err
+	}
+	result, err := db.Exec("UPDATE room_sensors SET calibration_offset = ?, weight = ?, is_active = ? WHERE name = ?",
+		offset, weight, active, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("sensor not found")
+	}
+	LogEvent("sensor_update", fmt.Sprintf("Sensor %s: offset %+.1f°C, weight %.1f, active %v", name, offset, weight, active), user.Username, "info")
+	return nil
+}
+
+func RemoveRoomSensor(name string, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can remove sensors")
+	}
+	result, err := db.Exec("DELETE FROM room_sensors WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("sensor not found")
+	}
+	if GetSetting("sensor_active_room", "") == name {
+		SetSetting("sensor_active_room", "", user.Username)
+	}
+	LogEvent("sensor_remove", "Sensor removed: "+name, user.Username, "warning")
+	return nil
+}
+
+func ListRoomSensors() ([]RoomSensor, error) {
+	rows, err := db.Query("SELECT id, name, location, calibration_offset, weight, is_active FROM room_sensors ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sensors := []RoomSensor{}
+	for rows.Next() {
+		var s RoomSensor
+		if err := rows.Scan(&s.ID, &s.Name, &s.Location, &s.Offset, &s.Weight, &s.IsActive); err != nil {
+			continue
+		}
+		sensors = append(sensors, s)
+	}
+	return sensors, nil
+}
+
+func roomSensorExists(name string) bool {
+	var id int
+	return db.QueryRow("SELECT id FROM room_sensors WHERE name = ?", name).Scan(&id) == nil
+}
+
+// GetSensorAggregate returns how room sensors are combined and, for the
+// active-room aggregate, which room is in control.
+func GetSensorAggregate() (string, string) {
+	return GetSetting("sensor_aggregate", AggregateWeighted), GetSetting("sensor_active_room", "")
+}
+
+func SetSensorAggregate(mode string, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change the sensor aggregate")
+	}
+	if mode != AggregateWeighted && mode != AggregateMin && mode != AggregateMax && mode != AggregateActiveRoom {
+		return errors.New("aggregate must be weighted_average, min, max or active_room")
+	}
+	return SetSetting("sensor_aggregate", mode, user.Username)
+}
+
+// SetActiveRoom chooses the room that controls the temperature when the
+// aggregate is active_room. Schedules switch it through the scheduler, which
+// passes its own name as username.
+func SetActiveRoom(name, username string) error {
+	if name != "" && !roomSensorExists(name) {
+		return errors.New("sensor not found")
+	}
+	if GetSetting("sensor_active_room", "") == name {
+		return nil
+	}
+	return SetSetting("sensor_active_room", name, username)
+}
+
+// readRoomSensor samples one remote sensor and applies its offset.
+func readRoomSensor(s RoomSensor, now time.Time) (float64, error) {
+	roomSensorMutex.Lock()
+	defer roomSensorMutex.Unlock()
+	st, ok := roomSensorStates[s.ID]
+	if !ok {
+		sensorMutex.RLock()
+		st = &roomSensorState{raw: lastReading.Temperature}
+		sensorMutex.RUnlock()
+		roomSensorStates[s.ID] = st
+	}
+	raw := simulatedStep(st.raw, 0.2, 16.0, 28.0)
+	if raw < roomSensorMinTemp || raw > roomSensorMaxTemp {
+		st.healthy = false
+		st.errorCount++
+		st.lastError = fmt.Sprintf("reading %.1f°C out of range", raw)
+		return 0, errors.New(st.lastError)
+	}
+	st.raw = raw
+	st.reading = raw + s.Offset
+	st.readAt = now
+	st.healthy = true
+	st.lastError = ""
+	db.Exec("INSERT INTO room_sensor_readings (sensor_id, temperature) VALUES (?, ?)", s.ID, st.reading)
+	return st.reading, nil
+}
+
+type roomReading struct {
+	Sensor RoomSensor
+	Temp   float64
+}
+
+// aggregateTemperatures combines the healthy readings. For active_room it
+// falls back to the weighted average if that room has no reading.
+func aggregateTemperatures(readings []roomReading, mode, activeRoom string) (float64, error) {
+	if len(readings) == 0 {
+		return 0, errors.New("no healthy room sensors")
+	}
+	switch mode {
+	case AggregateMin, AggregateMax:
+		v := readings[0].Temp
+		for _, r := range readings[1:] {
+			if mode == AggregateMin {
+				v = math.Min(v, r.Temp)
+			} else {
+				v = math.Max(v, r.Temp)
+			}
+		}
+		return v, nil
+	case AggregateActiveRoom:
+		for _, r := range readings {
+			if r.Sensor.Name == activeRoom {
+				return r.Temp, nil
+			}
+		}
+	}
+	sum, weights := 0.0, 0.0
+	for _, r := range readings {
+		sum += r.Temp * r.Sensor.Weight
+		weights += r.Sensor.Weight
+	}
+	if weights == 0 {
+		return 0, errors.New("room sensor weights are all zero")
+	}
+	return sum / weights, nil
+}
+
+// aggregateSource identifies the sensors, offsets and weights the aggregate
+// is taken from: the chosen sensor for min, max and active_room, otherwise
+// every reading. When it changes, the control temperature steps by the gap
+// between rooms.
+func aggregateSource(readings []roomReading, mode, activeRoom string) string {
+	used := readings
+	switch mode {
+	case AggregateMin, AggregateMax:
+		for i, r := range readings {
+			if i == 0 || (mode == AggregateMin && r.Temp < used[0].Temp) || (mode == AggregateMax && r.Temp > used[0].Temp) {
+				used = readings[i : i+1]
+			}
+		}
+	case AggregateActiveRoom:
+		for i, r := range readings {
+			if r.Sensor.Name == activeRoom {
+				used = readings[i : i+1]
+			}
+		}
+	}
+	parts := []string{mode}
+	for _, r := range used {
+		parts = append(parts, fmt.Sprintf("%d/%g/%g", r.Sensor.ID, r.Sensor.Offset, r.Sensor.Weight))
+	}
+	return strings.Join(parts, " ")
+}
+
+// noteControlSource records where the control temperature comes from and
+// marks a break in the stored temperature when that changes, so the step
+// between rooms is not judged a spike.
+func noteControlSource(source string) {
+	roomSensorMutex.Lock()
+	changed := controlSource != source
+	controlSource = source
+	roomSensorMutex.Unlock()
+	if changed {
+		markSensorBreak("temperature")
+	}
+}
+
+// ReadControlTemperature returns the temperature the controller acts on.
+// With no room sensors registered this is the thermostat's own sensor;
+// otherwise the healthy room sensors are combined with the configured
+// aggregate and the result is recorded as the current reading.
+func ReadControlTemperature() (float64, error) {
+	sensors, err := ListRoomSensors()
+	if err != nil {
+		return 0, err
+	}
+	active := []RoomSensor{}
+	for _, s := range sensors {
+		if s.IsActive {
+			active = append(active, s)
+		}
+	}
+	if len(active) == 0 {
+		noteControlSource("thermostat")
+		return ReadTemperature()
+	}
+
+	sensorMutex.RLock()
+	healthy := sensorHealth
+	sensorMutex.RUnlock()
+	if !healthy {
+		return 0, errors.New("sensor malfunction")
+	}
+
+	now := time.Now()
+	readings := []roomReading{}
+	for _, s := range active {
+		temp, err := readRoomSensor(s, now)
+		if err != nil {
+			LogEvent("sensor_error", fmt.Sprintf("Sensor %s: %v", s.Name, err), "system", "warning")
+			continue
+		}
+		readings = append(readings, roomReading{Sensor: s, Temp: temp})
+	}
+	mode, room := GetSensorAggregate()
+	temp, err := aggregateTemperatures(readings, mode, room)
+	if err != nil {
+		return 0, err
+	}
+	noteControlSource(aggregateSource(readings, mode, room))
+	storeTemperature(temp)
+	return temp, nil
+}
+
+// GetRoomSensorStatuses reports the latest reading and health of every
+// registered sensor.
+func GetRoomSensorStatuses() ([]RoomSensorStatus, error) {
+	sensors, err := ListRoomSensors()
+	if err != nil {
+		return nil, err
+	}
+	roomSensorMutex.Lock()
+	defer roomSensorMutex.Unlock()
+	statuses := []RoomSensorStatus{}
+	for _, s := range sensors {
+		status := RoomSensorStatus{RoomSensor: s}
+		if st, ok := roomSensorStates[s.ID]; ok {
+			status.Temperature = st.reading
+			status.ReadAt = st.readAt
+			status.Healthy = st.healthy && time.Since(st.readAt) < roomSensorStale
+			status.ErrorCount = st.errorCount
+			status.LastError = st.lastError
+			if !status.Healthy && status.LastError == "" && s.IsActive {
+				status.LastError = "no recent reading"
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	runtimeRiseThreshold  = 0.2 // week-over-week runtime rise flagged as an anomaly
+	runtimeMinRise        = 60  // minutes; smaller rises are noise
+	runtimeSimilarOutdoor = 2.0 // °C between weekly outdoor means to compare runtime
+	runtimeWeekMinDays    = 4   // days with outdoor history needed to compare a week
+)
+
+// equipmentRun is one continuous run in a mode, merged from the metered
+// intervals it was split into by stage changes.
+type equipmentRun struct {
+	Start time.Time
+	End   time.Time
+	Mode  string
+}
+
+func (r equipmentRun) Minutes() float64 {
+	return r.End.Sub(r.Start).Minutes()
+}
+
+// ModeRuntime is how hard one mode worked over a period. Time to setpoint
+// is measured from the start of a heating or cooling run until the indoor
+// temperature reached the target the controller was heading for, after
+// setback, eco, forecast, vacation and overcool adjustments.
+type ModeRuntime struct {
+	Mode              string
+	Cycles            int
+	RuntimeMinutes    float64
+	AvgCycleMinutes   float64
+	LongestRunMinutes float64
+	LongestRunStart   time.Time
+	DutyCycle         float64 // percent of the period spent running
+	SetpointReached   int     // runs that reached the target
+	SetpointMissed    int     // runs that stopped short of it
+	AvgToSetpoint     float64 // minutes, over the runs that reached it
+}
+
+// DailyRuntime is one local day of equipment runtime. OutdoorMean is only
+// meaningful when HasWeather is set.
+type DailyRuntime struct {
+	Date           string
+	Cycles         int
+	RuntimeMinutes float64
+	DutyCycle      float64
+	HasWeather     bool
+	OutdoorMean    float64
+}
+
+// RuntimeAnomaly is a mode whose runtime rose week over week while the
+// outdoor temperature stayed similar, so the equipment is delivering less
+// for the same load.
+type RuntimeAnomaly struct {
+	Mode        string
+	ThisWeek    float64 // runtime minutes in the last 7 complete days
+	LastWeek    float64
+	ThisOutdoor float64
+	LastOutdoor float64
+	Rise        float64 // fraction
+	Weeks       int     // consecutive weeks the runtime has risen
+}
+
+func (a RuntimeAnomaly) String() string {
+	trend := "week over week"
+	if a.Weeks > 1 {
+		trend = fmt.Sprintf("for %d weeks running", a.Weeks)
+	}
+	return fmt.Sprintf("%s runtime up %.0f%% %s (%.1f h vs %.1f h) at similar outdoor temperatures (%.1f°C vs %.1f°C): likely a clogged filter or refrigerant problem",
+		modeLabel(a.Mode), a.Rise*100, trend, a.ThisWeek/60, a.LastWeek/60, a.ThisOutdoor, a.LastOutdoor)
+}
+
+// RuntimeReport is the equipment duty-cycle report for a period.
+type RuntimeReport struct {
+	From      time.Time
+	To        time.Time
+	Modes     []ModeRuntime
+	Daily     []DailyRuntime
+	Anomalies []RuntimeAnomaly
+}
+
+// GetRuntimeReport reports on the last days local days, today included.
+func GetRuntimeReport(days int, user *User) (RuntimeReport, error) {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return RuntimeReport{}, errors.New("only homeowners or technicians can view runtime reports")
+	}
+	if days < 1 || days > 90 {
+		return RuntimeReport{}, errors.New("report must cover 1-90 days")
+	}
+	return BuildRuntimeReport(days, time.Now())
+}
+
+func BuildRuntimeReport(days int, now time.Time) (RuntimeReport, error) {
+	local := now.Local()
+	from := time.Date(local.Year(), local.Month(), local.Day()-days+1, 0, 0, 0, 0, time.Local)
+	report := RuntimeReport{From: from, To: now}
+	runs, err := equipmentRuns(from, now)
+	if err != nil {
+		return report, err
+	}
+	if report.Modes, err = modeRuntimes(runs, from, now); err != nil {
+		return report, err
+	}
+	means, err := dailyOutdoorMeans(from, now)
+	if err != nil {
+		return report, err
+	}
+	for start := from; start.Before(now); start = start.AddDate(0, 0, 1) {
+		end := start.AddDate(0, 0, 1)
+		if end.After(now) {
+			end = now
+		}
+		day := DailyRuntime{Date: start.Format("2006-01-02")}
+		for _, r := range runs {
+			if !r.Start.Before(start) && r.Start.Before(end) {
+				day.Cycles++
+			}
+			day.RuntimeMinutes += overlapMinutes(r, start, end)
+		}
+		day.DutyCycle = day.RuntimeMinutes / end.Sub(start).Minutes() * 100
+		day.OutdoorMean, day.HasWeather = means[day.Date]
+		report.Daily = append(report.Daily, day)
+	}
+	report.Anomalies, err = DetectRuntimeAnomalies(now)
+	return report, err
+}
+
+// equipmentRuns merges the metered intervals in [from, to) into runs.
+// Intervals continue a run when they follow on without a gap in the same mode.
+func equipmentRuns(from, to time.Time) ([]equipmentRun, error) {
+	intervals, err := meteredIntervals(from, to)
+	if err != nil {
+		return nil, err
+	}
+	runs := []equipmentRun{}
+	for _, m := range intervals {
+		if n := len(runs); n > 0 && runs[n-1].Mode == m.Mode && !m.Start.After(runs[n-1].End) {
+			if m.End.After(runs[n-1].End) {
+				runs[n-1].End = m.End
+			}
+			continue
+		}
+		runs = append(runs, equipmentRun{Start: m.Start, End: m.End, Mode: m.Mode})
+	}
+	return runs, nil
+}
+
+func overlapMinutes(r equipmentRun, from, to time.Time) float64 {
+	start, end := r.Start, r.End
+	if from.After(start) {
+		start = from
+	}
+	if to.Before(end) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return end.Sub(start).Minutes()
+}
+
+// modeRuntimes totals runs by mode, heat first.
+func modeRuntimes(runs []equipmentRun, from, to time.Time) ([]ModeRuntime, error) {
+	targets, err := loadRunTargets(from, to)
+	if err != nil {
+		return nil, err
+	}
+	temps, err := runTemperatures(from, to)
+	if err != nil {
+		return nil, err
+	}
+	byMode := map[string]*ModeRuntime{}
+	toSetpoint := map[string]float64{}
+	for _, r := range runs {
+		m, ok := byMode[r.Mode]
+		if !ok {
+			m = &ModeRuntime{Mode: r.Mode}
+			byMode[r.Mode] = m
+		}
+		minutes := r.Minutes()
+		m.Cycles++
+		m.RuntimeMinutes += minutes
+		if minutes > m.LongestRunMinutes {
+			m.LongestRunMinutes, m.LongestRunStart = minutes, r.Start
+		}
+		if r.Mode != string(ModeHeat) && r.Mode != string(ModeCool) {
+			continue
+		}
+		target, ok := runTarget(targets, r.Start)
+		if !ok {
+			continue
+		}
+		samples := samplesBetween(temps, r.Start, r.End.Add(time.Second))
+		if len(samples) == 0 {
+			// No temperature history is left for this run
+			continue
+		}
+		if reached, ok := timeToSetpoint(r, target, samples); ok {
+			m.SetpointReached++
+			toSetpoint[r.Mode] += reached
+		} else {
+			m.SetpointMissed++
+		}
+	}
+
+	period := to.Sub(from).Minutes()
+	modes := []ModeRuntime{}
+	for _, m := range byMode {
+		m.AvgCycleMinutes = m.RuntimeMinutes / float64(m.Cycles)
+		m.DutyCycle = m.RuntimeMinutes / period * 100
+		if m.SetpointReached > 0 {
+			m.AvgToSetpoint = toSetpoint[m.Mode] / float64(m.SetpointReached)
+		}
+		modes = append(modes, *m)
+	}
+	order := map[string]int{string(ModeHeat): 0, string(ModeCool): 1, string(ModeFan): 2}
+	sort.Slice(modes, func(i, j int) bool { return order[modes[i].Mode] < order[modes[j].Mode] })
+	return modes, nil
+}
+
+type targetSample struct {
+	At     time.Time
+	Target float64
+	Known  bool
+}
+
+// loadRunTargets returns the controlled target history from hvac_state,
+// preceded by the target in force at from. Rows written before the target
+// was recorded only hold the raw setpoint, which is used outside auto mode.
+func loadRunTargets(from, to time.Time) ([]targetSample, error) {
+	rows, err := db.Query(`SELECT id, timestamp, mode, COALESCE(target_temp, 0), control_target FROM (
+			SELECT id, timestamp, mode, target_temp, control_target FROM hvac_state WHERE timestamp < ? ORDER BY timestamp DESC, id DESC LIMIT 1
+		) UNION ALL SELECT id, timestamp, mode, COALESCE(target_temp, 0), control_target FROM hvac_state WHERE timestamp >= ? AND timestamp < ?
+		ORDER BY timestamp, id`, dbTime(from), dbTime(from), dbTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	targets := []targetSample{}
+	for rows.Next() {
+		var id int
+		var t targetSample
+		var mode string
+		var control sql.NullFloat64
+		if err := rows.Scan(&id, &t.At, &mode, &t.Target, &control); err != nil {
+			continue
+		}
+		if control.Valid {
+			t.Target, t.Known = control.Float64, true
+		} else {
+			// Auto mode records the middle of its band, not the setpoint a run heads for
+			t.Known = mode != string(ModeAuto) && t.Target > 0
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// runTarget is the target in force when a run started.
+func runTarget(targets []targetSample, at time.Time) (float64, bool) {
+	found := false
+	var t targetSample
+	for _, candidate := range targets {
+		if candidate.At.After(at) {
+			break
+		}
+		t, found = candidate, true
+	}
+	return t.Target, found && t.Known
+}
+
+// runTemperatures returns the indoor temperature over [from, to) for timing
+// runs: raw readings while they are kept, minute rollups before that.
+func runTemperatures(from, to time.Time) ([]tempSample, error) {
+	temps := []tempSample{}
+	rawFrom := time.Now().AddDate(0, 0, -RawReadingRetentionDays)
+	if from.Before(rawFrom) {
+		end := rawFrom
+		if to.Before(end) {
+			end = to
+		}
+		points, err := GetSensorHistory("temperature", from, end, Resolution1m)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range points {
+			temps = append(temps, tempSample{At: p.Timestamp, Temp: p.Avg})
+		}
+		from = end
+	}
+	if !from.Before(to) {
+		return temps, nil
+	}
+	raw, err := loadTemperatureSamples(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return append(temps, raw...), nil
+}
+
+// timeToSetpoint is the minutes from the start of r until the indoor
+// temperature reached target, if it did before the run ended. samples are
+// the readings taken during the run.
+func timeToSetpoint(r equipmentRun, target float64, samples []tempSample) (float64, bool) {
+	for _, s := range samples {
+		if (r.Mode == string(ModeHeat) && s.Temp >= target) || (r.Mode == string(ModeCool) && s.Temp <= target) {
+			return s.At.Sub(r.Start).Minutes(), true
+		}
+	}
+	return 0, false
+}
+
+// DetectRuntimeAnomalies compares heating and cooling runtime over the last
+// three 7-day weeks of complete days and flags a mode whose runtime rose in
+// the latest week at a similar outdoor temperature. Weeks without enough
+// outdoor history are not compared.
+func DetectRuntimeAnomalies(now time.Time) ([]RuntimeAnomaly, error) {
+	local := now.Local()
+	end := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.Local)
+	start := end.AddDate(0, 0, -21)
+	runs, err := equipmentRuns(start, end)
+	if err != nil {
+		return nil, err
+	}
+	means, err := dailyOutdoorMeans(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	type week struct {
+		runtime    map[string]float64
+		outdoor    float64
+		hasWeather bool
+	}
+	weeks := make([]week, 3) // oldest first
+	for i := range weeks {
+		from, to := start.AddDate(0, 0, 7*i), start.AddDate(0, 0, 7*(i+1))
+		w := week{runtime: map[string]float64{}}
+		for _, r := range runs {
+			w.runtime[r.Mode] += overlapMinutes(r, from, to)
+		}
+		sum, n := 0.0, 0
+		for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+			if mean, ok := means[day.Format("2006-01-02")]; ok {
+				sum += mean
+				n++
+			}
+		}
+		if n >= runtimeWeekMinDays {
+			w.outdoor, w.hasWeather = sum/float64(n), true
+		}
+		weeks[i] = w
+	}
+
+	rose := func(mode string, before, after week) bool {
+		return before.hasWeather && after.hasWeather &&
+			math.Abs(after.outdoor-before.outdoor) <= runtimeSimilarOutdoor &&
+			after.runtime[mode]-before.runtime[mode] >= runtimeMinRise &&
+			after.runtime[mode] >= before.runtime[mode]*(1+runtimeRiseThreshold)
+	}
+	anomalies := []RuntimeAnomaly{}
+	for _, mode := range []string{string(ModeHeat), string(ModeCool)} {
+		last, this := weeks[1], weeks[2]
+		if !rose(mode, last, this) {
+			continue
+		}
+		a := RuntimeAnomaly{
+			Mode:        mode,
+			ThisWeek:    this.runtime[mode],
+			LastWeek:    last.runtime[mode],
+			ThisOutdoor: this.outdoor,
+			LastOutdoor: last.outdoor,
+			Weeks:       1,
+		}
+		a.Rise = a.ThisWeek/a.LastWeek - 1
+		if a.LastWeek == 0 {
+			a.Rise = 1
+		}
+		if rose(mode, weeks[0], last) {
+			a.Weeks = 2
+		}
+		anomalies = append(anomalies, a)
+	}
+	return anomalies, nil
+}
+
+// modeLabel names a mode for reports.
+func modeLabel(mode string) string {
+	switch mode {
+	case string(ModeHeat):
+		return "Heating"
+	case string(ModeCool):
+		return "Cooling"
+	case string(ModeFan):
+		return "Fan"
+	}
+	return mode
+}
+
+func FormatRuntimeReport(r RuntimeReport) string {
+	output := "=== EQUIPMENT RUNTIME REPORT ===\n"
+	output += fmt.Sprintf("Period: %s to %s\n\n", r.From.Format("2006-01-02"), r.To.Format("2006-01-02 15:04"))
+	output += "By Mode:\n"
+	if len(r.Modes) == 0 {
+		output += "  No runtime recorded\n"
+	}
+	days := math.Max(1, r.To.Sub(r.From).Hours()/24)
+	for _, m := range r.Modes {
+		output += fmt.Sprintf("  %s: %d cycles (%.1f/day), %.0f min running, duty cycle %.1f%%\n",
+			modeLabel(m.Mode), m.Cycles, float64(m.Cycles)/days, m.RuntimeMinutes, m.DutyCycle)
+		output += fmt.Sprintf("    Average cycle %.1f min, longest run %.0f min from %s\n",
+			m.AvgCycleMinutes, m.LongestRunMinutes, m.LongestRunStart.Local().Format("01-02 15:04"))
+		if m.SetpointReached+m.SetpointMissed > 0 {
+			output += fmt.Sprintf("    Time to setpoint %.1f min on average (%d reached, %d stopped short)\n",
+				m.AvgToSetpoint, m.SetpointReached, m.SetpointMissed)
+		}
+	}
+	output += "\nDaily:\n"
+	output += fmt.Sprintf("  %-10s  %6s  %9s  %6s  %7s\n", "Date", "Cycles", "Runtime", "Duty", "Outdoor")
+	for _, d := range r.Daily {
+		outdoor := "-"
+		if d.HasWeather {
+			outdoor = fmt.Sprintf("%.1f°C", d.OutdoorMean)
+		}
+		output += fmt.Sprintf("  %-10s  %6d  %5.0f min  %5.1f%%  %7s\n", d.Date, d.Cycles, d.RuntimeMinutes, d.DutyCycle, outdoor)
+	}
+	if len(r.Anomalies) > 0 {
+		output += "\nAnomalies:\n"
+		for _, a := range r.Anomalies {
+			output += "  - " + a.String() + "\n"
+		}
+	}
+	return output
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// coThreshold is one point of a UL 2034-style alarm curve: the alarm trips
+// once the time-weighted average over Window reaches PPM.
+type coThreshold struct {
+	PPM    float64
+	Window time.Duration
+}
+
+var coThresholds = []coThreshold{
+	{PPM: 400, Window: 4 * time.Minute},
+	{PPM: 150, Window: 10 * time.Minute},
+	{PPM: 70, Window: 60 * time.Minute},
+}
+
+const (
+	coClearPPM           = 30.0 // level the air must fall below before an alarm can be acknowledged
+	coEscalationInterval = 5 * time.Minute
+	coTechnicianEscalate = 15 * time.Minute // unacknowledged alarms are also sent to technicians after this
+
+	SafetyOverrideCO     = "co_alarm"
+	SafetyOverrideFreeze = "freeze"
+	SafetyOverrideSensor = "sensor_fault"
+
+	DefaultFreezeLimit   = 7.0  // °C below which heat is forced on in any mode
+	DefaultOverheatLimit = 32.0 // °C above which homeowners are alerted
+	freezeRecovery       = 3.0  // °C above the freeze limit forced heat holds to
+	overheatRecovery     = 2.0  // °C below the overheat limit before the alert re-arms
+)
+
+type coSample struct {
+	Timestamp time.Time
+	PPM       float64
+}
+
+type COAlarm struct {
+	ID        int64
+	Active    bool
+	TrippedAt time.Time
+	PeakPPM   float64
+	Threshold string
+	LastPPM   float64
+}
+
+type SafetyLimits struct {
+	FreezeLimit   float64
+	OverheatLimit float64
+}
+
+var (
+	safetyMutex  sync.Mutex
+	coSamples    []coSample
+	coAlarm      COAlarm
+	lastCONotice time.Time
+
+	// Guarded by hvacMutex.
+	overheatAlerted bool
+)
+
+// InitializeSafety restores a CO alarm that was still latched when the
+// thermostat last shut down. It must run after InitializeHVAC.
+func InitializeSafety() error {
+	var alarm COAlarm
+	err := db.QueryRow(`SELECT id, tripped_at, peak_ppm, threshold FROM co_alarms
+		WHERE acknowledged_at IS NULL ORDER BY id DESC LIMIT 1`).Scan(&alarm.ID, &alarm.TrippedAt, &alarm.PeakPPM, &alarm.Threshold)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	alarm.Active = true
+	safetyMutex.Lock()
+	coAlarm = alarm
+	safetyMutex.Unlock()
+
+	hvacMutex.Lock()
+	applyCOVentilation()
+	hvacMutex.Unlock()
+	LogEvent("co_alarm", "CO alarm still latched from previous session", "system", "critical")
+	return nil
+}
+
+// timeWeightedCO averages the samples over the window, weighting each by how
+// long it was the latest reading. It reports false if the samples do not yet
+// cover the whole window. Callers must hold safetyMutex.
+func timeWeightedCO(window time.Duration, now time.Time) (float64, bool) {
+	start := now.Add(-window)
+	if len(coSamples) == 0 || coSamples[0].Timestamp.After(start) {
+		return 0, false
+	}
+	total := 0.0
+	for i, s := range coSamples {
+		from, to := s.Timestamp, now
+		if i+1 < len(coSamples) {
+			to = coSamples[i+1].Timestamp
+		}
+		if to.Before(start) {
+			continue
+		}
+		if from.Before(start) {
+			from = start
+		}
+		total += s.PPM * to.Sub(from).Seconds()
+	}
+	return total / window.Seconds(), true
+}
+
+// EvaluateCO records a CO reading and trips the alarm if any threshold on
+// the alarm curve has been reached.
+func EvaluateCO(ppm float64, now time.Time) {
+	safetyMutex.Lock()
+	coSamples = append(coSamples, coSample{Timestamp: now, PPM: ppm})
+	// Keep one sample older than the longest window so it stays covered
+	longest := coThresholds[len(coThresholds)-1].Window
+	for len(coSamples) > 1 && now.Sub(coSamples[1].Timestamp) >= longest {
+		coSamples = coSamples[1:]
+	}
+	coAlarm.LastPPM = ppm
+	if coAlarm.Active {
+		if ppm > coAlarm.PeakPPM {
+			coAlarm.PeakPPM = ppm
+			db.Exec("UPDATE co_alarms SET peak_ppm = ? WHERE id = ?", ppm, coAlarm.ID)
+		}
+		safetyMutex.Unlock()
+		escalateCOAlarm(now)
+		return
+	}
+	var tripped *coThreshold
+	for i, th := range coThresholds {
+		if avg, ok := timeWeightedCO(th.Window, now); ok && avg >= th.PPM {
+			tripped = &coThresholds[i]
+			break
+		}
+	}
+	if tripped == nil {
+		safetyMutex.Unlock()
+		return
+	}
+	threshold := fmt.Sprintf("%.0f ppm for %.0f min", tripped.PPM, tripped.Window.Minutes())
+	result, err := db.Exec("INSERT INTO co_alarms (tripped_at, peak_ppm, threshold) VALUES (?, ?, ?)", dbTime(now), ppm, threshold)
+	var id int64
+	if err == nil {
+		id, _ = result.LastInsertId()
+	}
+	coAlarm = COAlarm{ID: id, Active: true, TrippedAt: now, PeakPPM: ppm, Threshold: threshold, LastPPM: ppm}
+	lastCONotice = now
+	safetyMutex.Unlock()
+
+	LogEvent("co_alarm", fmt.Sprintf("CO alarm tripped at %.1f ppm (%s): HVAC shut down, ventilating", ppm, threshold), "system", "critical")
+	hvacMutex.Lock()
+	applyCOVentilation()
+	hvacMutex.Unlock()
+	notifyCOAlarm(ppm, "homeowner")
+}
+
+// applyCOVentilation shuts down heating and cooling at once, ignoring the
+// protection timers, and runs the fan. Callers must hold hvacMutex.
+func applyCOVentilation() {
+	if hvacState.ForcedMode == ModeFan && hvacState.IsRunning {
+		return
+	}
+	if hvacState.IsRunning {
+		hvacState.IsRunning = false
+		hvacState.Stage, hvacState.AuxHeat = 0, false
+		recordHVACState()
+	}
+	setWaitState("", time.Time{})
+	hvacState.SafetyOverride = SafetyOverrideCO
+	hvacState.ForcedMode = ModeFan
+	hvacState.IsRunning = true
+	SetOutput(OutputHumidifier, false, "CO alarm")
+	SetOutput(OutputDehumidifier, false, "CO alarm")
+	recordHVACState()
+}
+
+// activeUsernames lists the active accounts with the given role.
+func activeUsernames(role string) ([]string, error) {
+	rows, err := db.Query("SELECT username FROM users WHERE role = ? AND is_active = 1", role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if rows.Scan(&username) == nil {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames, nil
+}
+
+func notifyCOAlarm(ppm float64, roles ...string) {
+	for _, role := range roles {
+		usernames, err := activeUsernames(role)
+		if err != nil {
+			LogEvent("co_alarm", "Could not look up users to notify: "+err.Error(), "system", "critical")
+			continue
+		}
+		for _, username := range usernames {
+			SendCOAlert(username, ppm)
+		}
+	}
+}
+
+// escalateCOAlarm repeats the alert while the alarm is unacknowledged,
+// widening it to technicians if nobody has responded.
+func escalateCOAlarm(now time.Time) {
+	safetyMutex.Lock()
+	if !coAlarm.Active || now.Sub(lastCONotice) < coEscalationInterval {
+		safetyMutex.Unlock()
+		return
+	}
+	lastCONotice = now
+	ppm, since := coAlarm.PeakPPM, now.Sub(coAlarm.TrippedAt)
+	safetyMutex.Unlock()
+
+	roles := []string{"homeowner"}
+	if since >= coTechnicianEscalate {
+		roles = append(roles, "technician")
+	}
+	LogEvent("co_alarm", fmt.Sprintf("CO alarm unacknowledged for %.0f min, re-notifying", since.Minutes()), "system", "critical")
+	notifyCOAlarm(ppm, roles...)
+}
+
+// AcknowledgeCOAlarm clears a latched CO alarm and returns the HVAC to normal
+// control. Only homeowners may acknowledge, and only once the air is clear.
+func AcknowledgeCOAlarm(user *User) error {
+	if user.Role != "homeowner" {
+		AuditSecurityEvent("co_override_denied", "CO alarm acknowledge attempted by "+user.Role, user.Username)
+		return errors.New("only homeowners can acknowledge a CO alarm")
+	}
+	safetyMutex.Lock()
+	if !coAlarm.Active {
+		safetyMutex.Unlock()
+		return errors.New("no CO alarm is active")
+	}
+	if coAlarm.LastPPM >= coClearPPM {
+		safetyMutex.Unlock()
+		return fmt.Errorf("CO level still %.1f ppm; ventilate until below %.0f ppm", coAlarm.LastPPM, coClearPPM)
+	}
+	db.Exec("UPDATE co_alarms SET acknowledged_by = ?, acknowledged_at = CURRENT_TIMESTAMP WHERE id = ?", user.Username, coAlarm.ID)
+	coAlarm = COAlarm{LastPPM: coAlarm.LastPPM}
+	coSamples = nil
+	safetyMutex.Unlock()
+
+	hvacMutex.Lock()
+	if hvacState.SafetyOverride == SafetyOverrideCO {
+		if hvacState.IsRunning {
+			hvacState.IsRunning = false
+		}
+		hvacState.SafetyOverride = ""
+		hvacState.ForcedMode = ""
+		controlStrategy.Reset()
+		recordHVACState()
+	}
+	hvacMutex.Unlock()
+	LogEvent("co_alarm_ack", "CO alarm acknowledged, normal HVAC control resumed", user.Username, "warning")
+	return nil
+}
+
+func GetCOAlarm() COAlarm {
+	safetyMutex.Lock()
+	defer safetyMutex.Unlock()
+	return coAlarm
+}
+
+// COAlarmActive reports whether the CO interlock is holding the HVAC.
+func COAlarmActive() bool {
+	return GetCOAlarm().Active
+}
+
+func LoadSafetyLimits() SafetyLimits {
+	return SafetyLimits{
+		FreezeLimit:   GetSettingFloat("safety_freeze_limit", DefaultFreezeLimit),
+		OverheatLimit: GetSettingFloat("safety_overheat_limit", DefaultOverheatLimit),
+	}
+}
+
+func SetSafetyLimits(limits SafetyLimits, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can change safety limits")
+	}
+	if limits.FreezeLimit < 4 || limits.FreezeLimit > 12 {
+		return errors.New("freeze limit must be 4-12°C")
+	}
+	if limits.OverheatLimit < 28 || limits.OverheatLimit > 40 {
+		return errors.New("overheat limit must be 28-40°C")
+	}
+	if err := SetSettingFloat("safety_freeze_limit", limits.FreezeLimit, user.Username); err != nil {
+		return err
+	}
+	return SetSettingFloat("safety_overheat_limit", limits.OverheatLimit, user.Username)
+}
+
+// notifySafetyOverride records a safety_override event and alerts every
+// homeowner.
+func notifySafetyOverride(message string) {
+	LogEvent("safety_override", message, "system", "critical")
+	usernames, err := activeUsernames("homeowner")
+	if err != nil {
+		LogEvent("safety_override", "Could not look up users to notify: "+err.Error(), "system", "critical")
+		return
+	}
+	for _, username := range usernames {
+		SendSystemAlert(username, "SAFETY: "+message)
+	}
+}
+
+// checkTemperatureSafety enforces the absolute temperature limits on every
+// control tick, whatever the mode or who set it. Below the freeze limit heat
+// is forced on until the home has recovered; above the overheat limit
+// homeowners are alerted once per excursion. Callers must hold hvacMutex.
+func checkTemperatureSafety(current float64) {
+	limits := LoadSafetyLimits()
+
+	switch {
+	case hvacState.SafetyOverride == "" && current < limits.FreezeLimit:
+		if hvacState.IsRunning {
+			hvacState.IsRunning = false
+			hvacState.Stage, hvacState.AuxHeat = 0, false
+			recordHVACState()
+		}
+		hvacState.SafetyOverride = SafetyOverrideFreeze
+		hvacState.ForcedMode = ModeHeat
+		controlStrategy.Reset()
+		notifySafetyOverride(fmt.Sprintf("Indoor temperature %.1f°C is below the %.1f°C freeze limit; forcing heat on (mode %s)",
+			current, limits.FreezeLimit, hvacState.Mode))
+	case hvacState.SafetyOverride == SafetyOverrideFreeze && current >= freezeTarget(limits):
+		if hvacState.IsRunning {
+			hvacState.IsRunning = false
+			hvacState.Stage, hvacState.AuxHeat = 0, false
+		}
+		hvacState.SafetyOverride = ""
+		hvacState.ForcedMode = ""
+		controlStrategy.Reset()
+		recordHVACState()
+		notifySafetyOverride(fmt.Sprintf("Indoor temperature recovered to %.1f°C; freeze protection released, returning to %s mode",
+			current, hvacState.Mode))
+	}
+
+	if !overheatAlerted && current > limits.OverheatLimit {
+		overheatAlerted = true
+		notifySafetyOverride(fmt.Sprintf("Indoor temperature %.1f°C is above the %.1f°C high-temperature limit (mode %s, target %.1f°C)",
+			current, limits.OverheatLimit, hvacState.Mode, hvacState.TargetTemp))
+	} else if overheatAlerted && current < limits.OverheatLimit-overheatRecovery {
+		overheatAlerted = false
+		LogEvent("safety_override", fmt.Sprintf("Indoor temperature back to %.1f°C; high-temperature alert cleared", current), "system", "info")
+	}
+}
+
+// freezeTarget is the temperature forced heat holds the home at.
+func freezeTarget(limits SafetyLimits) float64 {
+	return limits.FreezeLimit + freezeRecovery
+}
+
+// checkSensorFailSafe shuts the equipment down while the temperature sensor
+// is stuck or spiking, since the setpoint cannot be trusted, and releases it
+// once the fault clears. Freeze protection still runs on the fallback
+// temperature: when that is below the freeze limit, or forced heat is already
+// on, the hold gives way to it. Drift alone only alerts, since the readings
+// still track the room. It reports whether the equipment is being held off.
+// Callers must hold hvacMutex.
+func checkSensorFailSafe(fallback float64) bool {
+	degraded := sensorUnreliable("temperature")
+	freezing := hvacState.SafetyOverride == SafetyOverrideFreeze || fallback < LoadSafetyLimits().FreezeLimit
+	hold := degraded && !freezing
+	switch {
+	case hold && hvacState.SafetyOverride != SafetyOverrideSensor:
+		if hvacState.IsRunning {
+			hvacState.IsRunning = false
+			hvacState.Stage, hvacState.AuxHeat = 0, false
+		}
+		setWaitState("", time.Time{})
+		hvacState.SafetyOverride = SafetyOverrideSensor
+		hvacState.ForcedMode = ModeOff
+		recordHVACState()
+		notifySafetyOverride("Temperature sensor degraded; heating and cooling shut down until it recovers, freeze protection stays on")
+	case !hold && hvacState.SafetyOverride == SafetyOverrideSensor:
+		hvacState.SafetyOverride = ""
+		hvacState.ForcedMode = ""
+		controlStrategy.Reset()
+		if degraded {
+			notifySafetyOverride(fmt.Sprintf("Temperature sensor still degraded but the home is at %.1f°C; freeze protection taking over", fallback))
+		} else {
+			notifySafetyOverride(fmt.Sprintf("Temperature sensor recovered; returning to %s mode", hvacState.Mode))
+		}
+	}
+	return hold
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// schedulerUser applies schedule entries, which only homeowners or
+// technicians can create.
+var schedulerUser = &User{Username: "scheduler", Role: "homeowner"}
+
+var (
+	schedulerMutex  sync.Mutex
+	appliedSchedule int // id of the schedule entry last applied, 0 if none
+)
+
+// GetScheduleProfile returns the profile whose schedules run, "" if none.
+func GetScheduleProfile() string {
+	return GetSetting("schedule_profile", "")
+}
+
+func SetScheduleProfile(profileName string, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can choose the schedule")
+	}
+	if profileName != "" {
+		if _, err := GetProfile(profileName); err != nil {
+			return errors.New("profile not found")
+		}
+	}
+	if err := SetSetting("schedule_profile", profileName, user.Username); err != nil {
+		return err
+	}
+	resetScheduler()
+	return nil
+}
+
+// resetScheduler makes the next run re-apply the current entry, e.g. after
+// returning home.
+func resetScheduler() {
+	schedulerMutex.Lock()
+	appliedSchedule = 0
+	schedulerMutex.Unlock()
+}
+
+// currentSchedule finds the entry of the profile covering now. Entries whose
+// end is before their start run past midnight.
+func currentSchedule(profileID int, now time.Time) (*Schedule, error) {
+	rows, err := db.Query(`SELECT id, day_of_week, start_time, end_time, target_temp, COALESCE(heat_setpoint, 0), COALESCE(cool_setpoint, 0),
+		COALESCE(active_room, '') FROM schedules WHERE profile_id = ? ORDER BY start_time`, profileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	today := int(now.Weekday())
+	yesterday := (today + 6) % 7
+	for rows.Next() {
+		var s Schedule
+		if err := rows.Scan(&s.ID, &s.DayOfWeek, &s.StartTime, &s.EndTime, &s.TargetTemp, &s.HeatSetpoint, &s.CoolSetpoint, &s.ActiveRoom); err != nil {
+			continue
+		}
+		overnight := s.EndTime < s.StartTime
+		switch {
+		case s.DayOfWeek == today && inTimeWindow(now, s.StartTime, s.EndTime) && (!overnight || now.Format("15:04") >= s.StartTime):
+		case s.DayOfWeek == yesterday && overnight && now.Format("15:04") < s.EndTime:
+		default:
+			continue
+		}
+		s.ProfileID = profileID
+		return &s, nil
+	}
+	return nil, nil
+}
+
+// RunScheduler applies the schedule entry for the current time, once per
+// entry so manual changes stick until the next one starts. Schedules are
+// suspended while nobody is home.
+func RunScheduler(now time.Time) error {
+	if state := GetOccupancy().State; state == OccupancyAway || state == OccupancyVacation {
+		return nil
+	}
+	name := GetScheduleProfile()
+	if name == "" {
+		return nil
+	}
+	profile, err := GetProfile(name)
+	if err != nil {
+		return err
+	}
+	s, err := currentSchedule(profile.ID, now)
+	if err != nil || s == nil {
+		return err
+	}
+	schedulerMutex.Lock()
+	defer schedulerMutex.Unlock()
+	if s.ID == appliedSchedule {
+		return nil
+	}
+	appliedSchedule = s.ID
+
+	if s.HeatSetpoint != 0 && GetHVACStatus().Mode == ModeAuto {
+		err = SetAutoSetpoints(s.HeatSetpoint, s.CoolSetpoint, schedulerUser)
+	} else {
+		err = SetTargetTemperature(s.TargetTemp, schedulerUser)
+	}
+	if err != nil {
+		return err
+	}
+	if s.ActiveRoom != "" {
+		if err := SetActiveRoom(s.ActiveRoom, schedulerUser.Username); err != nil {
+			return err
+		}
+	}
+	LogEvent("schedule_apply", fmt.Sprintf("Schedule %s %s-%s applied from profile %s", time.Weekday(s.DayOfWeek), s.StartTime, s.EndTime, name),
+		schedulerUser.Username, "info")
+	return nil
+}
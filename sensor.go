@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"math/rand"
 	"sync"
 	"time"
@@ -16,6 +18,8 @@ type SensorReading struct {
 
 type SensorStatus struct {
 	IsHealthy   bool
+	Degraded    bool // readings are arriving but a fault detector has flagged them
+	Faults      []SensorFault
 	LastReading time.Time
 	ErrorCount  int
 	SensorType  string
@@ -24,6 +28,7 @@ type SensorStatus struct {
 var (
 	sensorMutex  sync.RWMutex
 	lastReading  SensorReading
+	rawReading   SensorReading // before calibration
 	sensorHealth = true
 	errorCount   = 0
 )
@@ -39,6 +44,10 @@ func InitializeSensors() error {
 		CO:          0.0,
 		Timestamp:   time.Now(),
 	}
+	rawReading = lastReading
+	if err := LoadCalibrations(); err != nil {
+		LogEvent("sensor_init", "Sensor calibrations unavailable: "+err.Error(), "system", "warning")
+	}
 	LogEvent("sensor_init", "Sensors initialized", "system", "info")
 	return nil
 }
@@ -49,9 +58,14 @@ func ReadTemperature() (float64, error) {
 		sensorMutex.RUnlock()
 		return 0, errors.New("sensor malfunction")
 	}
+	last := rawReading.Temperature
 	sensorMutex.RUnlock()
 
-	temp := 18.0 + rand.Float64()*10.0
+	raw := simulatedStep(last, 0.2, 18.0, 28.0)
+	sensorMutex.Lock()
+	rawReading.Temperature = raw
+	sensorMutex.Unlock()
+	temp := applyCalibration(ChannelTemperature, raw)
 	if temp < -50 || temp > 100 {
 		sensorMutex.Lock()
 		errorCount++
@@ -60,6 +74,12 @@ func ReadTemperature() (float64, error) {
 		return 0, errors.New("invalid temperature")
 	}
 
+	storeTemperature(temp)
+	return temp, nil
+}
+
+// storeTemperature records temp as the current temperature reading.
+func storeTemperature(temp float64) {
 	sensorMutex.Lock()
 	lastReading.Temperature = temp
 	lastReading.Timestamp = time.Now()
@@ -67,8 +87,7 @@ func ReadTemperature() (float64, error) {
 	co := lastReading.CO
 	sensorMutex.Unlock()
 
-	db.Exec("INSERT INTO sensor_readings (temperature, humidity, co_level) VALUES (?, ?, ?)", temp, humidity, co)
-	return temp, nil
+	db.Exec("INSERT INTO sensor_readings (temperature, humidity, co_level, sensor_status) VALUES (?, ?, ?, ?)", temp, humidity, co, sensorStatusLabel())
 }
 
 func ReadHumidity() (float64, error) {
@@ -77,9 +96,14 @@ func ReadHumidity() (float64, error) {
 		sensorMutex.RUnlock()
 		return 0, errors.New("sensor malfunction")
 	}
+	last := rawReading.Humidity
 	sensorMutex.RUnlock()
 
-	humidity := 30.0 + rand.Float64()*40.0
+	raw := simulatedStep(last, 1.0, 30.0, 70.0)
+	sensorMutex.Lock()
+	rawReading.Humidity = raw
+	sensorMutex.Unlock()
+	humidity := applyCalibration(ChannelHumidity, raw)
 	if humidity < 0 || humidity > 100 {
 		sensorMutex.Lock()
 		errorCount++
@@ -91,8 +115,11 @@ func ReadHumidity() (float64, error) {
 	sensorMutex.Lock()
 	lastReading.Humidity = humidity
 	lastReading.Timestamp = time.Now()
+	temp := lastReading.Temperature
+	co := lastReading.CO
 	sensorMutex.Unlock()
 
+	db.Exec("INSERT INTO sensor_readings (temperature, humidity, co_level, sensor_status) VALUES (?, ?, ?, ?)", temp, humidity, co, sensorStatusLabel())
 	return humidity, nil
 }
 
@@ -104,7 +131,11 @@ func ReadCO() (float64, error) {
 	}
 	sensorMutex.RUnlock()
 
-	co := rand.Float64() * 10.0
+	raw := rand.Float64() * 10.0
+	sensorMutex.Lock()
+	rawReading.CO = raw
+	sensorMutex.Unlock()
+	co := math.Max(0, applyCalibration(ChannelCO, raw))
 	if co < 0 || co > 1000 {
 		sensorMutex.Lock()
 		errorCount++
@@ -112,21 +143,20 @@ func ReadCO() (float64, error) {
 		LogEvent("sensor_error", "CO out of range", "system", "warning")
 		return 0, errors.New("invalid CO")
 	}
-	if co > 50 {
-		LogEvent("co_alert", "Dangerous CO level detected", "system", "critical")
-	}
 
 	sensorMutex.Lock()
 	lastReading.CO = co
 	lastReading.Timestamp = time.Now()
 	sensorMutex.Unlock()
 
+	EvaluateCO(co, time.Now())
+
 	return co, nil
 }
 
 func ReadAllSensors() (SensorReading, error) {
 	// No sensorMutex.Lock() here. Each function handles its own lock.
-	temp, err1 := ReadTemperature()
+	temp, err1 := ReadControlTemperature()
 	humidity, err2 := ReadHumidity()
 	co, err3 := ReadCO()
 	if err1 != nil || err2 != nil || err3 != nil {
@@ -150,9 +180,11 @@ func GetSensorStatus() SensorStatus {
 	defer sensorMutex.RUnlock()
 	return SensorStatus{
 		IsHealthy:   sensorHealth,
+		Degraded:    len(sensorFaults) > 0,
+		Faults:      sortedFaults(),
 		LastReading: lastReading.Timestamp,
 		ErrorCount:  errorCount,
-		SensorType:  "Temperature/Humidity/CO",
+		SensorType:  sensorType(),
 	}
 }
 
@@ -168,6 +200,30 @@ func ResetSensor() error {
 	defer sensorMutex.Unlock()
 	sensorHealth = true
 	errorCount = 0
+	sensorFaults = map[string]SensorFault{}
 	LogEvent("sensor_reset", "Sensor system reset", "system", "info")
 	return nil
 }
+
+// sensorType describes the sensors in use.
+func sensorType() string {
+	var rooms int
+	db.QueryRow("SELECT COUNT(*) FROM room_sensors WHERE is_active = 1").Scan(&rooms)
+	if rooms == 0 {
+		return "Temperature/Humidity/CO"
+	}
+	return fmt.Sprintf("Temperature/Humidity/CO + %d room sensor(s)", rooms)
+}
+
+// simulatedStep moves a simulated reading by a random step of at most step,
+// reflecting off the limits so it stays in range.
+func simulatedStep(last, step, min, max float64) float64 {
+	v := last + (rand.Float64()*2-1)*step
+	if v > max {
+		v = 2*max - v
+	}
+	if v < min {
+		v = 2*min - v
+	}
+	return v
+}
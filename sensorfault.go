@@ -0,0 +1,369 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	FaultStuck = "stuck"
+	FaultSpike = "spike"
+	FaultDrift = "drift"
+
+	faultWindow       = 10 * time.Minute // readings examined for stuck values and spikes
+	faultMinSamples   = 10               // fewer readings than this are not judged
+	faultRateInterval = 20 * time.Second // shortest gap a rate of change is measured over
+	referenceValid    = time.Hour        // how long a spot reference reading describes current conditions
+)
+
+// faultLimits are the plausibility limits for one metric. A zero MaxRate
+// disables the rate check, since CO can legitimately rise quickly.
+type faultLimits struct {
+	MaxRate  float64 // units per minute
+	MaxDrift float64 // units from the reference
+}
+
+var sensorFaultLimits = map[string]faultLimits{
+	"temperature": {MaxRate: 2.0, MaxDrift: 1.5},
+	"humidity":    {MaxRate: 10.0, MaxDrift: 8.0},
+	"co":          {MaxDrift: 10.0},
+}
+
+type SensorFault struct {
+	Metric string
+	Kind   string
+	Detail string
+	Since  time.Time
+}
+
+// Guarded by sensorMutex.
+var (
+	sensorFaults = map[string]SensorFault{}
+	sensorBreaks = map[string][]sensorBreak{}
+)
+
+// sensorBreak marks where readings of a metric step for a known reason:
+// readings after ID are on a different basis from those before it.
+type sensorBreak struct {
+	ID int64
+	At time.Time
+}
+
+type metricSample struct {
+	ID    int64
+	At    time.Time
+	Value float64
+}
+
+// markSensorBreak records that the readings of metric step from the next one
+// stored, for example after a new calibration, so the step is not judged a
+// spike.
+func markSensorBreak(metric string) {
+	var last sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(id) FROM sensor_readings").Scan(&last); err != nil {
+		LogEvent("sensor_error", "Could not mark sensor break: "+err.Error(), "system", "warning")
+		return
+	}
+	now := time.Now()
+	sensorMutex.Lock()
+	defer sensorMutex.Unlock()
+	kept := []sensorBreak{}
+	for _, b := range sensorBreaks[metric] {
+		if now.Sub(b.At) < faultWindow {
+			kept = append(kept, b)
+		}
+	}
+	sensorBreaks[metric] = append(kept, sensorBreak{ID: last.Int64, At: now})
+}
+
+// breakIDs returns the breaks recorded for metric within the fault window.
+func breakIDs(metric string, now time.Time) []int64 {
+	sensorMutex.RLock()
+	defer sensorMutex.RUnlock()
+	ids := []int64{}
+	for _, b := range sensorBreaks[metric] {
+		if now.Sub(b.At) < faultWindow {
+			ids = append(ids, b.ID)
+		}
+	}
+	return ids
+}
+
+// sensorStatusLabel is stored with each reading. Callers must not hold
+// sensorMutex for writing.
+func sensorStatusLabel() string {
+	sensorMutex.RLock()
+	defer sensorMutex.RUnlock()
+	if len(sensorFaults) > 0 {
+		return "degraded"
+	}
+	return "healthy"
+}
+
+// sortedFaults returns the current faults in a stable order. Callers must
+// hold sensorMutex.
+func sortedFaults() []SensorFault {
+	faults := make([]SensorFault, 0, len(sensorFaults))
+	for _, f := range sensorFaults {
+		faults = append(faults, f)
+	}
+	sort.Slice(faults, func(i, j int) bool {
+		if faults[i].Metric != faults[j].Metric {
+			return faults[i].Metric < faults[j].Metric
+		}
+		return faults[i].Kind < faults[j].Kind
+	})
+	return faults
+}
+
+// sensorDegraded reports whether any fault is flagged on metric.
+func sensorDegraded(metric string) bool {
+	sensorMutex.RLock()
+	defer sensorMutex.RUnlock()
+	for _, f := range sensorFaults {
+		if f.Metric == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// sensorUnreliable reports whether metric is stuck or spiking. Drift alone
+// does not count: the readings are offset but still follow the room.
+func sensorUnreliable(metric string) bool {
+	sensorMutex.RLock()
+	defer sensorMutex.RUnlock()
+	for _, f := range sensorFaults {
+		if f.Metric == metric && f.Kind != FaultDrift {
+			return true
+		}
+	}
+	return false
+}
+
+// lastGoodTemp is the control temperature from the last tick the temperature
+// sensor was trusted, NaN before the first. Guarded by hvacMutex.
+var lastGoodTemp = math.NaN()
+
+// fallbackTemperature estimates the indoor temperature while the temperature
+// sensor is unreliable, for freeze protection: the median of the room sensors
+// read in the last minute, or else the last trusted reading. current is used
+// only when neither is available. Callers must hold hvacMutex.
+func fallbackTemperature(current float64) float64 {
+	cutoff := time.Now().Add(-time.Minute)
+	temps := []float64{}
+	roomSensorMutex.Lock()
+	for _, st := range roomSensorStates {
+		if st.healthy && st.readAt.After(cutoff) {
+			temps = append(temps, st.reading)
+		}
+	}
+	roomSensorMutex.Unlock()
+	if len(temps) > 0 {
+		sort.Float64s(temps)
+		if n := len(temps); n%2 == 0 {
+			return (temps[n/2-1] + temps[n/2]) / 2
+		}
+		return temps[len(temps)/2]
+	}
+	if !math.IsNaN(lastGoodTemp) {
+		return lastGoodTemp
+	}
+	return current
+}
+
+func loadMetricSamples(metric string, from, to time.Time) ([]metricSample, error) {
+	column, ok := sensorMetricColumns[metric]
+	if !ok {
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT id, timestamp, %s FROM sensor_readings WHERE timestamp >= ? AND timestamp <= ? AND %s IS NOT NULL ORDER BY timestamp, id",
+		column, column), dbTime(from), dbTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	samples := []metricSample{}
+	for rows.Next() {
+		var s metricSample
+		if err := rows.Scan(&s.ID, &s.At, &s.Value); err != nil {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// checkStuck flags a window of readings with zero variance.
+func checkStuck(samples []metricSample) (string, bool) {
+	if len(samples) < faultMinSamples || samples[len(samples)-1].At.Sub(samples[0].At) < faultWindow/2 {
+		return "", false
+	}
+	for _, s := range samples[1:] {
+		if s.Value != samples[0].Value {
+			return "", false
+		}
+	}
+	return fmt.Sprintf("%d readings all %.2f", len(samples), samples[0].Value), true
+}
+
+// checkSpike flags the steepest rate of change in the window if it exceeds
+// maxRate. Each reading is compared with the latest one at least
+// faultRateInterval older, so readings stored together are not compared.
+// Readings on either side of a break are not compared either.
+func checkSpike(samples []metricSample, maxRate float64, breaks []int64) (string, bool) {
+	if maxRate <= 0 {
+		return "", false
+	}
+	worst, j := 0.0, -1
+	for i := range samples {
+		for j+1 < i && samples[i].At.Sub(samples[j+1].At) >= faultRateInterval {
+			j++
+		}
+		if j < 0 || spansBreak(samples[j], samples[i], breaks) {
+			continue
+		}
+		rate := math.Abs(samples[i].Value-samples[j].Value) / samples[i].At.Sub(samples[j].At).Minutes()
+		worst = math.Max(worst, rate)
+	}
+	if worst > maxRate {
+		return fmt.Sprintf("changed %.1f/min (limit %.1f/min)", worst, maxRate), true
+	}
+	return "", false
+}
+
+func spansBreak(before, after metricSample, breaks []int64) bool {
+	for _, id := range breaks {
+		if before.ID <= id && after.ID > id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDrift compares the mean of the recent readings with the reference
+// value. A reference is a spot reading, so it is only compared while it
+// still describes current conditions.
+func checkDrift(metric string, samples []metricSample, maxDrift float64, now time.Time) (string, bool) {
+	value, at, ok := GetSensorReference(metric)
+	if !ok || now.Sub(at) > referenceValid || len(samples) == 0 {
+		return "", false
+	}
+	sum := 0.0
+	for _, s := range samples {
+		sum += s.Value
+	}
+	offset := sum/float64(len(samples)) - value
+	if math.Abs(offset) > maxDrift {
+		return fmt.Sprintf("reads %+.1f from reference %.1f taken %s", offset, value, at.Local().Format("2006-01-02 15:04")), true
+	}
+	return "", false
+}
+
+// GetSensorReference returns the last trusted reference reading recorded
+// for metric.
+func GetSensorReference(metric string) (float64, time.Time, bool) {
+	value := GetSettingFloat("sensor_reference_"+metric, math.NaN())
+	at, err := time.Parse(time.RFC3339, GetSetting("sensor_reference_"+metric+"_at", ""))
+	if math.IsNaN(value) || err != nil {
+		return 0, time.Time{}, false
+	}
+	return value, at, true
+}
+
+// SetSensorReference records a reading taken with a trusted instrument,
+// against which the sensor is checked for drift.
+func SetSensorReference(metric string, value float64, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can record sensor references")
+	}
+	if _, ok := sensorFaultLimits[metric]; !ok {
+		return fmt.Errorf("unknown metric %q", metric)
+	}
+	if err := SetSettingFloat("sensor_reference_"+metric, value, user.Username); err != nil {
+		return err
+	}
+	return SetSetting("sensor_reference_"+metric+"_at", time.Now().UTC().Format(time.RFC3339), user.Username)
+}
+
+// clearSensorReference forgets the reference for metric, for when the
+// sensor is recalibrated and the old comparison no longer applies.
+func clearSensorReference(metric, username string) error {
+	if _, err := db.Exec("DELETE FROM settings WHERE key IN (?, ?)", "sensor_reference_"+metric, "sensor_reference_"+metric+"_at"); err != nil {
+		return err
+	}
+	LogEvent("setting_change", "Sensor reference for "+metric+" cleared", username, "info")
+	return nil
+}
+
+// DetectSensorFaults checks recent readings of every metric for stuck
+// values, implausible rates of change and drift from the reference, and
+// updates the degraded state. It returns the faults now present.
+func DetectSensorFaults() ([]SensorFault, error) {
+	now := time.Now()
+	found := map[string]SensorFault{}
+	for metric, limits := range sensorFaultLimits {
+		samples, err := loadMetricSamples(metric, now.Add(-faultWindow), now)
+		if err != nil {
+			return nil, err
+		}
+		if detail, ok := checkStuck(samples); ok && !(metric == "co" && samples[0].Value == 0) {
+			found[metric+"/"+FaultStuck] = SensorFault{Metric: metric, Kind: FaultStuck, Detail: detail}
+		}
+		if detail, ok := checkSpike(samples, limits.MaxRate, breakIDs(metric, now)); ok {
+			found[metric+"/"+FaultSpike] = SensorFault{Metric: metric, Kind: FaultSpike, Detail: detail}
+		}
+		if detail, ok := checkDrift(metric, samples, limits.MaxDrift, now); ok {
+			found[metric+"/"+FaultDrift] = SensorFault{Metric: metric, Kind: FaultDrift, Detail: detail}
+		}
+	}
+
+	sensorMutex.Lock()
+	var raised, cleared []SensorFault
+	for key, f := range found {
+		if old, ok := sensorFaults[key]; ok {
+			f.Since = old.Since
+		} else {
+			f.Since = now
+			raised = append(raised, f)
+		}
+		found[key] = f
+	}
+	for key, f := range sensorFaults {
+		if _, ok := found[key]; !ok {
+			cleared = append(cleared, f)
+		}
+	}
+	sensorFaults = found
+	faults := sortedFaults()
+	sensorMutex.Unlock()
+
+	for _, f := range raised {
+		message := fmt.Sprintf("%s sensor %s: %s", f.Metric, f.Kind, f.Detail)
+		LogEvent("sensor_fault", message, "system", "warning")
+		if f.Kind == FaultDrift {
+			// Drift does not stop the equipment, so tell homeowners directly
+			notifySensorDrift(message)
+		}
+	}
+	for _, f := range cleared {
+		LogEvent("sensor_fault_cleared", fmt.Sprintf("%s sensor no longer %s", f.Metric, f.Kind), "system", "info")
+	}
+	return faults, nil
+}
+
+// notifySensorDrift alerts every homeowner that a sensor needs recalibrating.
+func notifySensorDrift(message string) {
+	usernames, err := activeUsernames("homeowner")
+	if err != nil {
+		LogEvent("sensor_fault", "Could not look up users to notify: "+err.Error(), "system", "warning")
+		return
+	}
+	for _, username := range usernames {
+		SendSystemAlert(username, message+"; recalibrate the sensor")
+	}
+}
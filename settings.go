@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+// GetSetting returns the stored value for key, or fallback if it is unset.
+func GetSetting(key, fallback string) string {
+	var value string
+	if db == nil {
+		return fallback
+	}
+	if err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value); err != nil {
+		return fallback
+	}
+	return value
+}
+
+func GetSettingFloat(key string, fallback float64) float64 {
+	f, err := strconv.ParseFloat(GetSetting(key, ""), 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+// SetSetting stores a value and records who changed it. Permission checks
+// are the caller's job, since they differ per setting.
+func SetSetting(key, value, username string) error {
+	if len(key) == 0 || len(key) > 64 || len(value) > 256 {
+		return errors.New("invalid setting")
+	}
+	_, err := db.Exec(`INSERT INTO settings (key, value, updated_by, updated_at) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP`,
+		key, value, username)
+	if err != nil {
+		return err
+	}
+	LogEvent("setting_change", "Setting "+key+" = "+value, username, "info")
+	return nil
+}
+
+func SetSettingFloat(key string, value float64, username string) error {
+	return SetSetting(key, strconv.FormatFloat(value, 'f', -1, 64), username)
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultFlatRate = 0.12 // per kWh when no tariff has been configured
+	defaultGasRate  = 1.50 // per therm
+)
+
+// Tariff is an electricity rate plan. Energy is charged at the rate of the
+// first time-of-use period covering it, or BaseRate outside all of them,
+// plus the adder of the highest tier the month's consumption has reached.
+type Tariff struct {
+	ID          int
+	Name        string
+	BaseRate    float64 // per kWh outside any time-of-use period
+	DailyCharge float64 // fixed charge per day, whatever the usage
+	Periods     []TariffPeriod
+	Tiers       []TariffTier
+}
+
+// TariffPeriod is a time-of-use window with its own rate. A season may wrap
+// past December and a window may cross midnight.
+type TariffPeriod struct {
+	Name       string // e.g. peak, off-peak
+	DayType    string // all, weekday or weekend
+	StartMonth int    // 1-12
+	EndMonth   int    // 1-12, inclusive
+	StartTime  string // HH:MM
+	EndTime    string // HH:MM
+	Rate       float64
+}
+
+// TariffTier is a consumption block: once the month's usage passes
+// AboveKWH, further energy costs Adder more per kWh.
+type TariffTier struct {
+	AboveKWH float64
+	Adder    float64
+}
+
+// PeriodCost is the energy and cost billed in one tariff period.
+type PeriodCost struct {
+	Name string
+	KWH  float64
+	Cost float64
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+var currencySymbols = map[string]string{"USD": "$", "CAD": "$", "AUD": "$", "EUR": "€", "GBP": "£", "JPY": "¥"}
+
+func validateTariff(t Tariff) error {
+	if len(t.Name) < 2 || len(t.Name) > 50 {
+		return errors.New("invalid tariff name length")
+	}
+	if t.BaseRate < 0 || t.BaseRate > 10 || t.DailyCharge < 0 || t.DailyCharge > 100 {
+		return errors.New("base rate must be 0-10 per kWh and daily charge 0-100")
+	}
+	for _, p := range t.Periods {
+		if p.Name == "" || len(p.Name) > 30 {
+			return errors.New("invalid period name")
+		}
+		if p.DayType != "all" && p.DayType != "weekday" && p.DayType != "weekend" {
+			return errors.New("period days must be all, weekday or weekend")
+		}
+		if p.StartMonth < 1 || p.StartMonth > 12 || p.EndMonth < 1 || p.EndMonth > 12 {
+			return errors.New("season months must be 1-12")
+		}
+		if _, err := time.Parse("15:04", p.StartTime); err != nil {
+			return errors.New("period start must be HH:MM")
+		}
+		if _, err := time.Parse("15:04", p.EndTime); err != nil {
+			return errors.New("period end must be HH:MM")
+		}
+		if p.StartTime == p.EndTime {
+			return errors.New("period must not start and end at the same time")
+		}
+		if p.Rate < 0 || p.Rate > 10 {
+			return errors.New("period rate must be 0-10 per kWh")
+		}
+	}
+	for _, tier := range t.Tiers {
+		if tier.AboveKWH <= 0 || tier.Adder < -10 || tier.Adder > 10 {
+			return errors.New("tiers need a positive monthly kWh threshold and an adder of -10 to 10")
+		}
+	}
+	return nil
+}
+
+// CreateTariff stores a rate plan and returns its ID.
+func CreateTariff(t Tariff, user *User) (int, error) {
+	if user.Role != "homeowner" {
+		return 0, errors.New("only homeowners can manage tariffs")
+	}
+	if err := validateTariff(t); err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("INSERT INTO tariffs (name, base_rate, daily_charge, created_by) VALUES (?, ?, ?, ?)",
+		t.Name, t.BaseRate, t.DailyCharge, user.Username)
+	if err != nil {
+		return 0, errors.New("tariff already exists or database error")
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	for i, p := range t.Periods {
+		if _, err := tx.Exec(`INSERT INTO tariff_periods (tariff_id, position, name, day_type, start_month, end_month, start_time, end_time, rate)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, id, i, p.Name, p.DayType, p.StartMonth, p.EndMonth, p.StartTime, p.EndTime, p.Rate); err != nil {
+			return 0, err
+		}
+	}
+	for _, tier := range t.Tiers {
+		if _, err := tx.Exec("INSERT INTO tariff_tiers (tariff_id, above_kwh, adder) VALUES (?, ?, ?)", id, tier.AboveKWH, tier.Adder); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	LogEvent("tariff_create", fmt.Sprintf("Tariff created: %s (%d periods, %d tiers)", t.Name, len(t.Periods), len(t.Tiers)), user.Username, "info")
+	return int(id), nil
+}
+
+func DeleteTariff(id int, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can manage tariffs")
+	}
+	t, err := GetTariff(id)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM tariffs WHERE id = ?", id); err != nil {
+		return err
+	}
+	if GetSetting("tariff_active", "") == strconv.Itoa(id) {
+		if err := SetSetting("tariff_active", "", user.Username); err != nil {
+			return err
+		}
+	}
+	LogEvent("tariff_delete", "Tariff deleted: "+t.Name, user.Username, "info")
+	return nil
+}
+
+// GetTariff loads a tariff with its periods and tiers.
+func GetTariff(id int) (*Tariff, error) {
+	t := Tariff{ID: id}
+	if err := db.QueryRow("SELECT name, base_rate, daily_charge FROM tariffs WHERE id = ?", id).Scan(&t.Name, &t.BaseRate, &t.DailyCharge); err != nil {
+		return nil, errors.New("tariff not found")
+	}
+	rows, err := db.Query(`SELECT name, day_type, start_month, end_month, start_time, end_time, rate FROM tariff_periods
+		WHERE tariff_id = ? ORDER BY position`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p TariffPeriod
+		if err := rows.Scan(&p.Name, &p.DayType, &p.StartMonth, &p.EndMonth, &p.StartTime, &p.EndTime, &p.Rate); err != nil {
+			continue
+		}
+		t.Periods = append(t.Periods, p)
+	}
+	tiers, err := db.Query("SELECT above_kwh, adder FROM tariff_tiers WHERE tariff_id = ? ORDER BY above_kwh", id)
+	if err != nil {
+		return nil, err
+	}
+	defer tiers.Close()
+	for tiers.Next() {
+		var tier TariffTier
+		if err := tiers.Scan(&tier.AboveKWH, &tier.Adder); err != nil {
+			continue
+		}
+		t.Tiers = append(t.Tiers, tier)
+	}
+	return &t, nil
+}
+
+func ListTariffs() ([]Tariff, error) {
+	rows, err := db.Query("SELECT id FROM tariffs ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	tariffs := []Tariff{}
+	for _, id := range ids {
+		if t, err := GetTariff(id); err == nil {
+			tariffs = append(tariffs, *t)
+		}
+	}
+	return tariffs, nil
+}
+
+func SetActiveTariff(id int, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can manage tariffs")
+	}
+	if _, err := GetTariff(id); err != nil {
+		return err
+	}
+	return SetSetting("tariff_active", strconv.Itoa(id), user.Username)
+}
+
+// ActiveTariff returns the tariff costs are computed with, and whether one
+// has been configured. Without one energy is billed at a flat rate.
+func ActiveTariff() (Tariff, bool) {
+	if id, err := strconv.Atoi(GetSetting("tariff_active", "")); err == nil {
+		if t, err := GetTariff(id); err == nil {
+			return *t, true
+		}
+	}
+	return Tariff{Name: "Flat rate", BaseRate: defaultFlatRate}, false
+}
+
+// GetGasRate is the price of gas per therm.
+func GetGasRate() float64 {
+	return GetSettingFloat("gas_rate", defaultGasRate)
+}
+
+func SetGasRate(rate float64, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can change the gas price")
+	}
+	if rate < 0 || rate > 20 {
+		return errors.New("gas price must be 0-20 per therm")
+	}
+	return SetSettingFloat("gas_rate", rate, user.Username)
+}
+
+func GetCurrency() string {
+	return GetSetting("currency", "USD")
+}
+
+func SetCurrency(code string, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can change the currency")
+	}
+	if !currencyPattern.MatchString(code) {
+		return errors.New("currency must be a three-letter ISO code such as USD or EUR")
+	}
+	return SetSetting("currency", code, user.Username)
+}
+
+// FormatMoney formats an amount in the configured currency.
+func FormatMoney(amount float64) string {
+	currency := GetCurrency()
+	if symbol, ok := currencySymbols[currency]; ok {
+		return fmt.Sprintf("%s%.2f", symbol, amount)
+	}
+	return fmt.Sprintf("%.2f %s", amount, currency)
+}
+
+func (p TariffPeriod) applies(at time.Time) bool {
+	month := int(at.Month())
+	if p.StartMonth <= p.EndMonth {
+		if month < p.StartMonth || month > p.EndMonth {
+			return false
+		}
+	} else if month < p.StartMonth && month > p.EndMonth {
+		return false
+	}
+	weekend := at.Weekday() == time.Saturday || at.Weekday() == time.Sunday
+	if (p.DayType == "weekday" && weekend) || (p.DayType == "weekend" && !weekend) {
+		return false
+	}
+	return inTimeWindow(at, p.StartTime, p.EndTime)
+}
+
+// rateAt returns the period in force at a local time and its rate.
+func (t Tariff) rateAt(at time.Time) (string, float64) {
+	for _, p := range t.Periods {
+		if p.applies(at) {
+			return p.Name, p.Rate
+		}
+	}
+	return "standard", t.BaseRate
+}
+
+// tierAdder is the per-kWh adder once monthKWH has been used this month.
+func (t Tariff) tierAdder(monthKWH float64) float64 {
+	adder := 0.0
+	for _, tier := range t.Tiers {
+		if monthKWH >= tier.AboveKWH {
+			adder = tier.Adder
+		}
+	}
+	return adder
+}
+
+// tariffOffPeak reports whether at falls in the cheapest rate of the active
+// tariff's day. known is false without a time-of-use tariff.
+func tariffOffPeak(at time.Time) (offPeak, known bool) {
+	t, ok := ActiveTariff()
+	if !ok || len(t.Periods) == 0 {
+		return false, false
+	}
+	_, rate := t.rateAt(at)
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+	cheapest, dearest := rate, rate
+	for m := day; m.Before(day.AddDate(0, 0, 1)); m = m.Add(15 * time.Minute) {
+		_, r := t.rateAt(m)
+		cheapest, dearest = math.Min(cheapest, r), math.Max(dearest, r)
+	}
+	if cheapest == dearest {
+		return false, false
+	}
+	return rate == cheapest, true
+}
+
+// energyCosts bills the metered intervals in [from, to) under t. Each
+// interval is billed minute by minute, so one crossing a period boundary is
+// split between them. Tiers count usage from the start of each month,
+// including usage before from.
+func energyCosts(t Tariff, from, to time.Time) ([]PeriodCost, float64, error) {
+	local := from.Local()
+	monthStart := time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, time.Local)
+	intervals, err := meteredIntervals(monthStart, to)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	byPeriod := map[string]*PeriodCost{}
+	order := []string{}
+	total := 0.0
+	month, monthKWH := monthStart.Month(), 0.0
+	for _, m := range intervals {
+		perSecond := m.KWH / m.Seconds()
+		for at := m.Start; at.Before(m.End); {
+			// Steps end on the minute, at from, or at the end of the interval.
+			next := at.Truncate(time.Minute).Add(time.Minute)
+			if at.Before(from) && from.Before(next) {
+				next = from
+			}
+			if m.End.Before(next) {
+				next = m.End
+			}
+			kwh := perSecond * next.Sub(at).Seconds()
+			atLocal := at.Local()
+			if atLocal.Month() != month {
+				month, monthKWH = atLocal.Month(), 0
+			}
+			adder := t.tierAdder(monthKWH)
+			monthKWH += kwh
+			if !at.Before(from) {
+				name, rate := t.rateAt(atLocal)
+				pc, ok := byPeriod[name]
+				if !ok {
+					pc = &PeriodCost{Name: name}
+					byPeriod[name] = pc
+					order = append(order, name)
+				}
+				cost := kwh * (rate + adder)
+				pc.KWH += kwh
+				pc.Cost += cost
+				total += cost
+			}
+			at = next
+		}
+	}
+	costs := make([]PeriodCost, 0, len(order))
+	for _, name := range order {
+		costs = append(costs, *byPeriod[name])
+	}
+	return costs, total, nil
+}
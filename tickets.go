@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	TicketOpen   = "open"
+	TicketClosed = "closed"
+
+	maxTicketAccess = 72 * time.Hour
+)
+
+// ServiceTicket is a homeowner's request for service. The assigned
+// technician can only sign in while one of their tickets is open, and
+// closing the ticket ends their access.
+type ServiceTicket struct {
+	ID          int
+	Title       string
+	Description string
+	Status      string
+	OpenedBy    string
+	OpenedAt    time.Time
+	Technician  string
+	AccessUntil time.Time
+	ClosedBy    string
+	ClosedAt    time.Time
+	Resolution  string
+	Entries     []TicketEntry
+}
+
+// TicketEntry is a note or an attached diagnostics run on a ticket.
+type TicketEntry struct {
+	CreatedAt time.Time
+	Author    string
+	Kind      string // note or diagnostics
+	Body      string
+}
+
+// OpenServiceTicket opens a ticket for one of the homeowner's technicians
+// and grants them access for accessHours. It returns the ticket ID.
+func OpenServiceTicket(title, description, technician string, accessHours int, user *User) (int, error) {
+	if user.Role != "homeowner" {
+		return 0, errors.New("only homeowners can open service tickets")
+	}
+	title, description = SanitizeInput(title), SanitizeInput(description)
+	if len(title) < 3 || len(title) > 80 {
+		return 0, errors.New("ticket title must be 3-80 characters")
+	}
+	if len(description) > 2000 {
+		return 0, errors.New("ticket description must be at most 2000 characters")
+	}
+	access := time.Duration(accessHours) * time.Hour
+	if access <= 0 || access > maxTicketAccess {
+		return 0, fmt.Errorf("access must be 1-%.0f hours", maxTicketAccess.Hours())
+	}
+	tech, err := GetUserByUsername(technician)
+	if err != nil || tech.Role != "technician" || !isHomeownerOfTechnician(user.Username, technician) {
+		return 0, errors.New("invalid technician")
+	}
+	accessUntil := time.Now().Add(access)
+	result, err := db.Exec("INSERT INTO service_tickets (title, description, status, opened_by, opened_at, technician, access_until) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		title, description, TicketOpen, user.Username, dbTime(time.Now()), technician, dbTime(accessUntil))
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := GrantTechnicianAccess(user.Username, technician, access, user.Role); err != nil {
+		db.Exec("DELETE FROM service_tickets WHERE id = ?", id)
+		return 0, err
+	}
+	LogEvent("ticket_open", fmt.Sprintf("Service ticket #%d opened: %s (assigned to %s)", id, title, technician), user.Username, "info")
+	return int(id), nil
+}
+
+// GetServiceTicket returns a ticket with its entries. Technicians can only
+// see their own tickets.
+func GetServiceTicket(id int, user *User) (ServiceTicket, error) {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return ServiceTicket{}, errors.New("only homeowners or technicians can view service tickets")
+	}
+	t, err := loadServiceTicket(id)
+	if err != nil {
+		return ServiceTicket{}, err
+	}
+	if user.Role == "technician" && t.Technician != user.Username {
+		return ServiceTicket{}, errors.New("ticket not found")
+	}
+	return t, nil
+}
+
+func loadServiceTicket(id int) (ServiceTicket, error) {
+	row := db.QueryRow(`SELECT id, title, COALESCE(description, ''), status, opened_by, opened_at, technician, access_until,
+		COALESCE(closed_by, ''), closed_at, COALESCE(resolution, '') FROM service_tickets WHERE id = ?`, id)
+	t, err := scanServiceTicket(row)
+	if err != nil {
+		return ServiceTicket{}, errors.New("ticket not found")
+	}
+	rows, err := db.Query("SELECT created_at, author, kind, body FROM service_ticket_entries WHERE ticket_id = ? ORDER BY created_at, id", id)
+	if err != nil {
+		return ServiceTicket{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e TicketEntry
+		if err := rows.Scan(&e.CreatedAt, &e.Author, &e.Kind, &e.Body); err != nil {
+			continue
+		}
+		t.Entries = append(t.Entries, e)
+	}
+	return t, nil
+}
+
+func scanServiceTicket(row interface{ Scan(...interface{}) error }) (ServiceTicket, error) {
+	var t ServiceTicket
+	var closedAt sql.NullTime
+	if err := row.Scan(&t.ID, &t.Title, &t.Description, &t.Status, &t.OpenedBy, &t.OpenedAt, &t.Technician, &t.AccessUntil,
+		&t.ClosedBy, &closedAt, &t.Resolution); err != nil {
+		return t, err
+	}
+	if closedAt.Valid {
+		t.ClosedAt = closedAt.Time
+	}
+	return t, nil
+}
+
+// ListServiceTickets returns tickets newest first, open ones only unless
+// all is set. Technicians see only their own.
+func ListServiceTickets(all bool, user *User) ([]ServiceTicket, error) {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return nil, errors.New("only homeowners or technicians can view service tickets")
+	}
+	query := `SELECT id, title, COALESCE(description, ''), status, opened_by, opened_at, technician, access_until,
+		COALESCE(closed_by, ''), closed_at, COALESCE(resolution, '') FROM service_tickets WHERE 1 = 1`
+	args := []interface{}{}
+	if !all {
+		query += " AND status = ?"
+		args = append(args, TicketOpen)
+	}
+	if user.Role == "technician" {
+		query += " AND technician = ?"
+		args = append(args, user.Username)
+	}
+	rows, err := db.Query(query+" ORDER BY opened_at DESC, id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tickets := []ServiceTicket{}
+	for rows.Next() {
+		t, err := scanServiceTicket(rows)
+		if err != nil {
+			continue
+		}
+		tickets = append(tickets, t)
+	}
+	return tickets, nil
+}
+
+// openTicketFor loads an open ticket the user may work on: the assigned
+// technician or a homeowner.
+func openTicketFor(id int, user *User) (ServiceTicket, error) {
+	t, err := GetServiceTicket(id, user)
+	if err != nil {
+		return t, err
+	}
+	if t.Status != TicketOpen {
+		return t, errors.New("ticket is closed")
+	}
+	return t, nil
+}
+
+func AddTicketNote(id int, note string, user *User) error {
+	if _, err := openTicketFor(id, user); err != nil {
+		return err
+	}
+	note = SanitizeInput(note)
+	if note == "" || len(note) > 2000 {
+		return errors.New("note must be 1-2000 characters")
+	}
+	if _, err := db.Exec("INSERT INTO service_ticket_entries (ticket_id, created_at, author, kind, body) VALUES (?, ?, ?, 'note', ?)",
+		id, dbTime(time.Now()), user.Username, note); err != nil {
+		return err
+	}
+	LogEvent("ticket_note", fmt.Sprintf("Note added to service ticket #%d", id), user.Username, "info")
+	return nil
+}
+
+// AttachTicketDiagnostics runs diagnostics and attaches the report to the
+// ticket.
+func AttachTicketDiagnostics(id int, user *User) (DiagnosticReport, error) {
+	if user.Role != "technician" {
+		return DiagnosticReport{}, errors.New("only the assigned technician can attach diagnostics")
+	}
+	if _, err := openTicketFor(id, user); err != nil {
+		return DiagnosticReport{}, err
+	}
+	report, err := RunSystemDiagnostics(user)
+	if err != nil {
+		return report, err
+	}
+	if _, err := db.Exec("INSERT INTO service_ticket_entries (ticket_id, created_at, author, kind, body) VALUES (?, ?, ?, 'diagnostics', ?)",
+		id, dbTime(time.Now()), user.Username, GenerateDiagnosticReport(report)); err != nil {
+		return report, err
+	}
+	LogEvent("ticket_diagnostics", fmt.Sprintf("Diagnostics attached to service ticket #%d (health: %s)", id, report.SystemHealth), user.Username, "info")
+	return report, nil
+}
+
+// CloseServiceTicket closes a ticket with its resolution and ends the
+// technician's access unless another of their tickets is still open.
+func CloseServiceTicket(id int, resolution string, user *User) error {
+	t, err := openTicketFor(id, user)
+	if err != nil {
+		return err
+	}
+	resolution = SanitizeInput(resolution)
+	if resolution == "" || len(resolution) > 2000 {
+		return errors.New("resolution must be 1-2000 characters")
+	}
+	now := time.Now()
+	result, err := db.Exec("UPDATE service_tickets SET status = ?, closed_by = ?, closed_at = ?, resolution = ? WHERE id = ? AND status = ?",
+		TicketClosed, user.Username, dbTime(now), resolution, id, TicketOpen)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("ticket is closed")
+	}
+	LogEvent("ticket_close", fmt.Sprintf("Service ticket #%d closed: %s", id, resolution), user.Username, "info")
+	if technicianHasOpenTicket(t.Technician) {
+		return nil
+	}
+	return endTechnicianAccess(t.Technician, fmt.Sprintf("service ticket #%d closed", id))
+}
+
+// endTechnicianAccess expires a technician's grant and signs them out.
+func endTechnicianAccess(technician, reason string) error {
+	now := time.Now()
+	if _, err := db.Exec("UPDATE guest_access SET expires_at = ? WHERE guest_username = ? AND expires_at > ?", now, technician, now); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE users SET session_token = NULL, session_expires_at = NULL WHERE username = ?", technician); err != nil {
+		return err
+	}
+	LogEvent("tech_access_end", "Technician access ended: "+reason, technician, "info")
+	return nil
+}
+
+func technicianHasOpenTicket(technician string) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM service_tickets WHERE technician = ? AND status = ?", technician, TicketOpen).Scan(&count)
+	return count > 0
+}
+
+// extendTicketAccess moves the access window of a technician's open
+// tickets out to until. Windows already ending later are kept.
+func extendTicketAccess(technician string, until time.Time) {
+	db.Exec("UPDATE service_tickets SET access_until = ? WHERE technician = ? AND status = ? AND access_until < ?",
+		dbTime(until), technician, TicketOpen, dbTime(until))
+}
+
+// accessEnded is when the technician's access for t ended, or will end.
+func (t ServiceTicket) accessEnded() time.Time {
+	if !t.ClosedAt.IsZero() && t.ClosedAt.Before(t.AccessUntil) {
+		return t.ClosedAt
+	}
+	return t.AccessUntil
+}
+
+// FormatServiceHistory renders tickets for printing: each ticket's access
+// window, the notes and diagnostics attached during it, any maintenance
+// visits the technician logged in it, and the resolution.
+func FormatServiceHistory(tickets []ServiceTicket) (string, error) {
+	visits, err := GetServiceVisits(1000)
+	if err != nil {
+		return "", err
+	}
+	output := "=== SERVICE HISTORY ===\n"
+	output += fmt.Sprintf("Printed: %s\n", time.Now().Format("2006-01-02 15:04"))
+	if len(tickets) == 0 {
+		output += "\nNo service tickets\n"
+	}
+	for _, t := range tickets {
+		ended := t.accessEnded()
+		output += fmt.Sprintf("\nTicket #%d: %s [%s]\n", t.ID, t.Title, t.Status)
+		output += fmt.Sprintf("  Opened %s by %s, assigned to %s\n", t.OpenedAt.Local().Format("2006-01-02 15:04"), t.OpenedBy, t.Technician)
+		if t.Description != "" {
+			output += "  Issue: " + t.Description + "\n"
+		}
+		output += fmt.Sprintf("  Access: %s to %s (%.1f h)\n", t.OpenedAt.Local().Format("2006-01-02 15:04"),
+			ended.Local().Format("2006-01-02 15:04"), ended.Sub(t.OpenedAt).Hours())
+		for _, e := range t.Entries {
+			if e.Kind == "diagnostics" {
+				output += fmt.Sprintf("  %s diagnostics by %s:\n", e.CreatedAt.Local().Format("2006-01-02 15:04"), e.Author)
+				for _, line := range strings.Split(strings.TrimRight(e.Body, "\n"), "\n") {
+					output += "    | " + line + "\n"
+				}
+				continue
+			}
+			output += fmt.Sprintf("  %s note by %s: %s\n", e.CreatedAt.Local().Format("2006-01-02 15:04"), e.Author, e.Body)
+		}
+		for _, v := range visits {
+			if v.Technician == t.Technician && !v.VisitedAt.Before(t.OpenedAt) && !v.VisitedAt.After(ended) {
+				output += "  Visit: " + formatServiceVisit(v) + "\n"
+			}
+		}
+		if t.Status == TicketClosed {
+			output += fmt.Sprintf("  Closed %s by %s: %s\n", t.ClosedAt.Local().Format("2006-01-02 15:04"), t.ClosedBy, t.Resolution)
+		}
+	}
+	return output, nil
+}
+
+// GetServiceHistory returns every ticket the user can see, with entries,
+// newest first.
+func GetServiceHistory(user *User) ([]ServiceTicket, error) {
+	tickets, err := ListServiceTickets(true, user)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tickets {
+		if tickets[i], err = loadServiceTicket(tickets[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return tickets, nil
+}
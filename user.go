@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"time"
 )
@@ -57,7 +58,8 @@ func CreateTechnicianAccount(homeowner, techName, password string, creatorRole s
 	return nil
 }
 
-// GrantTechnicianAccess - ONLY homeowners can grant/extend technician access
+// GrantTechnicianAccess - ONLY homeowners can grant/extend technician access,
+// and only for a technician with an open service ticket
 func GrantTechnicianAccess(homeowner, technician string, duration time.Duration, granterRole string) error {
 	// SECURITY: Only homeowners can grant technician access
 	if granterRole != "homeowner" {
@@ -69,7 +71,19 @@ func GrantTechnicianAccess(homeowner, technician string, duration time.Duration,
 		return errors.New("invalid technician")
 	}
 
+	// SECURITY: Access is scoped to service tickets
+	if !technicianHasOpenTicket(technician) {
+		return errors.New("open a service ticket for this technician first")
+	}
+
+	// A shorter grant never cuts short access already given for another ticket
 	expiresAt := time.Now().Add(duration)
+	var current sql.NullTime
+	db.QueryRow("SELECT expires_at FROM guest_access WHERE guest_username = ? AND granted_by = ? AND is_active = 1",
+		technician, homeowner).Scan(&current)
+	if current.Valid && current.Time.After(expiresAt) {
+		expiresAt = current.Time
+	}
 	res, err := db.Exec(
 		"UPDATE guest_access SET expires_at = ?, is_active = 1 WHERE guest_username = ? AND granted_by = ?",
 		expiresAt, technician, homeowner,
@@ -82,6 +96,7 @@ func GrantTechnicianAccess(homeowner, technician string, duration time.Duration,
 		return errors.New("no existing grant found to update")
 	}
 
+	extendTicketAccess(technician, expiresAt)
 	LogEvent("grant_tech", "Tech access extended until "+expiresAt.Format(time.RFC3339), homeowner, "info")
 	return nil
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeatingRate   = 2.0  // °C/hour assumed until heating history has been learned
+	minHeatingRate       = 0.25 // °C/hour; slower learned rates are treated as unreliable
+	preconditionMargin   = 15   // minutes added so the target is reached before arrival
+	maxPreconditionHours = 24
+	vacationPlanInterval = time.Hour
+)
+
+// Vacation is an away period. With a hold temperature the house is heated
+// only to that temperature, otherwise the vacation setback applies.
+// Heating back to the normal setpoint starts at PreconditionAt, computed
+// from the learned heating rate so the house is warm by EndAt.
+type Vacation struct {
+	ID             int
+	StartAt        time.Time
+	EndAt          time.Time
+	HoldTemp       float64 // 0 for the vacation setback instead
+	PreconditionAt time.Time
+	HeatingRate    float64 // °C/hour the preconditioning time was computed with
+	CreatedBy      string
+	Cancelled      bool
+}
+
+var (
+	vacationMutex    sync.Mutex
+	lastVacationPlan time.Time
+)
+
+// AddVacation schedules a vacation. The home is in the vacation state for
+// the whole range, whatever the other occupancy signals say, and schedules
+// are suspended.
+func AddVacation(start, end time.Time, holdTemp float64, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can schedule vacations")
+	}
+	if !end.After(start) {
+		return errors.New("vacation must end after it starts")
+	}
+	if end.Before(time.Now()) {
+		return errors.New("vacation has already ended")
+	}
+	if end.Sub(start) > 365*24*time.Hour {
+		return errors.New("vacation cannot be longer than a year")
+	}
+	if holdTemp != 0 {
+		if err := ValidateTemperatureInput(holdTemp); err != nil {
+			return err
+		}
+	}
+	result, err := db.Exec("INSERT INTO vacations (start_at, end_at, hold_temp, created_by) VALUES (?, ?, ?, ?)",
+		dbTime(start), dbTime(end), nullableSetpoint(holdTemp), user.Username)
+	if err != nil {
+		return err
+	}
+	details := fmt.Sprintf("Vacation scheduled %s to %s", start.Format("2006-01-02 15:04"), end.Format("2006-01-02 15:04"))
+	if holdTemp != 0 {
+		details += fmt.Sprintf(", holding %.1f°C", holdTemp)
+	}
+	LogEvent("vacation_add", details, user.Username, "info")
+	if id, err := result.LastInsertId(); err == nil {
+		if v, err := getVacation(int(id)); err == nil {
+			planPreconditioning(v, time.Now())
+		}
+	}
+	return UpdateOccupancy(time.Now())
+}
+
+func CancelVacation(id int, user *User) error {
+	if user.Role != "homeowner" {
+		return errors.New("only homeowners can cancel vacations")
+	}
+	result, err := db.Exec("UPDATE vacations SET cancelled = 1 WHERE id = ? AND cancelled = 0", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return errors.New("vacation not found")
+	}
+	LogEvent("vacation_cancel", fmt.Sprintf("Vacation %d cancelled", id), user.Username, "info")
+	return UpdateOccupancy(time.Now())
+}
+
+const vacationColumns = "id, start_at, end_at, COALESCE(hold_temp, 0), precondition_at, COALESCE(heating_rate, 0), created_by, cancelled"
+
+func scanVacation(scan func(...interface{}) error) (*Vacation, error) {
+	var v Vacation
+	var precondition sql.NullTime
+	if err := scan(&v.ID, &v.StartAt, &v.EndAt, &v.HoldTemp, &precondition, &v.HeatingRate, &v.CreatedBy, &v.Cancelled); err != nil {
+		return nil, err
+	}
+	v.PreconditionAt = precondition.Time
+	return &v, nil
+}
+
+func getVacation(id int) (*Vacation, error) {
+	return scanVacation(db.QueryRow("SELECT "+vacationColumns+" FROM vacations WHERE id = ?", id).Scan)
+}
+
+// ListVacations returns vacations that have not yet ended, soonest first.
+func ListVacations() ([]Vacation, error) {
+	rows, err := db.Query("SELECT "+vacationColumns+" FROM vacations WHERE end_at > ? ORDER BY start_at", dbTime(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	vacations := []Vacation{}
+	for rows.Next() {
+		v, err := scanVacation(rows.Scan)
+		if err != nil {
+			continue
+		}
+		vacations = append(vacations, *v)
+	}
+	return vacations, nil
+}
+
+func activeVacation(now time.Time) (*Vacation, error) {
+	return scanVacation(db.QueryRow("SELECT "+vacationColumns+" FROM vacations WHERE cancelled = 0 AND start_at <= ? AND end_at > ? ORDER BY start_at LIMIT 1",
+		dbTime(now), dbTime(now)).Scan)
+}
+
+// NextVacation returns the vacation in progress or the next one planned,
+// nil if there is none.
+func NextVacation(now time.Time) *Vacation {
+	v, err := scanVacation(db.QueryRow("SELECT "+vacationColumns+" FROM vacations WHERE cancelled = 0 AND end_at > ? ORDER BY start_at LIMIT 1",
+		dbTime(now)).Scan)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// learnedHeatingRate is the net rate heating raised the temperature over the
+// last week, in °C/hour, and the minutes before it responded. learned is
+// false when there is not enough history and the defaults are returned.
+func learnedHeatingRate(now time.Time) (rate, deadTime float64, learned bool) {
+	result, err := analyseResponse(now.AddDate(0, 0, -7), now, ModeHeat)
+	if err != nil || result.RunSlope*60 < minHeatingRate {
+		return defaultHeatingRate, 0, false
+	}
+	return result.RunSlope * 60, result.DeadTime, true
+}
+
+// preconditionStart works back from the return time: the time to heat from
+// the vacation temperature to the normal setpoint at the given rate, plus
+// the dead time and a safety margin, never before the vacation starts.
+func preconditionStart(v *Vacation, from, to, rate, deadTime float64) time.Time {
+	if to <= from {
+		return v.EndAt
+	}
+	minutes := (to-from)/rate*60 + deadTime + preconditionMargin
+	minutes = math.Min(minutes, maxPreconditionHours*60)
+	start := v.EndAt.Add(-time.Duration(minutes * float64(time.Minute)))
+	if start.Before(v.StartAt) {
+		return v.StartAt
+	}
+	return start
+}
+
+// returnTarget is the heating setpoint the house should reach on return.
+func returnTarget() float64 {
+	status := GetHVACStatus()
+	if status.Mode == ModeAuto {
+		return status.HeatSetpoint
+	}
+	return status.TargetTemp
+}
+
+// planPreconditioning recomputes and stores when heating must resume for v.
+func planPreconditioning(v *Vacation, now time.Time) {
+	target := returnTarget()
+	from := v.HoldTemp
+	if from == 0 {
+		from = target - LoadOccupancyConfig(OccupancyVacation).Setback
+	}
+	rate, deadTime, learned := learnedHeatingRate(now)
+	start := preconditionStart(v, from, target, rate, deadTime)
+	if _, err := db.Exec("UPDATE vacations SET precondition_at = ?, heating_rate = ? WHERE id = ?", dbTime(start), rate, v.ID); err != nil {
+		LogEvent("vacation_error", "Failed to store preconditioning plan: "+err.Error(), "system", "warning")
+		return
+	}
+	if v.PreconditionAt.IsZero() || math.Abs(start.Sub(v.PreconditionAt).Minutes()) >= preconditionMargin {
+		source := "learned"
+		if !learned {
+			source = "default"
+		}
+		LogEvent("vacation_plan", fmt.Sprintf("Vacation %d: heating from %.1f to %.1f°C starts %s (%s rate %.1f°C/h)",
+			v.ID, from, target, start.Local().Format("2006-01-02 15:04"), source, rate), "system", "info")
+	}
+	v.PreconditionAt, v.HeatingRate = start, rate
+}
+
+// refreshVacationPlans keeps the preconditioning times of upcoming vacations
+// current as the heating history and setpoints change.
+func refreshVacationPlans(now time.Time) {
+	vacationMutex.Lock()
+	defer vacationMutex.Unlock()
+	if now.Sub(lastVacationPlan) < vacationPlanInterval {
+		return
+	}
+	lastVacationPlan = now
+	vacations, err := ListVacations()
+	if err != nil {
+		return
+	}
+	for i := range vacations {
+		v := &vacations[i]
+		// Once preconditioning has begun the plan is fixed.
+		if v.Cancelled || (!v.PreconditionAt.IsZero() && !now.Before(v.PreconditionAt)) {
+			continue
+		}
+		planPreconditioning(v, now)
+	}
+}
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,29 +24,67 @@ type WeatherData struct {
 	Timestamp   time.Time
 }
 
-var cachedWeather WeatherData
-var lastFetch time.Time
-var cacheDuration = 10 * time.Minute
+// ForecastHour is the forecast for the hour starting at Time.
+type ForecastHour struct {
+	Time        time.Time
+	Temperature float64
+	Humidity    float64
+	Conditions  string
+}
 
-func GetOutdoorWeather(location string) (WeatherData, error) {
-	if time.Since(lastFetch) < cacheDuration && cachedWeather.Location == location {
-		LogEvent("weather_cache", "Weather from cache", "system", "info")
-		return cachedWeather, nil
-	}
-	if len(location) < 2 || len(location) > 100 {
-		return WeatherData{}, errors.New("invalid location")
-	}
-	weather := WeatherData{
+// WeatherProvider fetches current conditions and hourly forecasts for a location.
+type WeatherProvider interface {
+	Name() string
+	Current(location string) (WeatherData, error)
+	Forecast(location string, hours int) ([]ForecastHour, error)
+}
+
+const (
+	WeatherProviderSimulated      = "simulated"
+	WeatherProviderOpenWeatherMap = "openweathermap"
+
+	defaultWeatherBaseURL = "https://api.openweathermap.org"
+	weatherAPIKeyEnv      = "THERMOSTAT_WEATHER_API_KEY"
+	weatherMaxResponse    = 1 << 20
+	weatherCacheSize      = 32
+)
+
+var (
+	cacheDuration     = 10 * time.Minute
+	weatherRetryAfter = time.Minute
+	weatherStaleLimit = time.Hour
+)
+
+// SimulatedWeatherProvider makes up plausible weather without a network.
+type SimulatedWeatherProvider struct{}
+
+func (SimulatedWeatherProvider) Name() string { return WeatherProviderSimulated }
+
+func (SimulatedWeatherProvider) Current(location string) (WeatherData, error) {
+	return WeatherData{
 		Temperature: 15.0 + float64(time.Now().Hour())/2 + rand.Float64()*5,
 		Humidity:    60.0 + rand.Float64()*20,
 		Conditions:  getRandomCondition(),
 		Location:    location,
 		Timestamp:   time.Now(),
+	}, nil
+}
+
+// Forecast follows a daily cycle around the current simulated temperature.
+func (p SimulatedWeatherProvider) Forecast(location string, hours int) ([]ForecastHour, error) {
+	now, _ := p.Current(location)
+	start := time.Now().Truncate(time.Hour).Add(time.Hour)
+	forecast := make([]ForecastHour, 0, hours)
+	for i := 0; i < hours; i++ {
+		at := start.Add(time.Duration(i) * time.Hour)
+		forecast = append(forecast, ForecastHour{
+			Time:        at,
+			Temperature: now.Temperature - 6 + 6*math.Sin(float64(at.Hour()-9)/24*2*math.Pi) + rand.Float64(),
+			Humidity:    now.Humidity,
+			Conditions:  getRandomCondition(),
+		})
 	}
-	cachedWeather = weather
-	lastFetch = time.Now()
-	LogEvent("weather_fetch", "Weather fetched for "+location, "system", "info")
-	return weather, nil
+	return forecast, nil
 }
 
 func getRandomCondition() string {
@@ -45,6 +92,340 @@ func getRandomCondition() string {
 	return conditions[rand.Intn(len(conditions))]
 }
 
+// HTTPWeatherProvider talks to an OpenWeatherMap-compatible API. Network
+// errors, rate limiting and server errors are retried with backoff; other
+// errors are returned at once.
+type HTTPWeatherProvider struct {
+	BaseURL    string
+	APIKey     string
+	Client     *http.Client
+	Retries    int
+	RetryDelay time.Duration
+}
+
+func NewHTTPWeatherProvider(baseURL, apiKey string, timeout time.Duration, retries int) *HTTPWeatherProvider {
+	return &HTTPWeatherProvider{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		APIKey:     apiKey,
+		Client:     &http.Client{Timeout: timeout},
+		Retries:    retries,
+		RetryDelay: 500 * time.Millisecond,
+	}
+}
+
+func (p *HTTPWeatherProvider) Name() string { return WeatherProviderOpenWeatherMap }
+
+type weatherAPIError struct {
+	status    int
+	retryable bool
+}
+
+func (e *weatherAPIError) Error() string {
+	return fmt.Sprintf("weather API returned status %d", e.status)
+}
+
+// get fetches path with the query plus API key and decodes the JSON reply
+// into out, retrying transient failures.
+func (p *HTTPWeatherProvider) get(path string, query url.Values, out interface{}) error {
+	query.Set("appid", p.APIKey)
+	query.Set("units", "metric")
+	endpoint := p.BaseURL + path + "?" + query.Encode()
+	var err error
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.RetryDelay << (attempt - 1))
+		}
+		if err = p.fetch(endpoint, out); err == nil {
+			return nil
+		}
+		var apiErr *weatherAPIError
+		if errors.As(err, &apiErr) && !apiErr.retryable {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *HTTPWeatherProvider) fetch(endpoint string, out interface{}) error {
+	resp, err := p.Client.Get(endpoint)
+	if err != nil {
+		// The error text includes the URL, which carries the API key.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("failed to fetch weather data: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, weatherMaxResponse))
+		return &weatherAPIError{
+			status:    resp.StatusCode,
+			retryable: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+		}
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, weatherMaxResponse)).Decode(out); err != nil {
+		return fmt.Errorf("failed to parse weather response: %w", err)
+	}
+	return nil
+}
+
+// owmConditions is the part of an OpenWeatherMap reading used here.
+type owmConditions struct {
+	Main struct {
+		Temp     float64 `json:"temp"`
+		Humidity float64 `json:"humidity"`
+	} `json:"main"`
+	Weather []struct {
+		Description string `json:"description"`
+	} `json:"weather"`
+	Name string `json:"name"`
+	Dt   int64  `json:"dt"`
+}
+
+func (c owmConditions) toWeatherData(location string) WeatherData {
+	w := WeatherData{
+		Temperature: c.Main.Temp,
+		Humidity:    c.Main.Humidity,
+		Conditions:  "Unknown",
+		Location:    c.Name,
+		Timestamp:   time.Now(),
+	}
+	if len(c.Weather) > 0 {
+		w.Conditions = c.Weather[0].Description
+	}
+	if w.Location == "" {
+		w.Location = location
+	}
+	if c.Dt > 0 {
+		w.Timestamp = time.Unix(c.Dt, 0)
+	}
+	return w
+}
+
+func (p *HTTPWeatherProvider) Current(location string) (WeatherData, error) {
+	var reply owmConditions
+	if err := p.get("/data/2.5/weather", url.Values{"q": {location}}, &reply); err != nil {
+		return WeatherData{}, err
+	}
+	return reply.toWeatherData(location), nil
+}
+
+// owmForecast is an OpenWeatherMap hourly forecast reply.
+type owmForecast struct {
+	List []owmConditions `json:"list"`
+}
+
+func (p *HTTPWeatherProvider) Forecast(location string, hours int) ([]ForecastHour, error) {
+	var reply owmForecast
+	query := url.Values{"q": {location}, "cnt": {strconv.Itoa(hours)}}
+	if err := p.get("/data/2.5/forecast/hourly", query, &reply); err != nil {
+		return nil, err
+	}
+	forecast := []ForecastHour{}
+	for _, c := range reply.List {
+		if c.Dt == 0 {
+			continue
+		}
+		w := c.toWeatherData(location)
+		forecast = append(forecast, ForecastHour{Time: w.Timestamp, Temperature: w.Temperature, Humidity: w.Humidity, Conditions: w.Conditions})
+	}
+	if len(forecast) == 0 {
+		return nil, errors.New("weather API returned an empty forecast")
+	}
+	return forecast, nil
+}
+
+type WeatherConfig struct {
+	Provider       string
+	BaseURL        string
+	TimeoutSeconds float64
+	Retries        int
+}
+
+func LoadWeatherConfig() WeatherConfig {
+	return WeatherConfig{
+		Provider:       GetSetting("weather_provider", WeatherProviderSimulated),
+		BaseURL:        GetSetting("weather_base_url", defaultWeatherBaseURL),
+		TimeoutSeconds: GetSettingFloat("weather_timeout_seconds", 5),
+		Retries:        int(GetSettingFloat("weather_retries", 2)),
+	}
+}
+
+// weatherAPIKey prefers the environment so the key need not be stored.
+func weatherAPIKey() string {
+	if key := os.Getenv(weatherAPIKeyEnv); key != "" {
+		return key
+	}
+	return DecryptSensitiveData(GetSetting("weather_api_key", ""))
+}
+
+// SetWeatherConfig changes the weather provider. A non-empty apiKey replaces
+// the stored key.
+func SetWeatherConfig(cfg WeatherConfig, apiKey string, user *User) error {
+	if user.Role != "homeowner" && user.Role != "technician" {
+		return errors.New("only homeowners or technicians can configure weather")
+	}
+	if cfg.Provider != WeatherProviderSimulated && cfg.Provider != WeatherProviderOpenWeatherMap {
+		return errors.New("provider must be simulated or openweathermap")
+	}
+	u, err := url.Parse(cfg.BaseURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(cfg.BaseURL) > 200 {
+		return errors.New("base URL must be an http(s) URL")
+	}
+	if cfg.TimeoutSeconds < 1 || cfg.TimeoutSeconds > 60 {
+		return errors.New("timeout must be 1-60 seconds")
+	}
+	if cfg.Retries < 0 || cfg.Retries > 5 {
+		return errors.New("retries must be 0-5")
+	}
+	if len(apiKey) > 128 {
+		return errors.New("API key too long")
+	}
+	if cfg.Provider == WeatherProviderOpenWeatherMap && apiKey == "" && weatherAPIKey() == "" {
+		return errors.New("an API key is required (or set " + weatherAPIKeyEnv + ")")
+	}
+	for _, kv := range [][2]string{
+		{"weather_provider", cfg.Provider},
+		{"weather_base_url", cfg.BaseURL},
+		{"weather_timeout_seconds", fmt.Sprintf("%g", cfg.TimeoutSeconds)},
+		{"weather_retries", fmt.Sprintf("%d", cfg.Retries)},
+	} {
+		if err := SetSetting(kv[0], kv[1], user.Username); err != nil {
+			return err
+		}
+	}
+	if apiKey != "" {
+		// Stored directly so the key does not end up in the audit log.
+		_, err := db.Exec(`INSERT INTO settings (key, value, updated_by, updated_at) VALUES ('weather_api_key', ?, ?, CURRENT_TIMESTAMP)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_by = excluded.updated_by, updated_at = CURRENT_TIMESTAMP`,
+			EncryptSensitiveData(apiKey), user.Username)
+		if err != nil {
+			return err
+		}
+		LogEvent("setting_change", "Weather API key changed", user.Username, "info")
+	}
+	weatherCache.clear()
+	return nil
+}
+
+// weatherProvider builds the configured provider.
+func weatherProvider() WeatherProvider {
+	cfg := LoadWeatherConfig()
+	if cfg.Provider != WeatherProviderOpenWeatherMap {
+		return SimulatedWeatherProvider{}
+	}
+	return NewHTTPWeatherProvider(cfg.BaseURL, weatherAPIKey(), time.Duration(cfg.TimeoutSeconds*float64(time.Second)), cfg.Retries)
+}
+
+type cachedWeather struct {
+	data    WeatherData
+	fetched time.Time
+	failed  time.Time // last failed refresh, so a dead provider is not retried every tick
+}
+
+// locationCache holds recent weather per location, evicting the oldest
+// entry once full.
+type locationCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedWeather
+}
+
+func cacheKey(location string) string {
+	return strings.ToLower(strings.TrimSpace(location))
+}
+
+func (c *locationCache) get(location string, maxAge time.Duration) (WeatherData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey(location)]
+	if !ok || e.fetched.IsZero() || time.Since(e.fetched) >= maxAge {
+		return WeatherData{}, false
+	}
+	return e.data, true
+}
+
+func (c *locationCache) fail(location string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[cacheKey(location)]; ok {
+		e.failed = time.Now()
+		c.entries[cacheKey(location)] = e
+		return
+	}
+	c.store(cacheKey(location), cachedWeather{failed: time.Now()})
+}
+
+func (c *locationCache) recentlyFailed(location string, within time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey(location)]
+	return ok && !e.failed.IsZero() && time.Since(e.failed) < within
+}
+
+func (c *locationCache) put(location string, data WeatherData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(cacheKey(location), cachedWeather{data: data, fetched: time.Now()})
+}
+
+// store saves an entry, evicting the oldest one if the cache is full.
+// Callers must hold c.mu.
+func (c *locationCache) store(key string, entry cachedWeather) {
+	if c.entries == nil {
+		c.entries = map[string]cachedWeather{}
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= weatherCacheSize {
+		oldest := ""
+		for k, e := range c.entries {
+			if oldest == "" || e.fetched.Before(c.entries[oldest].fetched) {
+				oldest = k
+			}
+		}
+		delete(c.entries, oldest)
+	}
+	c.entries[key] = entry
+}
+
+func (c *locationCache) clear() {
+	c.mu.Lock()
+	c.entries = nil
+	c.mu.Unlock()
+}
+
+var weatherCache locationCache
+
+func GetOutdoorWeather(location string) (WeatherData, error) {
+	if len(location) < 2 || len(location) > 100 {
+		return WeatherData{}, errors.New("invalid location")
+	}
+	if weather, ok := weatherCache.get(location, cacheDuration); ok {
+		LogEvent("weather_cache", "Weather from cache", "system", "info")
+		return weather, nil
+	}
+	if weatherCache.recentlyFailed(location, weatherRetryAfter) {
+		if stale, ok := weatherCache.get(location, weatherStaleLimit); ok {
+			return stale, nil
+		}
+		return WeatherData{}, errors.New("weather unavailable, retrying shortly")
+	}
+	provider := weatherProvider()
+	weather, err := provider.Current(location)
+	if err != nil {
+		weatherCache.fail(location)
+		LogEvent("weather_error", fmt.Sprintf("Weather fetch for %s from %s failed: %v", location, provider.Name(), err), "system", "warning")
+		// Slightly old weather is better than none for the control loops.
+		if stale, ok := weatherCache.get(location, weatherStaleLimit); ok {
+			return stale, nil
+		}
+		return WeatherData{}, err
+	}
+	weatherCache.put(location, weather)
+	recordOutdoorTemperature(location, weather)
+	LogEvent("weather_fetch", "Weather fetched for "+location+" from "+provider.Name(), "system", "info")
+	return weather, nil
+}
+
 func DisplayWeather(weather WeatherData) string {
 	return "Location: " + weather.Location + "\nTemperature: " + formatFloat(weather.Temperature) + "°C\nHumidity: " + formatFloat(weather.Humidity) + "%\nConditions: " + weather.Conditions + "\nUpdated: " + weather.Timestamp.Format("15:04:05")
 }
@@ -52,110 +433,3 @@ func DisplayWeather(weather WeatherData) string {
 func formatFloat(f float64) string {
 	return fmt.Sprintf("%.1f", f)
 }
-
-// package main
-
-// import (
-//     "encoding/json"         // For decoding JSON from the API
-//     "errors"                // For meaningful error returns
-//     "fmt"                   // For string formatting
-//     "io/ioutil"             // For reading HTTP response body
-//     "net/http"              // For HTTP requests
-//     "time"                  // For timestamps and cache expiration
-// )
-
-// // WeatherData holds the weather information retrieved from the API
-// type WeatherData struct {
-//     Temperature float64   // Temperature in Celsius
-//     Humidity    float64   // Humidity as a percentage
-//     Conditions  string    // Weather condition description
-//     Location    string    // Name of the location
-//     Timestamp   time.Time // Time when the weather was fetched
-// }
-
-// // Cached weather and timing
-// var cachedWeather WeatherData
-// var lastFetch time.Time
-// var cacheDuration = 10 * time.Minute
-
-// // Substitute this with your actual OpenWeatherMap API key
-// const openWeatherMapAPIKey = "YOUR_API_KEY_HERE"
-
-// // GetOutdoorWeather fetches real weather for a given location, returns WeatherData struct
-// func GetOutdoorWeather(location string) (WeatherData, error) {
-//     // Check cache for recent data for the same location
-//     if time.Since(lastFetch) < cacheDuration && cachedWeather.Location == location {
-//         LogEvent("weather_cache", "Weather served from cache", "system", "info")
-//         return cachedWeather, nil
-//     }
-//     // Input validation: basic sanity for location string
-//     if len(location) < 2 || len(location) > 100 {
-//         return WeatherData{}, errors.New("invalid location name")
-//     }
-//     // Compose the API request URL (metric units)
-//     url := fmt.Sprintf(
-//         "https://api.openweathermap.org/data/2.5/weather?q=%s&appid=%s&units=metric",
-//         location, openWeatherMapAPIKey)
-//     // Make HTTP GET request
-//     resp, err := http.Get(url)
-//     if err != nil {
-//         return WeatherData{}, fmt.Errorf("failed to fetch weather data: %v", err)
-//     }
-//     defer resp.Body.Close()
-//     if resp.StatusCode != http.StatusOK {
-//         return WeatherData{}, fmt.Errorf("weather API error: status code %d", resp.StatusCode)
-//     }
-//     // Read response body
-//     bodyBytes, err := ioutil.ReadAll(resp.Body)
-//     if err != nil {
-//         return WeatherData{}, fmt.Errorf("failed to read weather response: %v", err)
-//     }
-//     // Minimal struct to parse only needed fields from API JSON
-//     var apiResp struct {
-//         Main struct {
-//             Temp     float64 `json:"temp"`
-//             Humidity float64 `json:"humidity"`
-//         } `json:"main"`
-//         Weather []struct {
-//             Description string `json:"description"`
-//         } `json:"weather"`
-//         Name string `json:"name"`
-//     }
-//     if err := json.Unmarshal(bodyBytes, &apiResp); err != nil {
-//         return WeatherData{}, fmt.Errorf("failed to parse weather JSON: %v", err)
-//     }
-//     // Build result struct with parsed data
-//     weather := WeatherData{
-//         Temperature: apiResp.Main.Temp,
-//         Humidity:    apiResp.Main.Humidity,
-//         Conditions:  "",
-//         Location:    apiResp.Name,
-//         Timestamp:   time.Now(),
-//     }
-//     if len(apiResp.Weather) > 0 {
-//         weather.Conditions = apiResp.Weather[0].Description
-//     } else {
-//         weather.Conditions = "Unknown"
-//     }
-//     // Update and record cache
-//     cachedWeather = weather
-//     lastFetch = time.Now()
-//     LogEvent("weather_fetch", "Real weather fetched for "+location, "system", "info")
-//     return weather, nil
-// }
-
-// // DisplayWeather returns a formatted string for displaying weather info
-// func DisplayWeather(weather WeatherData) string {
-//     return fmt.Sprintf(
-//         "Location: %s\nTemperature: %.1f°C\nHumidity: %.1f%%\nConditions: %s\nUpdated: %s",
-//         weather.Location,
-//         weather.Temperature,
-//         weather.Humidity,
-//         weather.Conditions,
-//         weather.Timestamp.Format("15:04:05"))
-// }
-
-// // LogEvent is part of your existing logging.go (called here for audit)
-// func LogEvent(eventType, details, username, severity string) {
-//     // Assume this logs to the audit trail
-// }
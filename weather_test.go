@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStubProvider(t *testing.T, stub *WeatherStub, apiKey string) *HTTPWeatherProvider {
+	t.Helper()
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	provider := NewHTTPWeatherProvider(server.URL, apiKey, 2*time.Second, 2)
+	provider.RetryDelay = time.Millisecond
+	return provider
+}
+
+func TestHTTPWeatherProviderCurrent(t *testing.T) {
+	stub := &WeatherStub{APIKey: "secret-key"}
+	provider := newStubProvider(t, stub, "secret-key")
+
+	weather, err := provider.Current("Oslo")
+	if err != nil {
+		t.Fatalf("Current: %v", err)
+	}
+	temp, humidity, conditions := stubConditions("Oslo", time.Unix(weather.Timestamp.Unix(), 0))
+	if weather.Location != "Oslo" || weather.Humidity != humidity || weather.Conditions != conditions {
+		t.Errorf("got %+v, want Oslo with humidity %.0f and %q", weather, humidity, conditions)
+	}
+	if diff := weather.Temperature - temp; diff > 0.05 || diff < -0.05 {
+		t.Errorf("temperature %.1f, want %.1f", weather.Temperature, temp)
+	}
+	if got := stub.Requests(); got != 1 {
+		t.Errorf("%d requests, want 1", got)
+	}
+}
+
+func TestHTTPWeatherProviderRetriesUnavailable(t *testing.T) {
+	stub := &WeatherStub{}
+	provider := newStubProvider(t, stub, "")
+	stub.FailNext(1)
+
+	if _, err := provider.Current("Oslo"); err != nil {
+		t.Fatalf("Current after one 503: %v", err)
+	}
+	if got := stub.Requests(); got != 2 {
+		t.Errorf("%d requests, want 2", got)
+	}
+
+	stub.FailNext(provider.Retries + 1)
+	_, err := provider.Current("Oslo")
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("Current with every attempt failing: got %v, want a 503 error", err)
+	}
+	if got := stub.Requests(); got != 2+provider.Retries+1 {
+		t.Errorf("%d requests, want %d", got, 2+provider.Retries+1)
+	}
+}
+
+func TestHTTPWeatherProviderDoesNotRetryUnauthorized(t *testing.T) {
+	stub := &WeatherStub{APIKey: "right-key"}
+	provider := newStubProvider(t, stub, "wrong-key-1234")
+
+	_, err := provider.Current("Oslo")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("got %v, want a 401 error", err)
+	}
+	if got := stub.Requests(); got != 1 {
+		t.Errorf("%d requests, want 1", got)
+	}
+	if strings.Contains(err.Error(), "wrong-key-1234") {
+		t.Errorf("error leaks the API key: %v", err)
+	}
+}
+
+func TestHTTPWeatherProviderHidesKeyInNetworkErrors(t *testing.T) {
+	server := httptest.NewServer(&WeatherStub{})
+	url := server.URL
+	server.Close()
+	provider := NewHTTPWeatherProvider(url, "leaky-key-5678", time.Second, 0)
+
+	_, err := provider.Current("Oslo")
+	if err == nil {
+		t.Fatal("Current against a closed server succeeded")
+	}
+	if strings.Contains(err.Error(), "leaky-key-5678") {
+		t.Errorf("error leaks the API key: %v", err)
+	}
+}
+
+func TestLocationCache(t *testing.T) {
+	var cache locationCache
+	cache.put("Oslo", WeatherData{Location: "Oslo", Temperature: 3})
+	cache.put("Bergen", WeatherData{Location: "Bergen", Temperature: 7})
+
+	if w, ok := cache.get(" oslo ", time.Minute); !ok || w.Temperature != 3 {
+		t.Errorf("get oslo: %+v %v, want the Oslo entry", w, ok)
+	}
+	if w, ok := cache.get("Bergen", time.Minute); !ok || w.Temperature != 7 {
+		t.Errorf("get Bergen: %+v %v, want the Bergen entry", w, ok)
+	}
+	if _, ok := cache.get("Oslo", 0); ok {
+		t.Error("entry older than maxAge was returned")
+	}
+	if _, ok := cache.get("Tromsø", time.Minute); ok {
+		t.Error("uncached location was returned")
+	}
+
+	cache.fail("Oslo")
+	if !cache.recentlyFailed("Oslo", time.Minute) || cache.recentlyFailed("Bergen", time.Minute) {
+		t.Error("failure not recorded for Oslo alone")
+	}
+	if _, ok := cache.get("Oslo", time.Minute); !ok {
+		t.Error("failed refresh dropped the cached Oslo weather")
+	}
+}
+
+func TestLocationCacheEvictsOldest(t *testing.T) {
+	var cache locationCache
+	base := time.Now()
+	cache.mu.Lock()
+	for i := 0; i < weatherCacheSize; i++ {
+		// Distinct fetch times, oldest first, so eviction order is certain
+		cache.store(fmt.Sprintf("city-%d", i), cachedWeather{data: WeatherData{Temperature: float64(i)}, fetched: base.Add(time.Duration(i-weatherCacheSize) * time.Second)})
+	}
+	cache.mu.Unlock()
+	cache.put("city-0", WeatherData{Temperature: 100}) // refreshing an entry does not evict
+	if _, ok := cache.get("city-1", time.Minute); !ok {
+		t.Fatal("refreshing an existing entry evicted another")
+	}
+
+	cache.put("one-more", WeatherData{})
+	if _, ok := cache.get("city-1", time.Minute); ok {
+		t.Error("oldest entry was not evicted")
+	}
+	for _, location := range []string{"city-0", "city-2", "one-more"} {
+		if _, ok := cache.get(location, time.Minute); !ok {
+			t.Errorf("%s was evicted", location)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WeatherStub serves OpenWeatherMap-shaped current conditions and hourly
+// forecasts with deterministic data per location, so the HTTP provider can
+// be exercised without network access or an API key. Run it standalone with
+// -weather-stub <addr> and point the weather base URL at it.
+type WeatherStub struct {
+	APIKey string // if set, requests must carry it as appid
+
+	mu       sync.Mutex
+	failNext int
+	requests int
+}
+
+// FailNext makes the next n requests return 503, to exercise retries.
+func (s *WeatherStub) FailNext(n int) {
+	s.mu.Lock()
+	s.failNext = n
+	s.mu.Unlock()
+}
+
+// Requests returns how many requests the stub has received.
+func (s *WeatherStub) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// stubConditions derives stable weather for a location, varying smoothly
+// with the time of day.
+func stubConditions(location string, at time.Time) (temp, humidity float64, conditions string) {
+	h := fnv.New32a()
+	h.Write([]byte(cacheKey(location)))
+	seed := h.Sum32()
+	base := float64(seed%30) - 5
+	hour := float64(at.Hour()) + float64(at.Minute())/60
+	temp = base + 4*math.Sin((hour-9)/24*2*math.Pi)
+	humidity = 40 + float64(seed/30%50)
+	conditions = []string{"clear sky", "few clouds", "overcast clouds", "light rain", "snow"}[seed%5]
+	return temp, humidity, conditions
+}
+
+func (s *WeatherStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	fail := s.failNext > 0
+	if fail {
+		s.failNext--
+	}
+	s.mu.Unlock()
+
+	if fail {
+		http.Error(w, `{"cod":503,"message":"stub failure"}`, http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	if s.APIKey != "" && !SecureCompare(query.Get("appid"), s.APIKey) {
+		http.Error(w, `{"cod":401,"message":"Invalid API key"}`, http.StatusUnauthorized)
+		return
+	}
+	location := query.Get("q")
+	if location == "" {
+		http.Error(w, `{"cod":400,"message":"Nothing to geocode"}`, http.StatusBadRequest)
+		return
+	}
+	var reply interface{}
+	switch r.URL.Path {
+	case "/data/2.5/weather":
+		reply = stubReading(location, time.Now())
+	case "/data/2.5/forecast/hourly":
+		count, err := strconv.Atoi(query.Get("cnt"))
+		if err != nil || count < 1 || count > 96 {
+			count = 96
+		}
+		forecast := owmForecast{}
+		start := time.Now().Truncate(time.Hour).Add(time.Hour)
+		for i := 0; i < count; i++ {
+			forecast.List = append(forecast.List, stubReading(location, start.Add(time.Duration(i)*time.Hour)))
+		}
+		reply = forecast
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+func stubReading(location string, at time.Time) owmConditions {
+	temp, humidity, conditions := stubConditions(location, at)
+	var reading owmConditions
+	reading.Main.Temp = math.Round(temp*10) / 10
+	reading.Main.Humidity = humidity
+	reading.Weather = append(reading.Weather, struct {
+		Description string `json:"description"`
+	}{conditions})
+	reading.Name = location
+	reading.Dt = at.Unix()
+	return reading
+}
+
+// StartWeatherStub serves the stub on addr in the background and returns
+// the server and the address it listens on.
+func StartWeatherStub(addr string, stub *WeatherStub) (*http.Server, string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, "", err
+	}
+	server := &http.Server{Handler: stub, ReadHeaderTimeout: 5 * time.Second}
+	go server.Serve(listener)
+	return server, listener.Addr().String(), nil
+}